@@ -0,0 +1,212 @@
+// graphite-write-proxy accepts Graphite metrics in the metrictank formats and
+// writes them to a Mimir-compatible Prometheus remote write endpoint.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/appcommon"
+	"github.com/grafana/mimir-graphite/v2/pkg/graphite/writeproxy"
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite"
+	"github.com/grafana/mimir-graphite/v2/pkg/route"
+)
+
+const (
+	serviceName  = "graphite-write-proxy"
+	metricPrefix = "graphite_proxy"
+
+	// metricsPath is the path metrictank and its clients use to ingest data.
+	metricsPath = "/metrics"
+
+	configFileFlag = "config.file"
+
+	// primaryDestination is the name of the main remote write destination.
+	primaryDestination = "primary"
+)
+
+// This value will be overridden during the build process using -ldflags.
+var version = "development"
+
+// Config is the full configuration of the binary. Both configs are inlined so
+// the YAML file uses the same keys as their own yaml tags.
+type Config struct {
+	App        appcommon.Config  `yaml:",inline"`
+	WriteProxy writeproxy.Config `yaml:",inline"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (c *Config) RegisterFlags(flags *flag.FlagSet) {
+	c.App.RegisterFlags(flags)
+	c.WriteProxy.RegisterFlags(flags)
+}
+
+func main() {
+	var (
+		cfg         Config
+		configFile  string
+		versionFlag bool
+	)
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&configFile, configFileFlag, "", "Path to a YAML configuration file. Flags given on the command line take precedence over the file.")
+	flag.BoolVar(&versionFlag, "version", false, "Display the version of the binary")
+
+	// Parse the config file first, so that command line flags can override
+	// any value set there.
+	if path := parseConfigFileParameter(os.Args[1:]); path != "" {
+		if err := LoadConfig(path, &cfg); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: error loading config file %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+	flag.Parse()
+
+	if versionFlag {
+		_, _ = fmt.Fprintf(os.Stdout, "%s\n", version)
+		os.Exit(0)
+	}
+
+	if cfg.App.ServiceName == "" {
+		cfg.App.ServiceName = serviceName
+	}
+
+	if err := run(cfg); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg Config) error {
+	reg := prometheus.DefaultRegisterer
+
+	app, err := appcommon.New(cfg.App, reg, metricPrefix, nil)
+	if err != nil {
+		return fmt.Errorf("can't create app: %w", err)
+	}
+	defer func() {
+		_ = app.Close()
+	}()
+
+	remoteWriteRecorder := remotewrite.NewRecorder(metricPrefix, reg)
+	client, err := newRemoteWriteClient(&app, cfg.WriteProxy.RemoteWriteConfig, primaryDestination, remoteWriteRecorder, reg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.WriteProxy.AdditionalRemoteWrites) > 0 {
+		destinations := []remotewrite.Destination{{Name: primaryDestination, Client: client}}
+		for _, destCfg := range cfg.WriteProxy.AdditionalRemoteWrites {
+			destClient, err := newRemoteWriteClient(&app, destCfg.Config, destCfg.Name, remoteWriteRecorder, reg)
+			if err != nil {
+				return err
+			}
+			if destCfg.OrgID != "" {
+				destClient = remotewrite.NewTenantClient(destClient, destCfg.OrgID)
+			}
+			destinations = append(destinations, remotewrite.Destination{Name: destCfg.Name, Client: destClient})
+		}
+		client, err = remotewrite.NewFanOutClient(cfg.WriteProxy.RemoteWritePolicy, destinations, metricPrefix, reg)
+		if err != nil {
+			return fmt.Errorf("can't create remote write fan-out: %w", err)
+		}
+	}
+
+	overrides, err := writeproxy.NewOverrides(cfg.WriteProxy.Limits, reg, app.Logger)
+	if err != nil {
+		return fmt.Errorf("can't create limits: %w", err)
+	}
+	app.Group.Add(overrides.Handler())
+
+	var aggregator *writeproxy.Aggregator
+	if cfg.WriteProxy.Aggregation.Enabled() {
+		aggregator, err = writeproxy.NewAggregator(cfg.WriteProxy.Aggregation, metricPrefix, reg, app.Logger)
+		if err != nil {
+			return fmt.Errorf("can't create aggregator: %w", err)
+		}
+		app.Group.Add(aggregator.Handler())
+	}
+
+	proxy, err := writeproxy.NewRemoteWriteProxy(cfg.WriteProxy, client, writeproxy.NewRecorder(reg), overrides, aggregator)
+	if err != nil {
+		return fmt.Errorf("can't create write proxy: %w", err)
+	}
+
+	registerer := route.NewMuxRegisterer(app.Server.Router)
+	registerer.RegisterRoute(metricsPath, proxy, http.MethodPost)
+
+	for _, listenerCfg := range cfg.WriteProxy.Carbon.Listeners {
+		listener, err := writeproxy.NewCarbonListener(cfg.WriteProxy.Carbon, listenerCfg, proxy, app.Logger)
+		if err != nil {
+			return fmt.Errorf("can't create carbon listener on %s: %w", listenerCfg.Address, err)
+		}
+		app.Group.Add(listener.Handler())
+	}
+
+	level.Info(app.Logger).Log("msg", "Starting graphite write proxy", "version", version, "path", metricsPath)
+	return app.Group.Run()
+}
+
+// newRemoteWriteClient returns the client of a remote write destination,
+// with its sharding and write queue if enabled. The metrics of the write
+// queue are labelled with the name of the destination.
+func newRemoteWriteClient(app *appcommon.App, cfg remotewrite.Config, name string, recorder remotewrite.Recorder, reg prometheus.Registerer) (remotewrite.Client, error) {
+	client, err := remotewrite.NewClient(cfg, recorder, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create remote write client %s: %w", name, err)
+	}
+	if cfg.Sharding.Enabled() {
+		client = remotewrite.NewShardingClient(cfg.Sharding, client, recorder, app.Tracer, time.Now)
+	}
+	client = remotewrite.NewMeasuredClient(client, recorder, app.Tracer, time.Now)
+
+	if cfg.Queue.Enabled() {
+		queueReg := prometheus.WrapRegistererWith(prometheus.Labels{"destination": name}, reg)
+		queue, err := remotewrite.NewQueueClient(cfg.Queue, client, metricPrefix, queueReg, app.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("can't create write queue of %s: %w", name, err)
+		}
+		app.Group.Add(queue.Handler())
+		app.Readiness.Add(queue)
+		client = queue
+	}
+	return client, nil
+}
+
+// LoadConfig reads the YAML file at path into cfg. Fields absent from the
+// file keep their current values.
+func LoadConfig(path string, cfg *Config) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// parseConfigFileParameter returns the value of the config file flag, if
+// present, without parsing any of the other flags.
+func parseConfigFileParameter(args []string) (configFile string) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&configFile, configFileFlag, "", "")
+
+	// Parse one argument at a time so unknown flags don't stop the search.
+	for len(args) > 0 {
+		_ = fs.Parse(args)
+		args = args[1:]
+	}
+	return configFile
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"flag"
 	"fmt"
@@ -16,9 +17,14 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/mimir/pkg/storage/bucket"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert/whisperconverter"
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite"
 )
 
 const (
@@ -26,6 +32,8 @@ const (
 	DATERANGE = "daterange"
 	PASS1     = "pass1"
 	PASS2     = "pass2"
+	BACKFILL  = "backfill"
+	UPLOAD    = "upload"
 )
 
 // This value will be overridden during the build process using -ldflags.
@@ -92,6 +100,31 @@ var (
 		"",
 		"An optional comma-separated list of extra label name to label value to be applied to all metrics during conversion. This can be useful if you want to mark all metrics as coming from a specific archive, for example. This is applied during the second pass and has no effect on the first pass conversion.",
 	)
+	aggregationMethodLabel = flag.String(
+		"aggregation-method-label",
+		"",
+		"An optional label name storing the aggregationMethod of each Whisper file (average, sum, last, max or min) in its series, so that downsampled data isn't misinterpreted. This is applied during the first pass.",
+	)
+	archiveResolutionLabel = flag.String(
+		"archive-resolution-label",
+		"",
+		"An optional label name storing the resolution of the Whisper archives. If set, each archive is converted to a separate series with its resolution in this label, instead of stitching the downsampled archives onto the raw archive. This is applied during the first pass.",
+	)
+	blockOrgID = flag.String(
+		"block-org-id",
+		"",
+		"An optional tenant recorded in the Thanos external labels of the meta.json of the generated blocks. This is applied during the second pass.",
+	)
+	blockExternalLabels = flag.String(
+		"block-external-labels",
+		"",
+		"An optional comma-separated list of label name to label value recorded as Thanos external labels in the meta.json of the generated blocks. This is applied during the second pass.",
+	)
+	blockResolution = flag.Duration(
+		"block-resolution",
+		0,
+		"The downsampling resolution recorded in the meta.json of the generated blocks. Leave to 0 for raw data, as expected by Mimir. This is applied during the second pass.",
+	)
 
 	versionFlag = flag.Bool("version", false, "Display the version of the binary")
 	verboseFlag = flag.Bool("verbose", false, "If true, outputs info logging")
@@ -100,8 +133,47 @@ var (
 
 	startDateFlag = flag.String("start-date", "", "The earliest date to process in YYYY-MM-DD format")
 	endDateFlag   = flag.String("end-date", "", "The last date to process in YYYY-MM-DD format")
+
+	backfillOrgID = flag.String(
+		"backfill-org-id",
+		"anonymous",
+		"The tenant the backfill command writes to.",
+	)
+	backfillBatchSize = flag.Int(
+		"backfill-batch-size",
+		5000, //nolint:gomnd
+		"Maximum number of samples per remote write request of the backfill command.",
+	)
+	backfillSamplesPerSecond = flag.Float64(
+		"backfill-samples-per-second",
+		0,
+		"Maximum number of samples per second written by the backfill command. 0 to disable the limit.",
+	)
+
+	uploadOrgID = flag.String(
+		"upload-org-id",
+		"anonymous",
+		"The tenant the upload command uploads the blocks for.",
+	)
+	resumeUpload = flag.Bool(
+		"resume-upload",
+		true,
+		"If true, the blocks uploaded by a previous run of the upload command are skipped. If false, all the blocks are uploaded again.",
+	)
+
+	// remoteWriteConfig configures the remote write client of the backfill
+	// command, with flags prefixed by "backfill.".
+	remoteWriteConfig remotewrite.Config
+	// bucketConfig configures the object storage of the upload command, with
+	// flags prefixed by "upload.".
+	bucketConfig bucket.Config
 )
 
+func init() {
+	remoteWriteConfig.RegisterFlagsWithPrefix("backfill", flag.CommandLine)
+	bucketConfig.RegisterFlagsWithPrefix("upload.", flag.CommandLine)
+}
+
 // Will be simplifying main() as we go.
 //
 //nolint:gocyclo
@@ -143,6 +215,21 @@ The commands are:
 
 			Required flags: , --start-date, --end-date, --intermediate-directory, --blocks-directory
 
+	backfill	Write the Whisper files to a Mimir remote write endpoint instead of
+			generating blocks, for smaller migrations without access to the object
+			storage. Samples rejected by the endpoint, for example because they are
+			out of order, are logged and skipped. The backfilled files are tracked
+			in the intermediate directory, so the backfill can be resumed. If
+			--start-date and --end-date are set, only these dates are written.
+
+			Required flags: --whisper-directory, --intermediate-directory, --backfill.write-endpoint
+
+	upload		Upload the finished Mimir blocks to the object storage of Mimir, under
+			the tenant of --upload-org-id. The uploaded blocks are tracked in the
+			blocks directory, so the upload can be resumed.
+
+			Required flags: --blocks-directory, --upload.backend and its options
+
 Flags:
 
 `)
@@ -182,7 +269,9 @@ Example Usage:
 	}
 
 	var dates []time.Time
-	if command != DATERANGE && command != FILELIST {
+	// The dates are optional for the backfill, which writes all of them by
+	// default.
+	if command != DATERANGE && command != FILELIST && command != UPLOAD && (command != BACKFILL || *startDateFlag != "" || *endDateFlag != "") {
 		if *startDateFlag == "" {
 			_, _ = fmt.Fprintf(os.Stderr, "ERROR: Need to specify --start-date\n")
 			flag.Usage()
@@ -233,7 +322,14 @@ Example Usage:
 		dates,
 		logger,
 	)
-
+	converter.SetArchiveLabels(*aggregationMethodLabel, *archiveResolutionLabel)
+	converter.SetBlockMeta(whisperconverter.BlockMetaConfig{
+		OrgID:          *blockOrgID,
+		ExternalLabels: ParseCustomLabels(*blockExternalLabels).Map(),
+		Resolution:     *blockResolution,
+	})
+
+	http.Handle("/metrics", promhttp.Handler())
 	go func() {
 		err := http.ListenAndServe("localhost:8081", nil)
 		if err != nil {
@@ -264,6 +360,36 @@ Example Usage:
 			level.Error(logger).Log("msg", "Error running pass2", "err", err)
 			os.Exit(1)
 		}
+	case BACKFILL:
+		client, err := newBackfillClient(remoteWriteConfig)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating remote write client", "err", err)
+			os.Exit(1)
+		}
+		err = converter.CommandBackfill(*targetWhisperFiles, *intermediateDirectory, *resumeIntermediate, client, whisperconverter.BackfillConfig{
+			OrgID:            *backfillOrgID,
+			BatchSize:        *backfillBatchSize,
+			SamplesPerSecond: *backfillSamplesPerSecond,
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", "Error running backfill", "err", err)
+			os.Exit(1)
+		}
+	case UPLOAD:
+		if err := bucketConfig.Validate(); err != nil {
+			level.Error(logger).Log("msg", "Invalid object storage config", "err", err)
+			os.Exit(1)
+		}
+		bkt, err := bucket.NewClient(context.Background(), bucketConfig, "whisper-converter", logger, prometheus.DefaultRegisterer)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating object storage client", "err", err)
+			os.Exit(1)
+		}
+		err = converter.CommandUpload(*blocksDirectory, bkt, *uploadOrgID, *resumeUpload)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error running upload", "err", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "ERROR: Unknown command: %s\n", command)
 		flag.Usage()
@@ -275,6 +401,27 @@ Example Usage:
 	level.Info(logger).Log("msg", fmt.Sprintf("All done. Processed %d files, %d skipped", processed, skipped))
 }
 
+// newBackfillClient returns the remote write client of the backfill command,
+// with its sharding if enabled. Its metrics are exposed along with pprof.
+func newBackfillClient(cfg remotewrite.Config) (remotewrite.Client, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("need to specify --backfill.write-endpoint")
+	}
+	if cfg.Queue.Enabled() {
+		return nil, fmt.Errorf("the write queue isn't supported by the backfill command")
+	}
+
+	recorder := remotewrite.NewRecorder("whisper_converter", prometheus.DefaultRegisterer)
+	client, err := remotewrite.NewClient(cfg, recorder, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Sharding.Enabled() {
+		client = remotewrite.NewShardingClient(cfg.Sharding, client, recorder, opentracing.NoopTracer{}, time.Now)
+	}
+	return client, nil
+}
+
 // ParseCustomLabels converts a csv string to a labels.Labels slice. panics on
 // error.
 func ParseCustomLabels(arg string) labels.Labels {
@@ -67,7 +67,10 @@ type App struct {
 	LogProvider ctxlog.Provider
 	Server      *server.Server
 	Tracer      opentracing.Tracer
-	closers     []func() error
+	// Readiness reports the app as ready when all its providers are, more
+	// providers can be added to it.
+	Readiness *internalserver.ReadinessProviders
+	closers   []func() error
 }
 
 func init() {
@@ -154,7 +157,9 @@ func New(cfg Config, reg prometheus.Registerer, metricPrefix string, tracer open
 	app.Server = srv
 
 	signalHandler := stopsignal.NewSignalHandler(cfg.InternalServerConfig.ServerGracefulShutdownTimeout, logger)
-	cfg.InternalServerConfig.ReadinessProvider = signalHandler
+	app.Readiness = &internalserver.ReadinessProviders{}
+	app.Readiness.Add(signalHandler)
+	cfg.InternalServerConfig.ReadinessProvider = app.Readiness
 
 	app.Group.Add(app.Server.Handler())
 	app.Group.Add(internalserver.Handler(logger, cfg.InternalServerConfig))
@@ -12,6 +12,35 @@ const (
 	UntaggedMetricName = "graphite_untagged"
 )
 
+// LabelsFromName returns the labels of a Graphite name, which is either a
+// Graphite 1.1 tagged name, "name;tag1=value1;tag2=value2", or an untagged
+// dotted path.
+func LabelsFromName(name string, builder *labels.Builder) (labels.Labels, error) {
+	name, rest, tagged := strings.Cut(name, ";")
+	if !tagged {
+		return LabelsFromUntaggedName(name, builder), nil
+	}
+	return LabelsFromTaggedName(name, strings.Split(rest, ";"), builder)
+}
+
+func LabelsFromTaggedName(name string, tags []string, builder *labels.Builder) (labels.Labels, error) {
+	// 1 per tag, +1 for the graphite name, +1 for the prom name
+	builder.Reset(make(labels.Labels, 0, len(tags)+2)) //nolint:gomnd
+
+	for _, tag := range tags {
+		equalIdx := strings.Index(tag, "=")
+		if equalIdx <= 0 || equalIdx == len(tag)-1 {
+			return nil, fmt.Errorf("encountered invalid tag %s", tag)
+		}
+		builder.Set(tag[:equalIdx], tag[equalIdx+1:])
+	}
+
+	builder.Set("name", name)
+	builder.Set("__name__", TaggedMetricName)
+
+	return builder.Labels(), nil
+}
+
 func LabelsFromUntaggedName(name string, builder *labels.Builder) labels.Labels {
 	// number of metric name nodes, +1 for the prom name
 	builder.Reset(make(labels.Labels, 0, strings.Count(name, ".")+2)) //nolint:gomnd
@@ -0,0 +1,61 @@
+package convert
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelsFromName(t *testing.T) {
+	tests := []struct {
+		name           string
+		metricName     string
+		expectedLabels labels.Labels
+		expectedErr    bool
+	}{
+		{
+			name:       "untagged",
+			metricName: "servers.www01.cpu",
+			expectedLabels: labels.FromStrings(
+				"__name__", UntaggedMetricName,
+				"__n000__", "servers",
+				"__n001__", "www01",
+				"__n002__", "cpu",
+			),
+		},
+		{
+			name:       "tagged",
+			metricName: "disk.used;host=www01;mount=/var/lib",
+			expectedLabels: labels.FromStrings(
+				"__name__", TaggedMetricName,
+				"name", "disk.used",
+				"host", "www01",
+				"mount", "/var/lib",
+			),
+		},
+		{
+			name:        "invalidTag",
+			metricName:  "disk.used;host",
+			expectedErr: true,
+		},
+		{
+			name:        "emptyTagValue",
+			metricName:  "disk.used;host=",
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lbls, err := LabelsFromName(test.metricName, labels.NewBuilder(nil))
+			if test.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.expectedLabels, lbls)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package whisperconverter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite"
+)
+
+// BackfillConfig configures the backfill of whisper files through a remote
+// write client.
+type BackfillConfig struct {
+	// OrgID is the tenant the samples are written to.
+	OrgID string
+	// BatchSize is the maximum number of samples per write request.
+	BatchSize int
+	// SamplesPerSecond limits the rate of the written samples, if positive.
+	SamplesPerSecond float64
+}
+
+// CommandBackfill reads whisper files and writes their samples to a remote
+// write endpoint through the given client, instead of generating blocks. The
+// samples of each file are written oldest first, in requests of at most
+// cfg.BatchSize samples of the same series. Requests rejected as bad, for
+// example because their samples are out of order or too old for the tenant,
+// are logged and skipped. Other errors, left once the client gave up retrying,
+// stop the backfill.
+//
+// The completely written files are recorded in a progress file in
+// progressDir, so rerunning the command resumes the backfill. If dates were
+// given to the converter, only the samples of those dates are written.
+func (c *WhisperConverter) CommandBackfill(targetWhisperFiles, progressDir string, resume bool, client remotewrite.Client, cfg BackfillConfig) error {
+	if cfg.BatchSize <= 0 {
+		return errors.New("backfill batch size must be positive")
+	}
+	err := os.MkdirAll(progressDir, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "could not create progress directory")
+	}
+
+	progressFName := filepath.Join(progressDir, "backfilledMetrics.intermediate")
+	progressFile, skippableMetrics, err := convert.NewUSTableForAppendWithIndex(progressFName, !resume, convert.NewMimirSeriesProto, c.logger)
+	if err != nil {
+		return errors.Wrap(err, "error opening backfilledMetrics intermediate file")
+	}
+	defer func() {
+		_ = progressFile.Close()
+	}()
+
+	b := &backfiller{
+		converter:        c,
+		client:           remotewrite.NewTenantClient(client, cfg.OrgID),
+		cfg:              cfg,
+		progressFile:     progressFile,
+		skippableMetrics: skippableMetrics,
+		dates:            make(map[time.Time]bool, len(c.dates)),
+	}
+	if cfg.SamplesPerSecond > 0 {
+		// The burst must allow a whole batch.
+		b.limiter = rate.NewLimiter(rate.Limit(cfg.SamplesPerSecond), cfg.BatchSize)
+	}
+	for _, d := range c.dates {
+		b.dates[d] = true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fileChan := make(chan string)
+	errChan := make(chan error, c.threads)
+	wg := &sync.WaitGroup{}
+	wg.Add(c.threads)
+	for i := 0; i < c.threads; i++ {
+		go func() {
+			defer wg.Done()
+			if err := b.backfillFromChan(ctx, fileChan); err != nil {
+				errChan <- err
+				cancel()
+			}
+		}()
+	}
+	c.getWhisperListIntoChan(targetWhisperFiles, fileChan)
+	wg.Wait()
+	close(errChan)
+
+	level.Info(c.logger).Log("msg", "backfill finished", "written_samples", b.writtenSamples, "rejected_samples", b.rejectedSamples)
+	return <-errChan
+}
+
+// backfiller writes whisper files through a remote write client.
+type backfiller struct {
+	converter        *WhisperConverter
+	client           remotewrite.Client
+	cfg              BackfillConfig
+	limiter          *rate.Limiter
+	progressFile     *convert.USTable
+	skippableMetrics map[string]int64
+	// dates are the dates to write, all if empty.
+	dates map[time.Time]bool
+
+	mu              sync.Mutex
+	writtenSamples  int
+	rejectedSamples int
+}
+
+// backfillFromChan backfills the files received from the given channel until
+// it's closed. After an error, the remaining files are drained without being
+// written.
+func (b *backfiller) backfillFromChan(ctx context.Context, files chan string) error {
+	var err error
+	for fname := range files {
+		if err != nil {
+			continue
+		}
+		err = b.backfillFile(ctx, fname)
+	}
+	return err
+}
+
+func (b *backfiller) backfillFile(ctx context.Context, fname string) error {
+	c := b.converter
+	metricName, err := c.getMetricName(fname)
+	if err != nil {
+		level.Warn(c.logger).Log("file", fname, "msg", "error getting metric name", "err", err)
+		c.progress.IncSkipped()
+		return nil
+	}
+	if _, ok := b.skippableMetrics[metricName]; ok {
+		level.Info(c.logger).Log("file", fname, "metric", metricName, "msg", "already completely backfilled in previous run, skipping")
+		c.progress.IncSkipped()
+		return nil
+	}
+	level.Info(c.logger).Log("file", fname, "metric", metricName, "msg", "backfilling file")
+
+	series, err := WhisperToMimirSeries(fname, metricName, c.archiveResolutionLabel != "")
+	if err != nil {
+		level.Warn(c.logger).Log("file", fname, "metric", metricName, "msg", "error converting whisper metric", "err", err)
+		c.progress.IncSkipped()
+		return nil
+	}
+	seriesLabels, err := c.seriesLabels(metricName, series)
+	if err != nil {
+		level.Warn(c.logger).Log("file", fname, "metric", metricName, "msg", "error converting metric name to labels", "err", err)
+		c.progress.IncSkipped()
+		return nil
+	}
+
+	for _, archive := range series.Archives {
+		_, archiveLabels := c.archiveLabels(metricName, seriesLabels, archive)
+		if len(c.customLabels) != 0 {
+			archiveLabels = append(archiveLabels.Copy(), c.customLabels...)
+			sort.Sort(archiveLabels)
+		}
+		labelAdapters := mimirpb.FromLabelsToLabelAdapters(archiveLabels)
+
+		for _, day := range SplitSamplesByDays(archive.Samples) {
+			if !b.includesDay(day[0].TimestampMs) {
+				continue
+			}
+			for len(day) > 0 {
+				batch := day[:min(len(day), b.cfg.BatchSize)]
+				day = day[len(batch):]
+				if err := b.write(ctx, labelAdapters, batch); err != nil {
+					return errors.Wrapf(err, "error backfilling metric %s", metricName)
+				}
+			}
+		}
+	}
+
+	// Write to the progress file to indicate this one is done.
+	err = b.progressFile.Append(metricName, &mimirpb.TimeSeries{})
+	if err != nil {
+		return errors.Wrap(err, "error writing to backfilledMetrics intermediate file")
+	}
+	c.progress.IncProcessed()
+	return nil
+}
+
+func (b *backfiller) includesDay(timestampMs int64) bool {
+	if len(b.dates) == 0 {
+		return true
+	}
+	t := time.UnixMilli(timestampMs).UTC()
+	return b.dates[time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())]
+}
+
+// write sends the samples of a series in a single request, tolerating the
+// rejection of the request as bad.
+func (b *backfiller) write(ctx context.Context, lbls []mimirpb.LabelAdapter, samples []mimirpb.Sample) error {
+	if b.limiter != nil {
+		if err := b.limiter.WaitN(ctx, len(samples)); err != nil {
+			return err
+		}
+	}
+
+	err := b.client.Write(ctx, &mimirpb.WriteRequest{
+		Timeseries: []mimirpb.PreallocTimeseries{{TimeSeries: &mimirpb.TimeSeries{
+			Labels:  lbls,
+			Samples: samples,
+		}}},
+		Source: mimirpb.API,
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var badRequest errorx.BadRequest
+	switch {
+	case err == nil:
+		b.writtenSamples += len(samples)
+	case errors.As(err, &badRequest):
+		level.Warn(b.converter.logger).Log("msg", "samples rejected by the remote write endpoint", "labels", mimirpb.FromLabelAdaptersToLabels(lbls), "samples", len(samples), "err", err)
+		b.rejectedSamples += len(samples)
+	default:
+		return err
+	}
+	return nil
+}
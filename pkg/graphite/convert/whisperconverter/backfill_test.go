@@ -0,0 +1,181 @@
+package whisperconverter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+// backfillClient records the samples written by tenant and series name.
+type backfillClient struct {
+	mu       sync.Mutex
+	requests int
+	samples  map[string]map[string][]mimirpb.Sample
+	// err, if set, returns the error of the writes of a series.
+	err func(name string) error
+}
+
+func (c *backfillClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	orgID, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	for _, ts := range req.Timeseries {
+		name := mimirpb.FromLabelAdaptersToLabels(ts.Labels).Get("__n000__")
+		if c.err != nil {
+			if err := c.err(name); err != nil {
+				return err
+			}
+		}
+		if c.samples == nil {
+			c.samples = map[string]map[string][]mimirpb.Sample{}
+		}
+		if c.samples[orgID] == nil {
+			c.samples[orgID] = map[string][]mimirpb.Sample{}
+		}
+		c.samples[orgID][name] = append(c.samples[orgID][name], ts.Samples...)
+	}
+	return nil
+}
+
+func TestCommandBackfill(t *testing.T) {
+	tmpInDir := t.TempDir()
+	tmpProgressDir := t.TempDir()
+
+	asdfTimes, err := ToTimes([]string{"2022-05-01", "2022-05-02", "2022-05-03"})
+	require.NoError(t, err)
+	require.NoError(t, CreateWhisperFile(filepath.Join(tmpInDir, "asdf.wsp"), asdfTimes))
+	qwerTimes, err := ToTimes([]string{"2022-04-29"})
+	require.NoError(t, err)
+	require.NoError(t, CreateWhisperFile(filepath.Join(tmpInDir, "qwer.wsp"), qwerTimes))
+
+	newConverter := func(dates []time.Time) *WhisperConverter {
+		return NewWhisperConverter(
+			"",
+			tmpInDir,
+			regexp.MustCompile(`\.wsp$`),
+			2,
+			1,
+			0,
+			labels.FromStrings("customlabel", "val"),
+			dates,
+			log.NewNopLogger(),
+		)
+	}
+	cfg := BackfillConfig{OrgID: "tenant-1", BatchSize: 2}
+
+	t.Run("writes all the samples", func(t *testing.T) {
+		client := &backfillClient{}
+		c := newConverter(nil)
+		require.NoError(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "all"), true, client, cfg))
+
+		require.Equal(t, map[string]map[string][]mimirpb.Sample{
+			"tenant-1": {
+				"asdf": {
+					{TimestampMs: asdfTimes[0].UnixMilli(), Value: 1},
+					{TimestampMs: asdfTimes[1].UnixMilli(), Value: 1},
+					{TimestampMs: asdfTimes[2].UnixMilli(), Value: 1},
+				},
+				"qwer": {
+					{TimestampMs: qwerTimes[0].UnixMilli(), Value: 1},
+				},
+			},
+		}, client.samples)
+		// One request per day and series, as they're split by days.
+		require.Equal(t, 4, client.requests)
+		require.Equal(t, uint64(2), c.GetProcessedCount())
+
+		// The backfilled files are skipped when resuming.
+		client = &backfillClient{}
+		c = newConverter(nil)
+		require.NoError(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "all"), true, client, cfg))
+		require.Zero(t, client.requests)
+		require.Equal(t, uint64(2), c.GetSkippedCount())
+	})
+
+	t.Run("writes the given dates only", func(t *testing.T) {
+		client := &backfillClient{}
+		c := newConverter([]time.Time{*asdfTimes[1]})
+		require.NoError(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "dates"), true, client, cfg))
+
+		require.Equal(t, map[string]map[string][]mimirpb.Sample{
+			"tenant-1": {
+				"asdf": {{TimestampMs: asdfTimes[1].UnixMilli(), Value: 1}},
+			},
+		}, client.samples)
+	})
+
+	t.Run("skips rejected samples", func(t *testing.T) {
+		client := &backfillClient{err: func(name string) error {
+			if name == "qwer" {
+				return errorx.BadRequest{Msg: "bad metrics write request", Err: errors.New("out of order sample")}
+			}
+			return nil
+		}}
+		c := newConverter(nil)
+		require.NoError(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "rejected"), true, client, cfg))
+
+		require.Len(t, client.samples["tenant-1"]["asdf"], 3)
+		require.NotContains(t, client.samples["tenant-1"], "qwer")
+		require.Equal(t, uint64(2), c.GetProcessedCount())
+	})
+
+	t.Run("stops on errors and resumes", func(t *testing.T) {
+		client := &backfillClient{err: func(name string) error {
+			if name == "qwer" {
+				return errorx.Internal{Msg: "failed writing metrics"}
+			}
+			return nil
+		}}
+		c := newConverter(nil)
+		require.Error(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "failed"), true, client, cfg))
+
+		// Only the failed file is written again.
+		client = &backfillClient{}
+		c = newConverter(nil)
+		require.NoError(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "failed"), true, client, cfg))
+		require.Contains(t, client.samples["tenant-1"], "qwer")
+		require.Equal(t, uint64(1), c.GetProcessedCount())
+	})
+
+	t.Run("splits the samples in batches", func(t *testing.T) {
+		// Recent points are kept in the raw archive. Even if they cross
+		// midnight, they're written in two requests.
+		now := time.Now().Truncate(time.Second)
+		var times []*time.Time
+		for i := 3; i > 0; i-- {
+			ts := now.Add(-time.Duration(i) * time.Second)
+			times = append(times, &ts)
+		}
+		batchInDir := t.TempDir()
+		require.NoError(t, CreateWhisperFile(filepath.Join(batchInDir, "zxcv.wsp"), times))
+
+		client := &backfillClient{}
+		c := NewWhisperConverter("", batchInDir, regexp.MustCompile(`\.wsp$`), 1, 1, 0, labels.FromStrings(), nil, log.NewNopLogger())
+		require.NoError(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "batches"), true, client, cfg))
+
+		require.Len(t, client.samples["tenant-1"]["zxcv"], 3)
+		require.Equal(t, 2, client.requests)
+	})
+
+	t.Run("invalid batch size", func(t *testing.T) {
+		c := newConverter(nil)
+		require.Error(t, c.CommandBackfill("", filepath.Join(tmpProgressDir, "invalid"), true, &backfillClient{}, BackfillConfig{OrgID: "tenant-1"}))
+	})
+}
@@ -0,0 +1,99 @@
+package whisperconverter
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/mimir/pkg/storage/tsdb/block"
+	promtsdb "github.com/prometheus/prometheus/tsdb"
+)
+
+// BlockMetaConfig configures the Thanos section of the meta.json of the
+// generated blocks, which Mimir reads to compact and query them.
+type BlockMetaConfig struct {
+	// OrgID, if set, is the tenant of the blocks, stored in the
+	// TenantExternalLabel.
+	OrgID string
+	// ExternalLabels are the Thanos external labels of the blocks.
+	ExternalLabels map[string]string
+	// Resolution is the downsampling resolution of the blocks, 0 for raw data.
+	Resolution time.Duration
+}
+
+// SetBlockMeta sets the Thanos metadata of the blocks generated by the second
+// pass.
+func (c *WhisperConverter) SetBlockMeta(cfg BlockMetaConfig) {
+	c.blockMeta = cfg
+}
+
+// extendBlockMeta returns the function extending the TSDB meta of the blocks
+// built in blocksDir with their Thanos metadata.
+func (c *WhisperConverter) extendBlockMeta(blocksDir string) func(promtsdb.BlockMeta) interface{} {
+	return func(meta promtsdb.BlockMeta) interface{} {
+		labels := make(map[string]string, len(c.blockMeta.ExternalLabels)+1)
+		for name, value := range c.blockMeta.ExternalLabels {
+			labels[name] = value
+		}
+		if c.blockMeta.OrgID != "" {
+			labels[TenantExternalLabel] = c.blockMeta.OrgID
+		}
+
+		extended := block.Meta{
+			BlockMeta: meta,
+			Thanos: block.ThanosMeta{
+				Version:    block.ThanosVersion1,
+				Labels:     labels,
+				Downsample: block.ThanosDownsample{Resolution: c.blockMeta.Resolution.Milliseconds()},
+				Source:     SourceWhisperConverter,
+			},
+		}
+
+		blockDir := filepath.Join(blocksDir, meta.ULID.String())
+		files, err := gatherBlockFiles(blockDir)
+		if err != nil {
+			// The files are optional, Mimir lists them from the bucket if missing.
+			level.Warn(c.logger).Log("block", meta.ULID, "msg", "error listing block files for meta.json", "err", err)
+			return extended
+		}
+		extended.Thanos.SegmentFiles = block.GetSegmentFiles(blockDir)
+		extended.Thanos.Files = files
+		return extended
+	}
+}
+
+// gatherBlockFiles returns the files of a block with their sizes, like
+// block.GatherFileStats, while its meta.json is still being written.
+func gatherBlockFiles(blockDir string) ([]block.File, error) {
+	entries, err := os.ReadDir(filepath.Join(blockDir, block.ChunksDirname))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]block.File, 0, len(entries)+2) //nolint:gomnd
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, block.File{
+			RelPath:   filepath.Join(block.ChunksDirname, entry.Name()),
+			SizeBytes: info.Size(),
+		})
+	}
+
+	info, err := os.Stat(filepath.Join(blockDir, block.IndexFilename))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, block.File{RelPath: block.IndexFilename, SizeBytes: info.Size()})
+	// Like Thanos, the meta.json is listed without size.
+	files = append(files, block.File{RelPath: block.MetaFilename})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelPath < files[j].RelPath
+	})
+	return files, nil
+}
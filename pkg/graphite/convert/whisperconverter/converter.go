@@ -30,6 +30,14 @@ type WhisperConverter struct {
 	customLabels labels.Labels
 	// dates is the list of all dates to process.
 	dates []time.Time
+	// aggregationMethodLabel, if set, is the label storing the aggregation
+	// method of the whisper files.
+	aggregationMethodLabel string
+	// archiveResolutionLabel, if set, splits the archives of the whisper files
+	// into separate series, storing their resolution in this label.
+	archiveResolutionLabel string
+	// blockMeta configures the Thanos metadata of the generated blocks.
+	blockMeta BlockMetaConfig
 
 	logger   log.Logger
 	progress *convert.Progress
@@ -59,6 +67,16 @@ func NewWhisperConverter(
 	}
 }
 
+// SetArchiveLabels sets the labels storing the aggregation method of the
+// whisper files and the resolution of their archives during the first pass.
+// Setting the archive resolution label converts each archive to a separate
+// series instead of stitching the downsampled archives onto the raw archive.
+// Empty label names disable either.
+func (c *WhisperConverter) SetArchiveLabels(aggregationMethodLabel, archiveResolutionLabel string) {
+	c.aggregationMethodLabel = aggregationMethodLabel
+	c.archiveResolutionLabel = archiveResolutionLabel
+}
+
 func (c *WhisperConverter) GetProcessedCount() uint64 {
 	return c.progress.GetProcessedCount()
 }
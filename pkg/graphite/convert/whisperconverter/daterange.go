@@ -39,7 +39,12 @@ func (c *WhisperConverter) CommandDateRange(targetWhisperFiles string) {
 // to a processing channel to find the min and max over all of the archives.
 func (c *WhisperConverter) getTimestampBounds(files chan string, tsChan chan<- int64, wg *sync.WaitGroup) {
 	for fname := range files {
-		metricName := c.getMetricName(fname)
+		metricName, err := c.getMetricName(fname)
+		if err != nil {
+			level.Warn(c.logger).Log("file", fname, "msg", "error getting metric name", "err", err)
+			c.progress.IncSkipped()
+			continue
+		}
 		level.Info(c.logger).Log("file", fname, "metric", metricName, "msg", "processing file")
 		samples, err := WhisperToMimirSamples(fname, metricName)
 		if err != nil {
@@ -11,11 +11,17 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
 )
 
+// archiveKeySeparator separates the metric name from the archive resolution in
+// the intermediate file keys of split whisper archives. It can't appear in
+// Graphite names.
+const archiveKeySeparator = "\x00"
+
 // CommandPass1 performs the first pass conversion to intermediate files. Each
 // metric is dumped, sorted, and split into days, and the individual days are
 // written to the intermediate files.  If this stage crashes, rerunning the
@@ -103,7 +109,12 @@ func (c *WhisperConverter) openIntermediateFiles(intermediateDir string, resumeI
 // given block, it is silently skipped.
 func (c *WhisperConverter) createIntermediateFromChan(files chan string, intermediateFiles map[time.Time]*convert.USTable, progressFile *convert.USTable, skippableMetrics map[string]int64, wg *sync.WaitGroup) {
 	for fname := range files {
-		metricName := c.getMetricName(fname)
+		metricName, err := c.getMetricName(fname)
+		if err != nil {
+			level.Warn(c.logger).Log("file", fname, "msg", "error getting metric name", "err", err)
+			c.progress.IncSkipped()
+			continue
+		}
 		if _, ok := skippableMetrics[metricName]; ok {
 			level.Info(c.logger).Log("file", fname, "metric", metricName, "msg", "already completely processed in previous run, skipping")
 			c.progress.IncSkipped()
@@ -111,41 +122,49 @@ func (c *WhisperConverter) createIntermediateFromChan(files chan string, interme
 		}
 		level.Info(c.logger).Log("file", fname, "metric", metricName, "msg", "processing file")
 
-		samples, err := WhisperToMimirSamples(fname, metricName)
+		series, err := WhisperToMimirSeries(fname, metricName, c.archiveResolutionLabel != "")
 		if err != nil {
 			level.Warn(c.logger).Log("file", fname, "metric", metricName, "msg", "error converting whisper metric", "err", err)
 			c.progress.IncSkipped()
 			continue
 		}
-		labelsBuilder := labels.NewBuilder(nil)
-		labels := convert.LabelsFromUntaggedName(metricName, labelsBuilder)
-
-		blocks := SplitSamplesByDays(samples)
-		// Shuffle blocks so we write dates to channels in random order, reducing
-		// contention.
-		rand.Shuffle(len(blocks), func(i, j int) { blocks[i], blocks[j] = blocks[j], blocks[i] })
+		seriesLabels, err := c.seriesLabels(metricName, series)
+		if err != nil {
+			level.Warn(c.logger).Log("file", fname, "metric", metricName, "msg", "error converting metric name to labels", "err", err)
+			c.progress.IncSkipped()
+			continue
+		}
 
 		wroteDates := make(map[time.Time]bool)
-		for _, block := range blocks {
-			t := time.UnixMilli(block[0].TimestampMs).UTC()
-			// Can't use time.Truncate because some days do not have 24 hours (leap seconds, etc).
-			rounded := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
-
-			// It is not necessarily an error if we don't find a channel, we might
-			// not be being asked to output for this date.
-			if i, ok := intermediateFiles[rounded]; ok {
-				level.Debug(c.logger).Log("msg", "writing data to intermediate file for date", "date", rounded)
-				err = i.Append(metricName, &mimirpb.TimeSeries{
-					Labels:  mimirpb.FromLabelsToLabelAdapters(labels),
-					Samples: block,
-				},
-				)
-				if err != nil {
-					level.Error(c.logger).Log("metric", metricName, "msg", "error writing to intermediate file", "err", err)
-					// TODO: properly handle this error better rather than exiting.
-					os.Exit(1)
+		for _, archive := range series.Archives {
+			key, archiveLabels := c.archiveLabels(metricName, seriesLabels, archive)
+
+			blocks := SplitSamplesByDays(archive.Samples)
+			// Shuffle blocks so we write dates to channels in random order, reducing
+			// contention.
+			rand.Shuffle(len(blocks), func(i, j int) { blocks[i], blocks[j] = blocks[j], blocks[i] })
+
+			for _, block := range blocks {
+				t := time.UnixMilli(block[0].TimestampMs).UTC()
+				// Can't use time.Truncate because some days do not have 24 hours (leap seconds, etc).
+				rounded := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+				// It is not necessarily an error if we don't find a channel, we might
+				// not be being asked to output for this date.
+				if i, ok := intermediateFiles[rounded]; ok {
+					level.Debug(c.logger).Log("msg", "writing data to intermediate file for date", "date", rounded)
+					err = i.Append(key, &mimirpb.TimeSeries{
+						Labels:  mimirpb.FromLabelsToLabelAdapters(archiveLabels),
+						Samples: block,
+					},
+					)
+					if err != nil {
+						level.Error(c.logger).Log("metric", metricName, "msg", "error writing to intermediate file", "err", err)
+						// TODO: properly handle this error better rather than exiting.
+						os.Exit(1)
+					}
+					wroteDates[rounded] = true
 				}
-				wroteDates[rounded] = true
 			}
 		}
 
@@ -165,3 +184,26 @@ func (c *WhisperConverter) createIntermediateFromChan(files chan string, interme
 	}
 	wg.Done()
 }
+
+// seriesLabels returns the labels of the series converted from the whisper
+// file of the given metric.
+func (c *WhisperConverter) seriesLabels(metricName string, series *WhisperSeries) (labels.Labels, error) {
+	seriesLabels, err := convert.LabelsFromName(metricName, labels.NewBuilder(nil))
+	if err != nil {
+		return nil, err
+	}
+	if c.aggregationMethodLabel != "" {
+		seriesLabels = labels.NewBuilder(seriesLabels).Set(c.aggregationMethodLabel, series.AggregationMethod).Labels()
+	}
+	return seriesLabels, nil
+}
+
+// archiveLabels returns the intermediate file key and the labels of the given
+// archive of a whisper file, which has the given series labels.
+func (c *WhisperConverter) archiveLabels(metricName string, seriesLabels labels.Labels, archive ArchiveSamples) (string, labels.Labels) {
+	if archive.Resolution == 0 {
+		return metricName, seriesLabels
+	}
+	resolution := model.Duration(archive.Resolution).String()
+	return metricName + archiveKeySeparator + resolution, labels.NewBuilder(seriesLabels).Set(c.archiveResolutionLabel, resolution).Labels()
+}
@@ -2,13 +2,18 @@ package whisperconverter
 
 import (
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 	"time"
 
+	"github.com/go-graphite/go-whisper"
 	"github.com/go-kit/log"
+	"github.com/grafana/mimir/pkg/mimirpb"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
 )
 
 func TestCommandPass1(t *testing.T) {
@@ -111,3 +116,119 @@ func TestCommandPass1(t *testing.T) {
 		})
 	}
 }
+
+func TestCommandPass1_TaggedSeries(t *testing.T) {
+	tmpInDir := t.TempDir()
+	tmpIntermediateDir := t.TempDir()
+
+	times, err := ToTimes([]string{"2022-05-01"})
+	require.NoError(t, err)
+
+	taggedDir := filepath.Join(tmpInDir, "_tagged", "1f2", "ab3")
+	require.NoError(t, os.MkdirAll(taggedDir, os.ModePerm))
+	require.NoError(t, CreateWhisperFile(filepath.Join(taggedDir, "disk_DOT_used;host=www01;mount=_DOT_var.wsp"), times))
+	require.NoError(t, CreateWhisperFile(filepath.Join(tmpInDir, "asdf.wsp"), times))
+
+	dates, err := ToTimes([]string{"2022-05-01"})
+	require.NoError(t, err)
+
+	c := NewWhisperConverter(
+		"",
+		tmpInDir,
+		regexp.MustCompile(`\.wsp$`),
+		1,
+		1,
+		0,
+		labels.FromStrings(),
+		[]time.Time{*dates[0]},
+		log.NewNopLogger(),
+	)
+	require.NoError(t, c.CommandPass1("", tmpIntermediateDir, true))
+
+	actual := readIntermediateLabels(t, filepath.Join(tmpIntermediateDir, "2022-05-01.intermediate"))
+	require.Equal(t, map[string]labels.Labels{
+		"asdf": labels.FromStrings("__name__", "graphite_untagged", "__n000__", "asdf"),
+		"disk.used;host=www01;mount=.var": labels.FromStrings(
+			"__name__", "graphite_tagged",
+			"name", "disk.used",
+			"host", "www01",
+			"mount", ".var",
+		),
+	}, actual)
+}
+
+func TestCommandPass1_ArchiveLabels(t *testing.T) {
+	for name, tc := range map[string]struct {
+		archiveResolutionLabel string
+		expectedLabels         map[string]labels.Labels
+	}{
+		"stitched archives": {
+			expectedLabels: map[string]labels.Labels{
+				"asdf": labels.FromStrings("__name__", "graphite_untagged", "__n000__", "asdf", "aggregation", "sum"),
+			},
+		},
+		"split archives": {
+			archiveResolutionLabel: "resolution",
+			expectedLabels: map[string]labels.Labels{
+				// A month later, the point is older than the retention of the
+				// raw archive, and too sparse to be propagated to the daily
+				// archive by the xFilesFactor, so only the hourly archive has
+				// points.
+				"asdf\x001h": labels.FromStrings("__name__", "graphite_untagged", "__n000__", "asdf", "aggregation", "sum", "resolution", "1h"),
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The archives holding the point depend on the current time.
+			now := whisper.Now
+			t.Cleanup(func() { whisper.Now = now })
+			whisper.Now = func() time.Time {
+				return time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+			}
+
+			tmpInDir := t.TempDir()
+			tmpIntermediateDir := t.TempDir()
+
+			times, err := ToTimes([]string{"2022-05-01"})
+			require.NoError(t, err)
+			require.NoError(t, CreateWhisperFile(filepath.Join(tmpInDir, "asdf.wsp"), times))
+
+			c := NewWhisperConverter(
+				"",
+				tmpInDir,
+				regexp.MustCompile(`\.wsp$`),
+				1,
+				1,
+				0,
+				labels.FromStrings(),
+				[]time.Time{*times[0]},
+				log.NewNopLogger(),
+			)
+			c.SetArchiveLabels("aggregation", tc.archiveResolutionLabel)
+			require.NoError(t, c.CommandPass1("", tmpIntermediateDir, true))
+
+			require.Equal(t, tc.expectedLabels, readIntermediateLabels(t, filepath.Join(tmpIntermediateDir, "2022-05-01.intermediate")))
+		})
+	}
+}
+
+// readIntermediateLabels returns the labels of the series of an intermediate
+// file by key.
+func readIntermediateLabels(t *testing.T, fname string) map[string]labels.Labels {
+	table, err := convert.NewUSTableForRead(fname, convert.NewMimirSeriesProto, log.NewNopLogger())
+	require.NoError(t, err)
+	defer func() {
+		_ = table.Close()
+	}()
+
+	index, err := table.Index()
+	require.NoError(t, err)
+
+	actual := map[string]labels.Labels{}
+	for key, pos := range index {
+		_, value, err := table.ReadAt(pos)
+		require.NoError(t, err)
+		actual[key] = mimirpb.FromLabelAdaptersToLabels(value.(*mimirpb.TimeSeries).Labels)
+	}
+	return actual
+}
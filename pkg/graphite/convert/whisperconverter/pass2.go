@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,10 +14,8 @@ import (
 
 	"github.com/grafana/mimir/pkg/mimirpb"
 	"github.com/prometheus/prometheus/model/labels"
-	promtsdb "github.com/prometheus/prometheus/tsdb"
 
 	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
-	"github.com/grafana/mimir-graphite/v2/pkg/graphite/writeproxy"
 	"github.com/grafana/mimir-graphite/v2/pkg/tsdb"
 )
 
@@ -49,14 +48,21 @@ type metricsIndexEntry struct {
 
 // buildMetricsIndex converts the raw name->position index to a sorted
 // labels->position index.
-func buildMetricsIndex(nameIndex map[string]int64) []metricsIndexEntry {
+func buildMetricsIndex(nameIndex map[string]int64) ([]metricsIndexEntry, error) {
 	// We need to sort by label sort, so rebuild the labels and sort.
 	index := make([]metricsIndexEntry, len(nameIndex))
 	idx := 0
-	for name, pos := range nameIndex {
+	for key, pos := range nameIndex {
+		// The archives of split whisper files are stored under the metric name
+		// followed by their resolution, which only tells them apart.
+		name, _, _ := strings.Cut(key, archiveKeySeparator)
 		labelsBuilder := labels.NewBuilder(nil)
+		lbls, err := convert.LabelsFromName(name, labelsBuilder)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid metric name %q", name)
+		}
 		index[idx] = metricsIndexEntry{
-			Labels: writeproxy.LabelsFromUntaggedName(name, labelsBuilder),
+			Labels: lbls,
 			Pos:    pos,
 		}
 		idx++
@@ -66,7 +72,7 @@ func buildMetricsIndex(nameIndex map[string]int64) []metricsIndexEntry {
 		return labels.Compare(index[i].Labels, index[j].Labels) == -1
 	})
 
-	return index
+	return index, nil
 }
 
 // createBlocksFromChan reads filenames from a channel and converts them to
@@ -108,7 +114,10 @@ func (c *WhisperConverter) createOneBlock(fname, blocksDir string) error {
 		return err
 	}
 
-	metricsIndex := buildMetricsIndex(index)
+	metricsIndex, err := buildMetricsIndex(index)
+	if err != nil {
+		return err
+	}
 	for _, info := range metricsIndex {
 		var value convert.ProtoUnmarshaler
 		_, value, err = i.ReadAt(info.Pos)
@@ -133,7 +142,7 @@ func (c *WhisperConverter) createOneBlock(fname, blocksDir string) error {
 			return err
 		}
 	}
-	_, err = builder.FinishBlock(context.Background(), func(meta promtsdb.BlockMeta) interface{} { return meta })
+	_, err = builder.FinishBlock(context.Background(), c.extendBlockMeta(blocksDir))
 	return err
 }
 
@@ -3,12 +3,14 @@ package whisperconverter
 import (
 	"math/rand"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/storage/tsdb/block"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/require"
 
@@ -90,6 +92,79 @@ func TestCommandPass2(t *testing.T) {
 	checkBlockSimpleValid(t, tmpBlockDir)
 }
 
+func TestCommandPass2_BlockMeta(t *testing.T) {
+	tmpIntermediateDir := t.TempDir()
+	tmpBlockDir := t.TempDir()
+
+	require.NoError(t, createIntermediate(filepath.Join(tmpIntermediateDir, "2022-08-01.intermediate"), createData([]string{"foo.bar.baz", "my.cool.metric"})))
+	dates, err := ToTimes([]string{"2022-08-01"})
+	require.NoError(t, err)
+
+	c := NewWhisperConverter(
+		"",
+		"",
+		regexp.MustCompile(`\.wsp$`),
+		1,
+		1,
+		0,
+		labels.FromStrings(),
+		[]time.Time{*dates[0]},
+		log.NewNopLogger(),
+	)
+	c.SetBlockMeta(BlockMetaConfig{
+		OrgID:          "tenant-1",
+		ExternalLabels: map[string]string{"source": "graphite"},
+		Resolution:     5 * time.Minute,
+	})
+	require.NoError(t, c.CommandPass2(tmpIntermediateDir, tmpBlockDir, true))
+
+	blockID := checkBlockSimpleValid(t, tmpBlockDir)
+	blockDir := filepath.Join(tmpBlockDir, blockID)
+	meta, err := block.ReadMetaFromDir(blockDir)
+	require.NoError(t, err)
+
+	require.Equal(t, block.ThanosVersion1, meta.Thanos.Version)
+	require.Equal(t, SourceWhisperConverter, meta.Thanos.Source)
+	require.Equal(t, map[string]string{"source": "graphite", TenantExternalLabel: "tenant-1"}, meta.Thanos.Labels)
+	require.Equal(t, (5 * time.Minute).Milliseconds(), meta.Thanos.Downsample.Resolution)
+	require.Equal(t, []string{"000001"}, meta.Thanos.SegmentFiles)
+
+	// The files match those listed by Mimir once the meta.json is written.
+	files, err := block.GatherFileStats(blockDir)
+	require.NoError(t, err)
+	require.Equal(t, files, meta.Thanos.Files)
+	for _, f := range meta.Thanos.Files {
+		if f.RelPath != block.MetaFilename {
+			require.Positive(t, f.SizeBytes, f.RelPath)
+		}
+	}
+}
+
+func TestBuildMetricsIndex(t *testing.T) {
+	index, err := buildMetricsIndex(map[string]int64{
+		"b":                  1,
+		"a;host=www01":       2,
+		"a\x001h":            3,
+		"a.b":                4,
+		"a;host=www01\x001d": 5,
+	})
+	require.NoError(t, err)
+
+	var positions []int64
+	for _, entry := range index {
+		positions = append(positions, entry.Pos)
+	}
+	// The archives of split files are sorted by the labels of their name,
+	// with the untagged series first.
+	require.Len(t, positions, 5)
+	require.Equal(t, []int64{4, 3, 1}, positions[:3])
+	require.ElementsMatch(t, []int64{2, 5}, positions[3:])
+	require.Equal(t, labels.FromStrings("__name__", "graphite_tagged", "name", "a", "host", "www01"), index[3].Labels)
+
+	_, err = buildMetricsIndex(map[string]int64{"a;host": 1})
+	require.Error(t, err)
+}
+
 // createData returns some fake data, using the passed-in metricNames (which
 // should be in dotted format)
 func createData(metricNames []string) map[string]*mimirpb.TimeSeries {
@@ -0,0 +1,148 @@
+package whisperconverter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/storage/tsdb/block"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
+)
+
+const (
+	// SourceWhisperConverter is the Thanos source of the blocks generated by
+	// the converter.
+	SourceWhisperConverter block.SourceType = "whisper-converter"
+
+	// TenantExternalLabel is the Thanos external label identifying the tenant
+	// of a block.
+	TenantExternalLabel = "__org_id__"
+)
+
+// CommandUpload uploads the finished blocks of blocksDir, those with a
+// meta.json, to the given bucket under <orgID>/<block ID>, like the Mimir
+// ingesters do. The uploaded meta.json has a Thanos section with the tenant
+// and the source of the block, which are only set if missing from the local
+// meta.json, for example in blocks generated by older converter versions.
+//
+// The uploaded blocks are recorded in a progress file in blocksDir, so
+// rerunning the command resumes the upload.
+func (c *WhisperConverter) CommandUpload(blocksDir string, bkt objstore.Bucket, orgID string, resume bool) error {
+	if orgID == "" {
+		return errors.New("need a tenant to upload blocks")
+	}
+
+	progressFName := filepath.Join(blocksDir, "uploadedBlocks.intermediate")
+	progressFile, uploadedBlocks, err := convert.NewUSTableForAppendWithIndex(progressFName, !resume, convert.NewMimirSeriesProto, c.logger)
+	if err != nil {
+		return errors.Wrap(err, "error opening uploadedBlocks intermediate file")
+	}
+	defer func() {
+		_ = progressFile.Close()
+	}()
+
+	blockDirs, err := c.getFinishedBlockDirs(blocksDir, uploadedBlocks)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userBkt := objstore.NewPrefixedBucket(bkt, orgID)
+	dirChan := make(chan string)
+	errChan := make(chan error, c.threads)
+	wg := &sync.WaitGroup{}
+	wg.Add(c.threads)
+	for i := 0; i < c.threads; i++ {
+		go func() {
+			defer wg.Done()
+			for dir := range dirChan {
+				if err := c.uploadBlock(ctx, userBkt, dir, orgID, progressFile); err != nil {
+					errChan <- err
+					cancel()
+					// Drain the remaining blocks without uploading them.
+					for range dirChan {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for _, dir := range blockDirs {
+		dirChan <- dir
+	}
+	close(dirChan)
+	wg.Wait()
+	close(errChan)
+
+	return <-errChan
+}
+
+// getFinishedBlockDirs returns the directories of the finished blocks of
+// blocksDir that haven't been uploaded yet. Blocks without a meta.json are
+// still being written, or their generation crashed.
+func (c *WhisperConverter) getFinishedBlockDirs(blocksDir string, uploadedBlocks map[string]int64) ([]string, error) {
+	entries, err := os.ReadDir(blocksDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing blocks directory")
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		dir := filepath.Join(blocksDir, entry.Name())
+		id, ok := block.IsBlockDir(dir)
+		if !entry.IsDir() || !ok {
+			continue
+		}
+		if _, ok := uploadedBlocks[id.String()]; ok {
+			level.Info(c.logger).Log("block", id, "msg", "block already uploaded in previous run, skipping")
+			c.progress.IncSkipped()
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, block.MetaFilename)); err != nil {
+			level.Warn(c.logger).Log("block", id, "msg", "block has no meta.json, skipping", "err", err)
+			c.progress.IncSkipped()
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+func (c *WhisperConverter) uploadBlock(ctx context.Context, bkt objstore.Bucket, dir, orgID string, progressFile *convert.USTable) error {
+	meta, err := block.ReadMetaFromDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "error reading meta.json of block %s", dir)
+	}
+	if meta.Thanos.Version == 0 {
+		meta.Thanos.Version = block.ThanosVersion1
+	}
+	if meta.Thanos.Source == "" {
+		meta.Thanos.Source = SourceWhisperConverter
+	}
+	if meta.Thanos.Labels == nil {
+		meta.Thanos.Labels = map[string]string{}
+	}
+	if _, ok := meta.Thanos.Labels[TenantExternalLabel]; !ok {
+		meta.Thanos.Labels[TenantExternalLabel] = orgID
+	}
+
+	level.Info(c.logger).Log("block", meta.ULID, "msg", "uploading block")
+	if err := block.Upload(ctx, c.logger, bkt, dir, meta); err != nil {
+		return errors.Wrapf(err, "error uploading block %s", meta.ULID)
+	}
+
+	// Write to the progress file to indicate this one is done.
+	if err := progressFile.Append(meta.ULID.String(), &mimirpb.TimeSeries{}); err != nil {
+		return errors.Wrap(err, "error writing to uploadedBlocks intermediate file")
+	}
+	c.progress.IncProcessed()
+	return nil
+}
@@ -0,0 +1,105 @@
+package whisperconverter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/mimir/pkg/storage/tsdb/block"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/providers/filesystem"
+)
+
+func TestCommandUpload(t *testing.T) {
+	tmpIntermediateDir := t.TempDir()
+	tmpBlockDir := t.TempDir()
+
+	require.NoError(t, createIntermediate(filepath.Join(tmpIntermediateDir, "2022-08-01.intermediate"), createData([]string{"foo.bar.baz", "my.cool.metric"})))
+	require.NoError(t, createIntermediate(filepath.Join(tmpIntermediateDir, "2022-08-02.intermediate"), createData([]string{"my.cool.metric"})))
+	dates, err := ToTimes([]string{"2022-08-01", "2022-08-02"})
+	require.NoError(t, err)
+
+	newConverter := func() *WhisperConverter {
+		return NewWhisperConverter(
+			"",
+			"",
+			regexp.MustCompile(`\.wsp$`),
+			2,
+			1,
+			0,
+			labels.FromStrings(),
+			[]time.Time{*dates[0], *dates[1]},
+			log.NewNopLogger(),
+		)
+	}
+	require.NoError(t, newConverter().CommandPass2(tmpIntermediateDir, tmpBlockDir, true))
+
+	// Blocks without a meta.json aren't finished, so they aren't uploaded.
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpBlockDir, "01GA4DHEPHR6NYKKAB0Z4Q6J8S", "chunks"), os.ModePerm))
+
+	bkt, err := filesystem.NewBucket(t.TempDir())
+	require.NoError(t, err)
+
+	c := newConverter()
+	require.NoError(t, c.CommandUpload(tmpBlockDir, bkt, "tenant-1", true))
+	require.Equal(t, uint64(2), c.GetProcessedCount())
+
+	blockIDs := listBucketBlocks(t, bkt, "tenant-1")
+	require.Len(t, blockIDs, 2)
+	for _, id := range blockIDs {
+		meta, err := block.DownloadMeta(context.Background(), log.NewNopLogger(), objstore.NewPrefixedBucket(bkt, "tenant-1"), id)
+		require.NoError(t, err)
+		require.Equal(t, block.ThanosVersion1, meta.Thanos.Version)
+		require.Equal(t, SourceWhisperConverter, meta.Thanos.Source)
+		require.Equal(t, map[string]string{TenantExternalLabel: "tenant-1"}, meta.Thanos.Labels)
+		require.NotEmpty(t, meta.Thanos.Files)
+
+		exists, err := bkt.Exists(context.Background(), "tenant-1/"+id.String()+"/index")
+		require.NoError(t, err)
+		require.True(t, exists)
+	}
+
+	// The uploaded blocks are skipped when resuming, even if they were since
+	// removed from the bucket.
+	require.NoError(t, bkt.Delete(context.Background(), "tenant-1/"+blockIDs[0].String()+"/meta.json"))
+	c = newConverter()
+	require.NoError(t, c.CommandUpload(tmpBlockDir, bkt, "tenant-1", true))
+	require.Zero(t, c.GetProcessedCount())
+	require.Len(t, listBucketBlocks(t, bkt, "tenant-1"), 1)
+
+	// All the blocks are uploaded again without resuming.
+	c = newConverter()
+	require.NoError(t, c.CommandUpload(tmpBlockDir, bkt, "tenant-1", false))
+	require.Equal(t, uint64(2), c.GetProcessedCount())
+	require.Len(t, listBucketBlocks(t, bkt, "tenant-1"), 2)
+
+	require.Error(t, newConverter().CommandUpload(tmpBlockDir, bkt, "", true))
+}
+
+// listBucketBlocks returns the IDs of the blocks of the tenant with a
+// meta.json in the bucket.
+func listBucketBlocks(t *testing.T, bkt objstore.Bucket, tenant string) []ulid.ULID {
+	var ids []ulid.ULID
+	require.NoError(t, bkt.Iter(context.Background(), tenant+"/", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		exists, err := bkt.Exists(context.Background(), filepath.Join(name, block.MetaFilename))
+		if err != nil || !exists {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	}))
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	return ids
+}
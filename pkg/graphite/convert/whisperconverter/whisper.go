@@ -16,24 +16,105 @@ import (
 // name, and writes it to the given block directory with blocks covering the
 // given duration.
 func WhisperToMimirSamples(whisperFile, name string) ([]mimirpb.Sample, error) {
+	var points []whisper.Point
+	err := readWhisperFile(whisperFile, func(w *ioReaderArchive) (err error) {
+		points, err = ReadPoints(w, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ToMimirSamples(points)
+}
+
+// WhisperSeries is the content of a whisper file converted to Mimir samples.
+type WhisperSeries struct {
+	// AggregationMethod is the method used by the file to downsample its
+	// archives: average, sum, last, max or min.
+	AggregationMethod string
+	// Archives holds the samples of each archive that has points, highest
+	// resolution first, when the archives are split. Otherwise it holds a
+	// single entry with zero resolution, stitching all the archives.
+	Archives []ArchiveSamples
+}
+
+// ArchiveSamples are the samples of a whisper archive.
+type ArchiveSamples struct {
+	// Resolution is the interval between the points of the archive.
+	Resolution time.Duration
+	Samples    []mimirpb.Sample
+}
+
+// WhisperToMimirSeries opens the given whisper file, applying the given metric
+// name, and converts its points and metadata. If splitArchives is true, each
+// archive is converted separately instead of stitching the downsampled
+// archives onto the higher resolution ones.
+func WhisperToMimirSeries(whisperFile, name string, splitArchives bool) (*WhisperSeries, error) {
+	series := &WhisperSeries{}
+	err := readWhisperFile(whisperFile, func(w *ioReaderArchive) error {
+		series.AggregationMethod = w.Header.Metadata.AggregationMethod.String()
+
+		if !splitArchives {
+			points, err := ReadPoints(w, name)
+			if err != nil {
+				return err
+			}
+			samples, err := ToMimirSamples(points)
+			if err != nil {
+				return err
+			}
+			series.Archives = []ArchiveSamples{{Samples: samples}}
+			return nil
+		}
+
+		archivePoints, err := ReadArchivePoints(w, name)
+		if err != nil {
+			return err
+		}
+		for i, points := range archivePoints {
+			if len(points) == 0 {
+				continue
+			}
+			samples, err := ToMimirSamples(points)
+			if err != nil {
+				return err
+			}
+			series.Archives = append(series.Archives, ArchiveSamples{
+				Resolution: time.Duration(w.GetArchives()[i].SecondsPerPoint) * time.Second,
+				Samples:    samples,
+			})
+		}
+		if len(series.Archives) == 0 {
+			return fmt.Errorf("no points to convert for metric")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// readWhisperFile opens the given whisper file and calls f with its archive.
+func readWhisperFile(whisperFile string, f func(w *ioReaderArchive) error) error {
 	fd, err := os.Open(whisperFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open whisper file: %w", err)
+		return fmt.Errorf("failed to open whisper file: %w", err)
 	}
 	defer func() {
 		_ = fd.Close()
 	}()
 	w, err := newIOReaderArchive(fd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open whisper archive: %w", err)
+		return fmt.Errorf("failed to open whisper archive: %w", err)
 	}
 
-	points, err := ReadPoints(w, name)
-	if err != nil {
-		return nil, fmt.Errorf("error dumping metric from whisper: %w", err)
+	if err := f(w); err != nil {
+		return fmt.Errorf("error dumping metric from whisper: %w", err)
 	}
-
-	return ToMimirSamples(points)
+	return nil
 }
 
 // Archive provides a testable interface for converting whisper databases.
@@ -42,18 +123,14 @@ type Archive interface {
 	DumpArchive(int) ([]whisper.Point, error)
 }
 
-// ReadPoints reads and concatenates all of the points in a whisper Archive.
-func ReadPoints(w Archive, name string) ([]whisper.Point, error) {
+// archiveLowerBounds returns, for each archive, the timestamp after which its
+// points are within its retention. It returns nil if there are no points.
+func archiveLowerBounds(w Archive, name string) ([]uint32, error) {
 	archives := w.GetArchives()
 	if len(archives) == 0 {
 		return nil, fmt.Errorf("whisper file contains no archives for metric: %q", name)
 	}
 
-	// Dump one precision level at a time and write into the output slice.
-	// Its important to remember that the archive with index 0 (first archive)
-	// has the raw data and the highest precision https://graphite.readthedocs.io/en/latest/whisper.html#archives-retention-and-precision
-	keptPoints := []whisper.Point{}
-
 	// We want to track the max timestamp of the archives because we know it
 	// virtually represents now() and we won't have newer points.
 	var maxTs, maxTsOffset uint32
@@ -82,6 +159,11 @@ func ReadPoints(w Archive, name string) ([]whisper.Point, error) {
 	}
 	maxTs += maxTsOffset
 
+	// no maxTs means no points. This is not an error.
+	if maxTs == 0 {
+		return nil, nil
+	}
+
 	// Also determine the boundaries between archives.
 	lowerBoundTs := make([]uint32, len(archives))
 	for i, a := range archives {
@@ -93,10 +175,24 @@ func ReadPoints(w Archive, name string) ([]whisper.Point, error) {
 			lowerBoundTs[i] = maxTs - a.Retention()
 		}
 	}
+	return lowerBoundTs, nil
+}
 
-	// no maxTs means no points. This is not an error.
-	if maxTs == 0 {
-		return []whisper.Point{}, nil
+// ReadPoints reads and concatenates all of the points in a whisper Archive.
+func ReadPoints(w Archive, name string) ([]whisper.Point, error) {
+	archives := w.GetArchives()
+
+	// Dump one precision level at a time and write into the output slice.
+	// Its important to remember that the archive with index 0 (first archive)
+	// has the raw data and the highest precision https://graphite.readthedocs.io/en/latest/whisper.html#archives-retention-and-precision
+	keptPoints := []whisper.Point{}
+
+	lowerBoundTs, err := archiveLowerBounds(w, name)
+	if err != nil {
+		return nil, err
+	}
+	if lowerBoundTs == nil {
+		return keptPoints, nil
 	}
 
 	// Iterate over archives backwards so we process oldest points first. Sort the
@@ -148,6 +244,43 @@ func ReadPoints(w Archive, name string) ([]whisper.Point, error) {
 	return keptPoints, nil
 }
 
+// ReadArchivePoints reads the points of each archive of a whisper Archive that
+// are within the retention of the archive, sorted by timestamp. Unlike
+// ReadPoints, the points of the downsampled archives that are also covered by
+// higher resolution archives are kept.
+func ReadArchivePoints(w Archive, name string) ([][]whisper.Point, error) {
+	lowerBoundTs, err := archiveLowerBounds(w, name)
+	if err != nil {
+		return nil, err
+	}
+
+	archivePoints := make([][]whisper.Point, len(w.GetArchives()))
+	if lowerBoundTs == nil {
+		return archivePoints, nil
+	}
+
+	for i := range archivePoints {
+		points, err := w.DumpArchive(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump archive %d from whisper metric %s", i, name)
+		}
+
+		kept := make([]whisper.Point, 0, len(points))
+		for _, p := range points {
+			if p.Timestamp == 0 || p.Timestamp <= lowerBoundTs[i] {
+				continue
+			}
+			kept = append(kept, p)
+		}
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].Timestamp < kept[j].Timestamp
+		})
+		archivePoints[i] = kept
+	}
+
+	return archivePoints, nil
+}
+
 // ToMimirSamples converts a Whisper metric with the given name to a slice of
 // labels and series of mimir samples.  Returns error if no points.
 func ToMimirSamples(points []whisper.Point) ([]mimirpb.Sample, error) {
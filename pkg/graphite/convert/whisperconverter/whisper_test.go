@@ -415,6 +415,58 @@ func TestExtractWhisperPoints(t *testing.T) {
 	}
 }
 
+func TestReadArchivePoints(t *testing.T) {
+	archive := &testArchive{
+		infos: []whisper.ArchiveInfo{
+			simpleArchiveInfo(4, 1),
+			simpleArchiveInfo(3, 10),
+		},
+		points: [][]whisper.Point{
+			{
+				whisper.NewPoint(time.Unix(1003, 0), 4),
+				whisper.NewPoint(time.Unix(1000, 0), 1),
+				whisper.NewPoint(time.Unix(1001, 0), 2),
+				whisper.NewPoint(time.Unix(1002, 0), 3),
+			},
+			{
+				whisper.NewPoint(time.Unix(0, 0), 0),
+				whisper.NewPoint(time.Unix(1000, 0), 10),
+				whisper.NewPoint(time.Unix(970, 0), 7),
+				whisper.NewPoint(time.Unix(980, 0), 8),
+				whisper.NewPoint(time.Unix(990, 0), 9),
+			},
+		},
+	}
+
+	got, err := ReadArchivePoints(archive, "mymetric")
+	require.NoError(t, err)
+	// Unlike ReadPoints, the downsampled archive keeps the points covered by
+	// the raw archive.
+	require.Equal(t, [][]whisper.Point{
+		{
+			{Timestamp: 1000, Value: 1},
+			{Timestamp: 1001, Value: 2},
+			{Timestamp: 1002, Value: 3},
+			{Timestamp: 1003, Value: 4},
+		},
+		{
+			{Timestamp: 980, Value: 8},
+			{Timestamp: 990, Value: 9},
+			{Timestamp: 1000, Value: 10},
+		},
+	}, got)
+
+	got, err = ReadArchivePoints(&testArchive{
+		infos:  []whisper.ArchiveInfo{simpleArchiveInfo(4, 1)},
+		points: [][]whisper.Point{{}},
+	}, "mymetric")
+	require.NoError(t, err)
+	require.Equal(t, [][]whisper.Point{nil}, got)
+
+	_, err = ReadArchivePoints(&testArchive{}, "mymetric")
+	require.Error(t, err)
+}
+
 func TestConvertToMimirSamples(t *testing.T) {
 	tests := []struct {
 		name        string
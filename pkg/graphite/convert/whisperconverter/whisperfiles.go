@@ -2,6 +2,7 @@ package whisperconverter
 
 import (
 	"bufio"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -52,16 +53,43 @@ func (c *WhisperConverter) getWhisperListIntoChan(targetWhisperFiles string, fil
 	close(fileChan)
 }
 
+// taggedDirectory is the top-level directory in which carbon stores the
+// tagged series, as _tagged/<hash[0:3]>/<hash[3:6]>/<encoded name>.wsp.
+const taggedDirectory = "_tagged"
+
 // getMetricName generates the metric name based on the file name and given
-// prefix.
-func (c *WhisperConverter) getMetricName(file string) string {
+// prefix. Files of tagged series return their Graphite 1.1 tagged name,
+// "name;tag1=value1;tag2=value2".
+func (c *WhisperConverter) getMetricName(file string) (string, error) {
 	// remove all leading '/' from file name
 	file = strings.TrimPrefix(file, c.whisperDirectory)
 	for file[0] == '/' {
 		file = file[1:]
 	}
+	file = strings.TrimSuffix(file, filepath.Ext(file))
+
+	nodes := strings.Split(file, "/")
+	if len(nodes) == 4 && nodes[0] == taggedDirectory { //nolint:gomnd
+		name, err := decodeTaggedName(nodes[3])
+		if err != nil {
+			return "", err
+		}
+		return c.namePrefix + name, nil
+	}
+
+	return c.namePrefix + strings.Join(nodes, "."), nil
+}
 
-	return c.namePrefix + strings.ReplaceAll(strings.TrimSuffix(file, filepath.Ext(file)), "/", ".")
+// decodeTaggedName decodes the file name of a tagged series like
+// TaggedSeries.decode of graphite-web: carbon replaces the dots of the tagged
+// name by "_DOT_" so that they don't create further directories.
+func decodeTaggedName(file string) (string, error) {
+	// Carbon stores the tagged series under the hash of their name when
+	// tag_hash_filenames is enabled, which can't be decoded.
+	if !strings.Contains(file, ";") {
+		return "", fmt.Errorf("tagged series file name %q has no tags, it may be hashed", file)
+	}
+	return strings.ReplaceAll(file, "_DOT_", "."), nil
 }
 
 func (c *WhisperConverter) isMatchingFile(path string, d fs.DirEntry) bool {
@@ -72,7 +100,8 @@ func (c *WhisperConverter) isMatchingFile(path string, d fs.DirEntry) bool {
 	filename := filepath.Base(path)
 
 	if !c.fileFilter.MatchString(filename) {
-		_ = level.Debug(c.logger).Log("file", path, "metricname", c.getMetricName(path), "msg", "skipping file")
+		metricName, _ := c.getMetricName(path)
+		_ = level.Debug(c.logger).Log("file", path, "metricname", metricName, "msg", "skipping file")
 		c.progress.IncSkipped()
 		return false
 	}
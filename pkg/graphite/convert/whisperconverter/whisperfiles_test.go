@@ -110,6 +110,7 @@ func TestGetMetricName(t *testing.T) {
 		whisperDirectory   string
 		file               string
 		expectedMetricName string
+		expectedErr        bool
 	}{
 		{
 			name:               "whisperDirectoryPathRemoved",
@@ -132,6 +133,34 @@ func TestGetMetricName(t *testing.T) {
 			file:               "/output/asdf/qwer/test.wsp",
 			expectedMetricName: "namePrefix.asdf.qwer.test",
 		},
+		{
+			name:               "taggedSeries",
+			namePrefix:         "",
+			whisperDirectory:   "/output",
+			file:               "/output/_tagged/1f2/ab3/disk_DOT_used;host=www01;mount=_DOT_var_DOT_lib.wsp",
+			expectedMetricName: "disk.used;host=www01;mount=.var.lib",
+		},
+		{
+			name:               "taggedSeriesWithNamePrefix",
+			namePrefix:         "namePrefix.",
+			whisperDirectory:   "/output",
+			file:               "/output/_tagged/1f2/ab3/disk_DOT_used;host=www01.wsp",
+			expectedMetricName: "namePrefix.disk.used;host=www01",
+		},
+		{
+			name:             "hashedTaggedSeries",
+			namePrefix:       "",
+			whisperDirectory: "/output",
+			file:             "/output/_tagged/1f2/ab3/1f2ab3c1e4d5a8f2b7e3c9d0a6b4f1e2d3c5b7a9e8f0d1c2b3a4f5e6d7c8b9a0.wsp",
+			expectedErr:      true,
+		},
+		{
+			name:               "untaggedSeriesUnderTaggedDirectory",
+			namePrefix:         "",
+			whisperDirectory:   "/output",
+			file:               "/output/_tagged/test.wsp",
+			expectedMetricName: "_tagged.test",
+		},
 	}
 
 	for _, test := range tests {
@@ -147,8 +176,13 @@ func TestGetMetricName(t *testing.T) {
 				nil,
 				log.NewNopLogger(),
 			)
-			metricName := converter.getMetricName(test.file)
+			metricName, err := converter.getMetricName(test.file)
+			if test.expectedErr {
+				require.Error(t, err)
+				return
+			}
 
+			require.NoError(t, err)
 			require.Equal(t, test.expectedMetricName, metricName)
 		})
 	}
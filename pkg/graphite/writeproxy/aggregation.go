@@ -0,0 +1,459 @@
+package writeproxy
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/metrictank/schema"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultAggregationFlushDelay = 10 * time.Second
+	defaultAggregationMaxSeries  = 100_000
+	defaultAggregationMaxValues  = 10_000
+
+	aggregationFlushPeriod = time.Second
+)
+
+// AggregationConfig configures the aggregation of the incoming metrics with
+// carbon-aggregator rules, read from the rules file and the rules of the
+// config file, in that order.
+type AggregationConfig struct {
+	RulesFile string   `yaml:"rules_file"`
+	Rules     []string `yaml:"rules"`
+
+	// DropInputs drops the metrics matching any rule once aggregated, instead
+	// of writing them along with the aggregates.
+	DropInputs bool `yaml:"drop_inputs"`
+	// FlushDelay is how long after the end of its window an aggregate is
+	// written, waiting for the late samples of the window.
+	FlushDelay time.Duration `yaml:"flush_delay"`
+	// MaxSeries limits the number of aggregates kept in memory. Once reached,
+	// the samples of new aggregates are written as is instead.
+	MaxSeries int `yaml:"max_series"`
+	// MaxValues limits the number of values kept per aggregate by the
+	// percentile methods. Once reached, a uniform sample of the values is
+	// kept, so the percentiles are estimated.
+	MaxValues int `yaml:"max_values"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it.
+func (c *AggregationConfig) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	flags.StringVar(&c.RulesFile, prefix+"aggregation.rules-file", "", "Path to a file of carbon-aggregator rules, like \"<output> (60) = sum <input>\", aggregating the incoming metrics. Disabled if neither a rules file nor rules are set.")
+	flags.BoolVar(&c.DropInputs, prefix+"aggregation.drop-inputs", false, "If set to true, the metrics matching an aggregation rule are only written as part of the aggregates.")
+	flags.DurationVar(&c.FlushDelay, prefix+"aggregation.flush-delay", defaultAggregationFlushDelay, "How long after the end of their window the aggregates are written. Later samples are not aggregated.")
+	flags.IntVar(&c.MaxSeries, prefix+"aggregation.max-series", defaultAggregationMaxSeries, "Maximum number of aggregates kept in memory, the samples of new aggregates are written as is once reached.")
+	flags.IntVar(&c.MaxValues, prefix+"aggregation.max-values", defaultAggregationMaxValues, "Maximum number of values kept per aggregate for the percentile methods, which are estimated from a uniform sample of the values once reached. 0 to disable.")
+}
+
+// Enabled returns whether any aggregation rule is configured.
+func (c AggregationConfig) Enabled() bool {
+	return c.RulesFile != "" || len(c.Rules) > 0
+}
+
+// aggregationRuleRegexp matches the carbon-aggregator rules,
+// "output_template (frequency) = method input_pattern".
+var aggregationRuleRegexp = regexp.MustCompile(`^(\S+)\s+\((\d+)\)\s*=\s*(\w+)\s+(\S+)$`)
+
+// aggregationMethods are the carbon-aggregator aggregation methods, computed
+// from the state of an aggregate.
+var aggregationMethods = map[string]func(a *aggregate) float64{
+	"sum":   func(a *aggregate) float64 { return a.sum },
+	"avg":   func(a *aggregate) float64 { return a.sum / float64(a.count) },
+	"min":   func(a *aggregate) float64 { return a.min },
+	"max":   func(a *aggregate) float64 { return a.max },
+	"count": func(a *aggregate) float64 { return float64(a.count) },
+	"p50":   percentile(0.5),
+	"p75":   percentile(0.75),
+	"p80":   percentile(0.8),
+	"p90":   percentile(0.9),
+	"p95":   percentile(0.95),
+	"p99":   percentile(0.99),
+	"p999":  percentile(0.999),
+}
+
+type aggregationRule struct {
+	input     *regexp.Regexp
+	output    string
+	frequency int64
+	method    string
+	// keepValues is set for the percentiles, which need all the values.
+	keepValues bool
+}
+
+// parseAggregationRule parses a rule in the carbon-aggregator format. The
+// input pattern matches a node per "*" or "<field>", and any number of nodes
+// per "<<field>>". The output template refers to the fields as "<field>".
+func parseAggregationRule(line string) (aggregationRule, error) {
+	match := aggregationRuleRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return aggregationRule{}, fmt.Errorf("must be \"<output> (<frequency>) = <method> <input>\"")
+	}
+	output, frequencyStr, method, input := match[1], match[2], match[3], match[4]
+
+	frequency, err := strconv.ParseInt(frequencyStr, 10, 64)
+	if err != nil || frequency <= 0 {
+		return aggregationRule{}, fmt.Errorf("invalid frequency %q", frequencyStr)
+	}
+	if _, ok := aggregationMethods[method]; !ok {
+		return aggregationRule{}, fmt.Errorf("unknown aggregation method %q", method)
+	}
+	regex, err := aggregationInputRegex(input)
+	if err != nil {
+		return aggregationRule{}, fmt.Errorf("invalid input pattern %q: %w", input, err)
+	}
+	for _, field := range aggregationFieldRegexp.FindAllStringSubmatch(output, -1) {
+		if regex.SubexpIndex(field[1]) < 0 {
+			return aggregationRule{}, fmt.Errorf("output field %q isn't in the input pattern", field[1])
+		}
+	}
+
+	return aggregationRule{
+		input:      regex,
+		output:     output,
+		frequency:  frequency,
+		method:     method,
+		keepValues: strings.HasPrefix(method, "p"),
+	}, nil
+}
+
+// aggregationFieldRegexp matches the "<field>" and "<<field>>" of the rules.
+var aggregationFieldRegexp = regexp.MustCompile(`<<?(\w+)>>?`)
+
+// aggregationInputRegex turns an input pattern into a regular expression
+// capturing its fields.
+func aggregationInputRegex(pattern string) (*regexp.Regexp, error) {
+	var (
+		sb   strings.Builder
+		last int
+	)
+	sb.WriteString("^")
+	for _, loc := range aggregationFieldRegexp.FindAllStringSubmatchIndex(pattern, -1) {
+		sb.WriteString(globToRegex(pattern[last:loc[0]]))
+		field := pattern[loc[2]:loc[3]]
+		if strings.HasPrefix(pattern[loc[0]:], "<<") {
+			sb.WriteString("(?P<" + field + ">.+?)")
+		} else {
+			sb.WriteString("(?P<" + field + ">[^.]+)")
+		}
+		last = loc[1]
+	}
+	sb.WriteString(globToRegex(pattern[last:]))
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// outputName returns the name of the aggregate of the given input name.
+func (r aggregationRule) outputName(name string, match []int) string {
+	return aggregationFieldRegexp.ReplaceAllStringFunc(r.output, func(field string) string {
+		field = strings.Trim(field, "<>")
+		i := r.input.SubexpIndex(field)
+		return name[match[2*i]:match[2*i+1]]
+	})
+}
+
+// readAggregationRules reads the rules of r, one per line, skipping the empty
+// lines and the comments starting with "#".
+func readAggregationRules(r io.Reader) ([]string, error) {
+	var rules []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	return rules, scanner.Err()
+}
+
+// aggregate is the state of the aggregation of an output in a window.
+type aggregate struct {
+	count    int
+	sum      float64
+	min, max float64
+	values   []float64
+}
+
+// add aggregates value. If keepValue is set, at most maxValues values are
+// kept with reservoir sampling, or all of them if maxValues isn't positive.
+func (a *aggregate) add(value float64, keepValue bool, maxValues int) {
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.count++
+	a.sum += value
+	switch {
+	case !keepValue:
+	case maxValues <= 0 || len(a.values) < maxValues:
+		a.values = append(a.values, value)
+	default:
+		// Every value seen so far has the same chance to be kept.
+		if i := rand.Intn(a.count); i < maxValues { //nolint:gosec
+			a.values[i] = value
+		}
+	}
+}
+
+// percentile returns the method computing the given percentile of the values,
+// interpolated between the closest ranks like carbon-aggregator does.
+func percentile(factor float64) func(a *aggregate) float64 {
+	return func(a *aggregate) float64 {
+		values := a.values
+		sort.Float64s(values)
+		rank := factor * float64(len(values)-1)
+		left, right := int(math.Floor(rank)), int(math.Ceil(rank))
+		if left == right {
+			return values[left]
+		}
+		return values[left]*(float64(right)-rank) + values[right]*(rank-float64(left))
+	}
+}
+
+type aggregateKey struct {
+	tenant string
+	rule   int
+	output string
+	// window is the start of the window of the aggregate, in seconds.
+	window int64
+}
+
+// Aggregator aggregates the incoming metrics with carbon-aggregator rules in
+// windows of the frequency of each rule, and writes the aggregates once their
+// window has ended. Every matching rule aggregates a metric.
+//
+// The aggregates are written as the tenant of their inputs.
+type Aggregator struct {
+	rules      []aggregationRule
+	dropInputs bool
+	flushDelay time.Duration
+	maxSeries  int
+	maxValues  int
+	logger     log.Logger
+	timeNow    func() time.Time
+
+	// write is set by the RemoteWriteProxy the aggregator is given to.
+	write func(tenant string, metrics []*schema.MetricData) error
+
+	mtx        sync.Mutex
+	aggregates map[aggregateKey]*aggregate
+
+	inputSamples   *prometheus.CounterVec
+	outputSamples  *prometheus.CounterVec
+	skippedSamples *prometheus.CounterVec
+	activeSeries   prometheus.GaugeFunc
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// NewAggregator creates the Aggregator of the given config, returning an
+// error if any of the rules is invalid. Its metrics are prefixed with prefix.
+func NewAggregator(cfg AggregationConfig, prefix string, reg prometheus.Registerer, logger log.Logger) (*Aggregator, error) {
+	lines := cfg.Rules
+	if cfg.RulesFile != "" {
+		f, err := os.Open(cfg.RulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read aggregation rules: %w", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		fileLines, err := readAggregationRules(f)
+		if err != nil {
+			return nil, fmt.Errorf("can't read aggregation rules: %w", err)
+		}
+		lines = append(fileLines, lines...)
+	}
+
+	a := &Aggregator{
+		dropInputs: cfg.DropInputs,
+		flushDelay: cfg.FlushDelay,
+		maxSeries:  cfg.MaxSeries,
+		maxValues:  cfg.MaxValues,
+		logger:     logger,
+		timeNow:    time.Now,
+		aggregates: map[aggregateKey]*aggregate{},
+		quit:       make(chan struct{}),
+	}
+	for _, line := range lines {
+		rule, err := parseAggregationRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation rule %q: %w", line, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+
+	namespace := prefix + "_aggregation"
+	a.inputSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "input_samples_total",
+		Help:      "The total number of samples matching an aggregation rule.",
+	}, []string{"user"})
+	a.outputSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_samples_total",
+		Help:      "The total number of aggregated samples written, by result.",
+	}, []string{"user", "result"})
+	a.skippedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_samples_total",
+		Help:      "The total number of samples matching an aggregation rule but not aggregated, because their window was already written or because of the max series.",
+	}, []string{"user", "reason"})
+	a.activeSeries = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_series",
+		Help:      "The number of aggregates kept in memory.",
+	}, func() float64 {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		return float64(len(a.aggregates))
+	})
+	for _, c := range []prometheus.Collector{a.inputSamples, a.outputSamples, a.skippedSamples, a.activeSeries} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// add aggregates md with every matching rule, and returns whether md must
+// still be written. The metrics some rule couldn't aggregate, because they're
+// late or because of the max series, are always written so they're not lost.
+func (a *Aggregator) add(tenant string, md *schema.MetricData) bool {
+	if a == nil {
+		return true
+	}
+
+	var (
+		matched bool
+		skipped bool
+		now     = a.timeNow()
+	)
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for i, rule := range a.rules {
+		match := rule.input.FindStringSubmatchIndex(md.Name)
+		if match == nil {
+			continue
+		}
+		matched = true
+
+		window := md.Time - md.Time%rule.frequency
+		if a.due(window, rule.frequency, now) {
+			a.skippedSamples.WithLabelValues(tenant, "late").Inc()
+			skipped = true
+			continue
+		}
+		key := aggregateKey{tenant: tenant, rule: i, output: rule.outputName(md.Name, match), window: window}
+		agg, ok := a.aggregates[key]
+		if !ok {
+			if a.maxSeries > 0 && len(a.aggregates) >= a.maxSeries {
+				a.skippedSamples.WithLabelValues(tenant, "max_series").Inc()
+				skipped = true
+				continue
+			}
+			agg = &aggregate{}
+			a.aggregates[key] = agg
+		}
+		agg.add(md.Value, rule.keepValues, a.maxValues)
+	}
+	if matched {
+		a.inputSamples.WithLabelValues(tenant).Inc()
+	}
+	return !matched || !a.dropInputs || skipped
+}
+
+// due returns whether the aggregates of the window are due to be written.
+func (a *Aggregator) due(window, frequency int64, now time.Time) bool {
+	end := time.Unix(window+frequency, 0)
+	return !now.Before(end.Add(a.flushDelay))
+}
+
+// flush writes the aggregates due at now, or all of them if all is set.
+func (a *Aggregator) flush(now time.Time, all bool) {
+	outputs := map[string][]*schema.MetricData{}
+	a.mtx.Lock()
+	for key, agg := range a.aggregates {
+		rule := a.rules[key.rule]
+		if !all && !a.due(key.window, rule.frequency, now) {
+			continue
+		}
+		delete(a.aggregates, key)
+		outputs[key.tenant] = append(outputs[key.tenant], &schema.MetricData{
+			Name:     key.output,
+			Interval: int(rule.frequency),
+			Value:    aggregationMethods[rule.method](agg),
+			Time:     key.window,
+		})
+	}
+	a.mtx.Unlock()
+
+	for tenant, metrics := range outputs {
+		valid := metrics[:0]
+		for _, md := range metrics {
+			metricDataDefaults(md)
+			if err := md.Validate(); err != nil {
+				a.outputSamples.WithLabelValues(tenant, "invalid").Inc()
+				level.Warn(a.logger).Log("msg", "invalid aggregated metric", "tenant", tenant, "name", md.Name, "err", err)
+				continue
+			}
+			valid = append(valid, md)
+		}
+		if len(valid) == 0 || a.write == nil {
+			continue
+		}
+		if err := a.write(tenant, valid); err != nil {
+			a.outputSamples.WithLabelValues(tenant, "failure").Add(float64(len(valid)))
+			level.Error(a.logger).Log("msg", "failed to write aggregated metrics", "tenant", tenant, "count", len(valid), "err", err)
+			continue
+		}
+		a.outputSamples.WithLabelValues(tenant, "success").Add(float64(len(valid)))
+	}
+}
+
+// Handler returns two functions to run the periodic writes of the aggregates
+// and to stop them. All the aggregates left are written when stopping.
+func (a *Aggregator) Handler() (run func() error, stop func(error)) {
+	run = func() error {
+		ticker := time.NewTicker(aggregationFlushPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.flush(a.timeNow(), false)
+			case <-a.quit:
+				a.flush(a.timeNow(), true)
+				return nil
+			}
+		}
+	}
+	stop = func(error) {
+		a.quitOnce.Do(func() {
+			close(a.quit)
+		})
+	}
+	return run, stop
+}
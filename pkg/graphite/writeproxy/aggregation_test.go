@@ -0,0 +1,339 @@
+package writeproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+)
+
+func TestParseAggregationRule(t *testing.T) {
+	for name, tc := range map[string]struct {
+		rule      string
+		input     string
+		expOutput string
+		expErr    bool
+	}{
+		"fields": {
+			rule:      "<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests",
+			input:     "prod.applications.apache.www01.requests",
+			expOutput: "prod.applications.apache.all.requests",
+		},
+		"multiple nodes field": {
+			rule:      "<<prefix>>.total (60) = sum <<prefix>>.*.count",
+			input:     "servers.dc1.web.host01.count",
+			expOutput: "servers.dc1.web.total",
+		},
+		"no fields": {
+			rule:      "total.requests (10) = count *.requests",
+			input:     "www01.requests",
+			expOutput: "total.requests",
+		},
+		"star matches a single node": {
+			rule:  "total.requests (10) = count *.requests",
+			input: "dc1.www01.requests",
+		},
+		"invalid format": {
+			rule:   "total.requests = count *.requests",
+			expErr: true,
+		},
+		"invalid frequency": {
+			rule:   "total.requests (0) = count *.requests",
+			expErr: true,
+		},
+		"unknown method": {
+			rule:   "total.requests (10) = median *.requests",
+			expErr: true,
+		},
+		"unknown output field": {
+			rule:   "<app>.requests (10) = sum *.requests",
+			expErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rule, err := parseAggregationRule(tc.rule)
+			if tc.expErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			match := rule.input.FindStringSubmatchIndex(tc.input)
+			if tc.expOutput == "" {
+				assert.Nil(t, match)
+				return
+			}
+			require.NotNil(t, match)
+			assert.Equal(t, tc.expOutput, rule.outputName(tc.input, match))
+		})
+	}
+}
+
+func TestAggregationMethods(t *testing.T) {
+	values := []float64{4, 1, 3, 2, 5}
+	agg := &aggregate{}
+	for _, v := range values {
+		agg.add(v, true, 0)
+	}
+
+	for method, expected := range map[string]float64{
+		"sum":   15,
+		"avg":   3,
+		"min":   1,
+		"max":   5,
+		"count": 5,
+		"p50":   3,
+		"p75":   4,
+		"p90":   4.6,
+	} {
+		assert.InDelta(t, expected, aggregationMethods[method](agg), 1e-9, method)
+	}
+}
+
+func TestAggregationMethods_MaxValues(t *testing.T) {
+	agg := &aggregate{}
+	for v := 1; v <= 10000; v++ {
+		agg.add(float64(v), true, 100)
+	}
+
+	// The other methods are still exact.
+	assert.Len(t, agg.values, 100)
+	assert.Equal(t, float64(1), aggregationMethods["min"](agg))
+	assert.Equal(t, float64(10000), aggregationMethods["max"](agg))
+	assert.Equal(t, float64(10000), aggregationMethods["count"](agg))
+	// The sample is uniform, so the median is around the middle.
+	assert.InDelta(t, 5000, aggregationMethods["p50"](agg), 2000)
+}
+
+func TestReadAggregationRules(t *testing.T) {
+	rules, err := readAggregationRules(strings.NewReader(`
+# Totals per application
+<app>.all.requests (60) = sum <app>.*.requests
+
+  total.requests (60) = sum *.*.requests
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"<app>.all.requests (60) = sum <app>.*.requests",
+		"total.requests (60) = sum *.*.requests",
+	}, rules)
+}
+
+// aggregatorWrites records the writes of an aggregator, sorted by name.
+type aggregatorWrites map[string][]*schema.MetricData
+
+func newTestAggregator(t *testing.T, cfg AggregationConfig, now *time.Time) (*Aggregator, aggregatorWrites) {
+	aggregator, err := NewAggregator(cfg, "graphite_proxy", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	aggregator.timeNow = func() time.Time { return *now }
+
+	writes := aggregatorWrites{}
+	aggregator.write = func(tenant string, metrics []*schema.MetricData) error {
+		writes[tenant] = append(writes[tenant], metrics...)
+		sort.Slice(writes[tenant], func(i, j int) bool {
+			return writes[tenant][i].Name < writes[tenant][j].Name
+		})
+		return nil
+	}
+	return aggregator, writes
+}
+
+func TestAggregator(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	aggregator, writes := newTestAggregator(t, AggregationConfig{
+		Rules: []string{
+			"<app>.all.requests (60) = sum <app>.*.requests",
+			"<app>.max.requests (60) = max <app>.*.requests",
+		},
+		FlushDelay: 10 * time.Second,
+	}, &now)
+
+	window := now.Unix() - now.Unix()%60
+	assert.True(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.requests", Value: 1, Time: window}))
+	assert.True(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www02.requests", Value: 2, Time: window + 30}))
+	assert.True(t, aggregator.add("tenant-b", &schema.MetricData{Name: "apache.www01.requests", Value: 5, Time: window}))
+	assert.True(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.errors", Value: 1, Time: window}))
+
+	// The window isn't due before the end of the flush delay.
+	aggregator.flush(time.Unix(window+60+9, 0), false)
+	assert.Empty(t, writes)
+
+	aggregator.flush(time.Unix(window+60+10, 0), false)
+	require.Len(t, writes["tenant-a"], 2)
+	assert.Equal(t, "apache.all.requests", writes["tenant-a"][0].Name)
+	assert.Equal(t, float64(3), writes["tenant-a"][0].Value)
+	assert.Equal(t, window, writes["tenant-a"][0].Time)
+	assert.Equal(t, 60, writes["tenant-a"][0].Interval)
+	assert.Equal(t, "apache.max.requests", writes["tenant-a"][1].Name)
+	assert.Equal(t, float64(2), writes["tenant-a"][1].Value)
+	require.Len(t, writes["tenant-b"], 2)
+	assert.Equal(t, float64(5), writes["tenant-b"][0].Value)
+
+	// Written aggregates are forgotten.
+	assert.Equal(t, float64(0), testutil.ToFloat64(aggregator.activeSeries))
+}
+
+func TestAggregator_DropInputs(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	aggregator, _ := newTestAggregator(t, AggregationConfig{
+		Rules:      []string{"<app>.all.requests (60) = sum <app>.*.requests"},
+		DropInputs: true,
+		FlushDelay: 10 * time.Second,
+	}, &now)
+
+	assert.False(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.requests", Value: 1, Time: now.Unix()}))
+	// Metrics matching no rule are kept.
+	assert.True(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.errors", Value: 1, Time: now.Unix()}))
+}
+
+func TestAggregator_LateSamples(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	aggregator, writes := newTestAggregator(t, AggregationConfig{
+		Rules:      []string{"<app>.all.requests (60) = sum <app>.*.requests"},
+		DropInputs: true,
+		FlushDelay: 10 * time.Second,
+	}, &now)
+
+	// The window of the sample ended more than the flush delay ago, so it
+	// may already have been written. The sample is written as is instead.
+	assert.True(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.requests", Value: 1, Time: now.Unix() - 120}))
+	assert.Equal(t, float64(1), testutil.ToFloat64(aggregator.skippedSamples.WithLabelValues("tenant-a", "late")))
+
+	aggregator.flush(now.Add(time.Hour), false)
+	assert.Empty(t, writes)
+}
+
+func TestAggregator_MaxSeries(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	aggregator, _ := newTestAggregator(t, AggregationConfig{
+		Rules:      []string{"<app>.all.requests (60) = sum <app>.*.requests"},
+		DropInputs: true,
+		FlushDelay: 10 * time.Second,
+		MaxSeries:  1,
+	}, &now)
+
+	assert.False(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.requests", Value: 1, Time: now.Unix()}))
+	assert.False(t, aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www02.requests", Value: 1, Time: now.Unix()}))
+	// A new aggregate over the limit, its input is written as is.
+	assert.True(t, aggregator.add("tenant-a", &schema.MetricData{Name: "nginx.www01.requests", Value: 1, Time: now.Unix()}))
+	assert.Equal(t, float64(1), testutil.ToFloat64(aggregator.skippedSamples.WithLabelValues("tenant-a", "max_series")))
+}
+
+func TestAggregator_FlushesOnStop(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	aggregator, writes := newTestAggregator(t, AggregationConfig{
+		Rules:      []string{"<app>.all.requests (60) = sum <app>.*.requests"},
+		FlushDelay: 10 * time.Second,
+	}, &now)
+	aggregator.add("tenant-a", &schema.MetricData{Name: "apache.www01.requests", Value: 1, Time: now.Unix()})
+
+	run, stop := aggregator.Handler()
+	done := make(chan error)
+	go func() {
+		done <- run()
+	}()
+	stop(nil)
+	require.NoError(t, <-done)
+	require.Len(t, writes["tenant-a"], 1)
+	assert.Equal(t, "apache.all.requests", writes["tenant-a"][0].Name)
+}
+
+func TestNewAggregator_RulesFile(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "aggregation-rules.conf")
+	require.NoError(t, os.WriteFile(rulesFile, []byte("<app>.all.requests (60) = sum <app>.*.requests\n"), 0o600))
+
+	aggregator, err := NewAggregator(AggregationConfig{
+		RulesFile: rulesFile,
+		Rules:     []string{"total.requests (60) = sum *.*.requests"},
+	}, "graphite_proxy", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	require.Len(t, aggregator.rules, 2)
+	assert.Equal(t, "<app>.all.requests", aggregator.rules[0].output)
+
+	_, err = NewAggregator(AggregationConfig{Rules: []string{"invalid"}}, "graphite_proxy", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.Error(t, err)
+}
+
+func TestRemoteWriteMetricsHandler_Aggregation(t *testing.T) {
+	now := time.Now()
+	aggregator, err := NewAggregator(AggregationConfig{
+		Rules:      []string{"<app>.all.requests (60) = sum <app>.*.requests"},
+		DropInputs: true,
+	}, "graphite_proxy", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	metrics := []*schema.MetricData{
+		{Name: "apache.www01.requests", Interval: 10, Value: 1, Time: now.Unix()},
+		{Name: "apache.www02.requests", Interval: 10, Value: 2, Time: now.Unix()},
+		{Name: "apache.www01.errors", Interval: 10, Value: 3, Time: now.Unix()},
+	}
+	body, err := json.Marshal(metrics)
+	require.NoError(t, err)
+
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+	recorderMock.On("measureIncomingSamples", "fake", 3).Return(nil)
+	recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+	recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+	recorderMock.On("measureReceivedSamples", "fake", 1).Return(nil)
+
+	var writes [][]string
+	remoteWriteMock := &remotewritemock.Client{}
+	remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		tenant, err := user.ExtractOrgID(args.Get(0).(context.Context))
+		require.NoError(t, err)
+		assert.Equal(t, "fake", tenant)
+
+		var names []string
+		for _, ts := range args.Get(1).(*mimirpb.WriteRequest).Timeseries {
+			names = append(names, graphiteName(ts.Labels))
+		}
+		writes = append(writes, names)
+	}).Return(nil)
+
+	handler, err := NewRemoteWriteProxy(Config{}, remoteWriteMock, recorderMock, nil, aggregator)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	require.JSONEq(t, `{"published":1}`, recorder.Body.String())
+
+	// The inputs are dropped, and the aggregate is written once flushed.
+	aggregator.flush(now, true)
+	assert.Equal(t, [][]string{{"apache.www01.errors"}, {"apache.all.requests"}}, writes)
+}
+
+// graphiteName returns the Graphite name of an untagged series.
+func graphiteName(lbls []mimirpb.LabelAdapter) string {
+	var nodes []string
+	for _, l := range lbls {
+		if strings.HasPrefix(l.Name, "__n") && l.Name != "__name__" {
+			nodes = append(nodes, l.Value)
+		}
+	}
+	return strings.Join(nodes, ".")
+}
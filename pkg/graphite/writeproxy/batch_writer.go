@@ -0,0 +1,239 @@
+package writeproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/metrictank/schema"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+// batchWriter validates the metrics of a request as they are decoded and
+// writes them upstream in sub-batches, so that a large request never needs
+// all its series in memory at once.
+//
+// Once a metric fails validation the request is going to be rejected, so no
+// further sub-batches are written, but the remaining metrics are still
+// validated so that every rejected sample is counted. The sub-batches written
+// before can't be taken back, so they stay written even though the request
+// fails. With partial writes, invalid metrics are dropped and the request
+// carries on.
+//
+// The metrics routed to another tenant are subject to the limits and the
+// rate limit of that tenant, on top of the request limits of the tenant of
+// the request.
+type batchWriter struct {
+	ctx         context.Context
+	proxy       *RemoteWriteProxy
+	userID      string
+	maxSeries   int
+	partial     bool
+	maxExamples int
+	limits      Limits
+
+	batch []*schema.MetricData
+	// tenants holds the limits of the tenants the metrics are routed to, the
+	// number of their samples in the request and in the current sub-batch.
+	tenants map[string]*tenantState
+
+	// incoming is the number of metrics decoded, accepted the number of them
+	// that passed validation, and published the number of series written
+	// upstream.
+	incoming  int
+	accepted  int
+	published int
+
+	rejected   int
+	rejections map[string]*rejectedSamples
+
+	validationErr error
+
+	// These errors stop the decoding of the request.
+	limitErr     error
+	rateLimitErr error
+	convertErr   error
+	pushErr      error
+}
+
+type tenantState struct {
+	limits  Limits
+	samples int
+	batched int
+	// written holds the series written to the tenant by the request, so that
+	// duplicates are removed across sub-batches. It's nil without dedup.
+	written map[dedupKey]struct{}
+}
+
+// rejectedSamples summarises the samples rejected for a given reason.
+type rejectedSamples struct {
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+// newBatchWriter creates a batchWriter configured after the proxy.
+func newBatchWriter(ctx context.Context, proxy *RemoteWriteProxy, userID string) *batchWriter {
+	return &batchWriter{
+		ctx:         ctx,
+		proxy:       proxy,
+		userID:      userID,
+		maxSeries:   proxy.maxSeriesPerRequest,
+		partial:     proxy.allowPartialWrites,
+		maxExamples: proxy.maxRejectionExamples,
+		limits:      proxy.overrides.ForTenant(userID),
+		tenants:     map[string]*tenantState{},
+		rejections:  map[string]*rejectedSamples{},
+	}
+}
+
+// tenant returns the state of the tenant metrics are routed to.
+func (bw *batchWriter) tenant(tenant string) *tenantState {
+	state, ok := bw.tenants[tenant]
+	if !ok {
+		state = &tenantState{limits: bw.limits}
+		if bw.proxy.dedupPolicy == DedupPolicyFirst || bw.proxy.dedupPolicy == DedupPolicyLast {
+			state.written = map[dedupKey]struct{}{}
+		}
+		if tenant != bw.userID {
+			state.limits = bw.proxy.overrides.ForTenant(tenant)
+		}
+		bw.tenants[tenant] = state
+	}
+	return state
+}
+
+// add validates md and queues it, writing the current sub-batch upstream once
+// it is full. An error is returned if the request exceeds the limits of its
+// tenant or of the tenant md is routed to, or the sub-batch couldn't be
+// written.
+func (bw *batchWriter) add(md *schema.MetricData) error {
+	bw.incoming++
+	if bw.limits.MaxSamplesPerRequest > 0 && bw.incoming > bw.limits.MaxSamplesPerRequest {
+		bw.proxy.recorder.measureRejectedSamples(bw.userID, reasonTooManySamples)
+		bw.limitErr = fmt.Errorf("the request exceeds the limit of %d samples", bw.limits.MaxSamplesPerRequest)
+		return bw.limitErr
+	}
+
+	metricDataDefaults(md)
+	if !bw.proxy.filter.apply(md) {
+		// Filtered samples are dropped by design, they don't fail the
+		// request.
+		bw.proxy.recorder.measureRejectedSamples(bw.userID, reasonFiltered)
+		return nil
+	}
+	// Validate normalises the name, keep it as received for the examples.
+	name := md.Name
+	if err := md.Validate(); err != nil {
+		bw.reject(bw.userID, name, validationReason(err), err)
+		return nil
+	}
+
+	tenant := bw.proxy.tenantRouter.tenant(md, bw.userID)
+	state := bw.tenant(tenant)
+	state.samples++
+	if tenant != bw.userID && state.limits.MaxSamplesPerRequest > 0 && state.samples > state.limits.MaxSamplesPerRequest {
+		bw.proxy.recorder.measureRejectedSamples(tenant, reasonTooManySamples)
+		bw.limitErr = fmt.Errorf("the request exceeds the limit of %d samples of tenant %q", state.limits.MaxSamplesPerRequest, tenant)
+		return bw.limitErr
+	}
+	if reason, err := state.limits.validate(md); err != nil {
+		bw.reject(tenant, name, reason, err)
+		return nil
+	}
+	if bw.validationErr != nil {
+		return nil
+	}
+
+	bw.accepted++
+	bw.batch = append(bw.batch, md)
+	state.batched++
+	// Sub-batches larger than the burst would never be allowed by the rate
+	// limiter.
+	if (bw.maxSeries > 0 && len(bw.batch) >= bw.maxSeries) || (state.limits.IngestionRate > 0 && state.batched >= state.limits.burst()) {
+		return bw.flush()
+	}
+	return nil
+}
+
+// reject counts the sample named name as rejected for the given reason and
+// tenant, keeping the first few errors of each reason as examples. Unless
+// partial writes are allowed, the request fails.
+func (bw *batchWriter) reject(tenant, name, reason string, err error) {
+	if bw.validationErr == nil && !bw.partial {
+		bw.validationErr = err
+	}
+	bw.proxy.recorder.measureRejectedSamples(tenant, reason)
+	bw.rejected++
+
+	rejection, ok := bw.rejections[reason]
+	if !ok {
+		rejection = &rejectedSamples{Examples: []string{}}
+		bw.rejections[reason] = rejection
+	}
+	rejection.Count++
+	if len(rejection.Examples) < bw.maxExamples {
+		rejection.Examples = append(rejection.Examples, fmt.Sprintf("%q: %s", name, err))
+	}
+}
+
+// stopped returns whether the decoding was stopped by the writer, rather than
+// because of an invalid body.
+func (bw *batchWriter) stopped() bool {
+	return bw.limitErr != nil || bw.rateLimitErr != nil || bw.convertErr != nil || bw.pushErr != nil
+}
+
+// flush writes the queued metrics upstream, unless the request has already
+// failed validation.
+func (bw *batchWriter) flush() error {
+	if len(bw.batch) == 0 || bw.validationErr != nil {
+		return nil
+	}
+
+	for _, tb := range bw.proxy.tenantRouter.split(bw.batch, bw.userID) {
+		limits := bw.tenant(tb.tenant).limits
+		if !bw.proxy.rateLimiter.AllowN(tb.tenant, limits, time.Now(), len(tb.metrics)) {
+			for range tb.metrics {
+				bw.proxy.recorder.measureRejectedSamples(tb.tenant, reasonRateLimited)
+			}
+			bw.rateLimitErr = errorx.TooManyRequests{Msg: fmt.Sprintf("ingestion rate limit of %g samples per second with a burst of %d exceeded", limits.IngestionRate, limits.burst())}
+			return bw.rateLimitErr
+		}
+
+		metrics := bw.proxy.aggregate(bw.userID, tb.metrics)
+		if len(metrics) == 0 {
+			continue
+		}
+		ctx := bw.ctx
+		if tb.tenant != bw.userID {
+			ctx = user.InjectOrgID(ctx, tb.tenant)
+		}
+		series, metadata, err := bw.proxy.convert(ctx, tb.tenant, metrics, bw.tenant(tb.tenant).written)
+		if err != nil {
+			bw.convertErr = err
+			return err
+		}
+		count := len(series)
+
+		if err := bw.proxy.push(ctx, series, metadata); err != nil {
+			bw.pushErr = err
+			return err
+		}
+		bw.published += count
+		if tb.tenant != bw.userID {
+			bw.proxy.recorder.measureRoutedSamples(bw.userID, tb.tenant, count)
+		}
+	}
+
+	// The metrics have been converted, so the slice can be reused without
+	// keeping them alive.
+	for i := range bw.batch {
+		bw.batch[i] = nil
+	}
+	bw.batch = bw.batch[:0]
+	for _, state := range bw.tenants {
+		state.batched = 0
+	}
+	return nil
+}
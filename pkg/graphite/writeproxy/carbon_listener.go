@@ -0,0 +1,422 @@
+package writeproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/metrictank/schema"
+)
+
+const (
+	CarbonFormatPlaintext = "plaintext"
+	CarbonFormatPickle    = "pickle"
+
+	networkTCP = "tcp"
+	networkUDP = "udp"
+
+	defaultCarbonBatchSize     = 1000
+	defaultCarbonFlushInterval = time.Second
+
+	maxUDPPacketSize = 65535
+)
+
+// CarbonConfig configures the carbon protocol listeners.
+type CarbonConfig struct {
+	BatchSize     int                    `yaml:"batch_size"`
+	FlushInterval time.Duration          `yaml:"flush_interval"`
+	Listeners     []CarbonListenerConfig `yaml:"listeners"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it. Listeners can only be configured in the config file.
+func (c *CarbonConfig) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	flags.IntVar(&c.BatchSize, prefix+"carbon.batch-size", defaultCarbonBatchSize, "Maximum number of carbon samples sent upstream in a single write request.")
+	flags.DurationVar(&c.FlushInterval, prefix+"carbon.flush-interval", defaultCarbonFlushInterval, "Maximum time carbon samples are buffered before being sent upstream.")
+}
+
+// CarbonListenerConfig configures a single carbon listener. All the samples
+// received by a listener are written to the same tenant, unless routed to
+// another tenant by the tenant routes.
+type CarbonListenerConfig struct {
+	// Network is either "tcp" or "udp".
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Format  string `yaml:"format"`
+	OrgID   string `yaml:"org_id"`
+}
+
+func (c CarbonListenerConfig) Validate() error {
+	if c.Network != networkTCP && c.Network != networkUDP {
+		return fmt.Errorf("invalid carbon listener network %q, must be %q or %q", c.Network, networkTCP, networkUDP)
+	}
+	if c.Address == "" {
+		return fmt.Errorf("carbon listener address can't be empty")
+	}
+	switch c.Format {
+	case CarbonFormatPlaintext:
+	case CarbonFormatPickle:
+		if c.Network != networkTCP {
+			return fmt.Errorf("carbon pickle format is only supported over %q", networkTCP)
+		}
+	default:
+		return fmt.Errorf("invalid carbon listener format %q, must be %q or %q", c.Format, CarbonFormatPlaintext, CarbonFormatPickle)
+	}
+	if c.OrgID == "" {
+		return fmt.Errorf("carbon listener org ID can't be empty")
+	}
+	return nil
+}
+
+// CarbonListener receives metrics over the carbon protocols, batches them and
+// writes them upstream through a RemoteWriteProxy.
+type CarbonListener struct {
+	cfg           CarbonListenerConfig
+	batchSize     int
+	flushInterval time.Duration
+	proxy         *RemoteWriteProxy
+	logger        log.Logger
+	timeNow       func() time.Time
+
+	listener   net.Listener
+	packetConn net.PacketConn
+
+	metrics  chan *schema.MetricData
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	connsMtx sync.Mutex
+	conns    map[net.Conn]struct{}
+	connsWg  sync.WaitGroup
+}
+
+// NewCarbonListener validates the config and binds the listener socket, so
+// that errors are reported before the app is started.
+func NewCarbonListener(cfg CarbonConfig, listenerCfg CarbonListenerConfig, proxy *RemoteWriteProxy, logger log.Logger) (*CarbonListener, error) {
+	if err := listenerCfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.BatchSize <= 0 {
+		return nil, fmt.Errorf("carbon batch size must be positive")
+	}
+	if cfg.FlushInterval <= 0 {
+		return nil, fmt.Errorf("carbon flush interval must be positive")
+	}
+
+	l := &CarbonListener{
+		cfg:           listenerCfg,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		proxy:         proxy,
+		logger:        log.With(logger, "component", "carbon", "network", listenerCfg.Network, "format", listenerCfg.Format),
+		timeNow:       time.Now,
+		metrics:       make(chan *schema.MetricData, cfg.BatchSize),
+		quit:          make(chan struct{}),
+		conns:         map[net.Conn]struct{}{},
+	}
+
+	var err error
+	switch listenerCfg.Network {
+	case networkTCP:
+		l.listener, err = net.Listen(networkTCP, listenerCfg.Address)
+	case networkUDP:
+		l.packetConn, err = net.ListenPacket(networkUDP, listenerCfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	level.Info(l.logger).Log("msg", "carbon listener listening on address", "addr", l.Addr().String())
+	return l, nil
+}
+
+// Addr returns the address the listener is listening on.
+func (l *CarbonListener) Addr() net.Addr {
+	if l.listener != nil {
+		return l.listener.Addr()
+	}
+	return l.packetConn.LocalAddr()
+}
+
+// Handler returns two functions to run and stop the listener.
+func (l *CarbonListener) Handler() (run func() error, stop func(error)) {
+	return l.Run, func(error) { l.Stop() }
+}
+
+// Run serves connections until Stop is called. Buffered samples are flushed
+// before it returns.
+func (l *CarbonListener) Run() error {
+	batcherDone := make(chan struct{})
+	go func() {
+		defer close(batcherDone)
+		l.runBatcher()
+	}()
+
+	var err error
+	if l.listener != nil {
+		err = l.serveTCP()
+	} else {
+		err = l.serveUDP()
+	}
+
+	l.connsWg.Wait()
+	close(l.metrics)
+	<-batcherDone
+	return err
+}
+
+// Stop closes the listener and all open connections.
+func (l *CarbonListener) Stop() {
+	l.quitOnce.Do(func() {
+		close(l.quit)
+		if l.listener != nil {
+			_ = l.listener.Close()
+		} else {
+			_ = l.packetConn.Close()
+		}
+
+		l.connsMtx.Lock()
+		defer l.connsMtx.Unlock()
+		for conn := range l.conns {
+			_ = conn.Close()
+		}
+	})
+}
+
+func (l *CarbonListener) stopping() bool {
+	select {
+	case <-l.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *CarbonListener) serveTCP() error {
+	level.Info(l.logger).Log("msg", "Starting carbon listener", "addr", l.listener.Addr().String())
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if l.stopping() {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				level.Warn(l.logger).Log("msg", "failed to accept connection", "err", err)
+				continue
+			}
+			return err
+		}
+
+		l.connsMtx.Lock()
+		if l.stopping() {
+			l.connsMtx.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		l.conns[conn] = struct{}{}
+		l.connsWg.Add(1)
+		l.connsMtx.Unlock()
+
+		go l.handleConn(conn)
+	}
+}
+
+func (l *CarbonListener) handleConn(conn net.Conn) {
+	defer l.connsWg.Done()
+	defer func() {
+		l.connsMtx.Lock()
+		delete(l.conns, conn)
+		l.connsMtx.Unlock()
+		_ = conn.Close()
+	}()
+
+	if err := l.decode(conn); err != nil && !l.stopping() {
+		level.Warn(l.logger).Log("msg", "failed to read from carbon connection", "remote", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+func (l *CarbonListener) serveUDP() error {
+	level.Info(l.logger).Log("msg", "Starting carbon listener", "addr", l.packetConn.LocalAddr().String())
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, _, err := l.packetConn.ReadFrom(buf)
+		if err != nil {
+			if l.stopping() {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if err := l.decode(bytes.NewReader(buf[:n])); err != nil {
+			level.Warn(l.logger).Log("msg", "failed to read carbon packet", "err", err)
+		}
+	}
+}
+
+// decode reads all the samples from r in the configured format and queues
+// them to be written.
+func (l *CarbonListener) decode(r io.Reader) error {
+	if l.cfg.Format == CarbonFormatPickle {
+		return decodeCarbonPickle(r, l.timeNow, l.enqueue, l.reject)
+	}
+	return decodeCarbonPlaintext(r, l.timeNow, l.enqueue, l.reject)
+}
+
+func (l *CarbonListener) reject(reason string, err error) {
+	l.proxy.recorder.measureRejectedSamples(l.cfg.OrgID, reason)
+	level.Debug(l.logger).Log("msg", "failed to parse carbon data", "reason", reason, "err", err)
+}
+
+func (l *CarbonListener) enqueue(md *schema.MetricData) {
+	l.metrics <- md
+}
+
+// runBatcher collects samples until the batch is full or the flush interval
+// elapses, whichever happens first. It returns once the metrics channel is
+// closed and the last batch has been flushed.
+func (l *CarbonListener) runBatcher() {
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*schema.MetricData, 0, l.batchSize)
+	for {
+		select {
+		case md, ok := <-l.metrics:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			batch = append(batch, md)
+			if len(batch) >= l.batchSize {
+				l.flush(batch)
+				batch = make([]*schema.MetricData, 0, l.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				l.flush(batch)
+				batch = make([]*schema.MetricData, 0, l.batchSize)
+			}
+		}
+	}
+}
+
+// flush validates and writes a batch upstream. Unlike HTTP requests, carbon
+// lines are independent of each other, so invalid samples are dropped without
+// affecting the rest of the batch. The samples are subject to the limits and
+// the rate limit of the tenant they're routed to, those exceeding them are
+// dropped as well.
+func (l *CarbonListener) flush(batch []*schema.MetricData) {
+	if len(batch) == 0 {
+		return
+	}
+	userID := l.cfg.OrgID
+	ctx := user.InjectOrgID(context.Background(), userID)
+	recorder := l.proxy.recorder
+
+	recorder.measureIncomingRequest(userID)
+	recorder.measureIncomingSamples(userID, len(batch))
+
+	limits := map[string]Limits{}
+	tenantLimits := func(tenant string) Limits {
+		tl, ok := limits[tenant]
+		if !ok {
+			tl = l.proxy.overrides.ForTenant(tenant)
+			limits[tenant] = tl
+		}
+		return tl
+	}
+
+	valid := batch[:0]
+	for _, md := range batch {
+		metricDataDefaults(md)
+		if !l.proxy.filter.apply(md) {
+			recorder.measureRejectedSamples(userID, reasonFiltered)
+			continue
+		}
+		if err := md.Validate(); err != nil {
+			recorder.measureRejectedSamples(userID, validationReason(err))
+			continue
+		}
+		tenant := l.proxy.tenantRouter.tenant(md, userID)
+		if reason, err := tenantLimits(tenant).validate(md); err != nil {
+			recorder.measureRejectedSamples(tenant, reason)
+			level.Debug(l.logger).Log("msg", "carbon sample exceeds the limits", "tenant", tenant, "reason", reason, "err", err)
+			continue
+		}
+		valid = append(valid, md)
+	}
+	if len(valid) == 0 {
+		return
+	}
+
+	published := 0
+	for _, tb := range l.proxy.tenantRouter.split(valid, userID) {
+		metrics := l.proxy.aggregate(userID, l.rateLimit(tb, tenantLimits(tb.tenant)))
+		if len(metrics) == 0 {
+			continue
+		}
+		tenantCtx := ctx
+		if tb.tenant != userID {
+			tenantCtx = user.InjectOrgID(ctx, tb.tenant)
+		}
+		series, metadata, err := l.proxy.convert(tenantCtx, tb.tenant, metrics, nil)
+		if err != nil {
+			level.Error(l.logger).Log("msg", "failed to generate prometheus series from carbon metrics", "tenant", tb.tenant, "err", err)
+			continue
+		}
+		count := len(series)
+
+		if err := l.proxy.push(tenantCtx, series, metadata); err != nil {
+			level.Error(l.logger).Log("msg", "failed to push carbon metric data", "tenant", tb.tenant, "count", count, "err", err)
+			continue
+		}
+		published += count
+		if tb.tenant != userID {
+			recorder.measureRoutedSamples(userID, tb.tenant, count)
+		}
+	}
+	if published == 0 {
+		return
+	}
+
+	recorder.measureReceivedRequest(userID)
+	recorder.measureReceivedSamples(userID, published)
+}
+
+// rateLimit returns the metrics of the tenant batch within its ingestion rate
+// limit, dropping the others. The batch is checked in chunks of at most the
+// burst, which would never be allowed otherwise.
+func (l *CarbonListener) rateLimit(tb tenantBatch, limits Limits) []*schema.MetricData {
+	if limits.IngestionRate <= 0 {
+		return tb.metrics
+	}
+	allowed := tb.metrics[:0]
+	for start := 0; start < len(tb.metrics); start += limits.burst() {
+		chunk := tb.metrics[start:min(start+limits.burst(), len(tb.metrics))]
+		if l.proxy.rateLimiter.AllowN(tb.tenant, limits, time.Now(), len(chunk)) {
+			allowed = append(allowed, chunk...)
+			continue
+		}
+		for range chunk {
+			l.proxy.recorder.measureRejectedSamples(tb.tenant, reasonRateLimited)
+		}
+	}
+	return allowed
+}
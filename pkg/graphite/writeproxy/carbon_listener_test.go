@@ -0,0 +1,237 @@
+package writeproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+)
+
+type carbonWrite struct {
+	orgID  string
+	series []mimirpb.PreallocTimeseries
+}
+
+// newCarbonTestClient returns a remote write client that sends a copy of every
+// write to the returned channel.
+func newCarbonTestClient(t *testing.T) (*remotewritemock.Client, chan carbonWrite) {
+	writes := make(chan carbonWrite, 10)
+	remoteWriteMock := &remotewritemock.Client{}
+	remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		orgID, err := user.ExtractOrgID(args.Get(0).(context.Context))
+		require.NoError(t, err)
+		req := args.Get(1).(*mimirpb.WriteRequest)
+		// The series are returned to the pool after the write, keep a copy.
+		series := make([]mimirpb.PreallocTimeseries, 0, len(req.Timeseries))
+		for _, ts := range req.Timeseries {
+			series = append(series, mimirpb.PreallocTimeseries{TimeSeries: &mimirpb.TimeSeries{
+				Labels:  append([]mimirpb.LabelAdapter(nil), ts.Labels...),
+				Samples: append([]mimirpb.Sample(nil), ts.Samples...),
+			}})
+		}
+		writes <- carbonWrite{orgID: orgID, series: series}
+	}).Return(nil)
+	return remoteWriteMock, writes
+}
+
+func newCarbonTestListener(t *testing.T, network, format string, batchSize int, recorderMock *MockRecorder) (*CarbonListener, chan carbonWrite) {
+	remoteWriteMock, writes := newCarbonTestClient(t)
+	proxy, err := NewRemoteWriteProxy(Config{}, remoteWriteMock, recorderMock, nil, nil)
+	require.NoError(t, err)
+	listener, err := NewCarbonListener(
+		CarbonConfig{BatchSize: batchSize, FlushInterval: time.Hour},
+		CarbonListenerConfig{Network: network, Address: "127.0.0.1:0", Format: format, OrgID: "123"},
+		proxy,
+		log.NewNopLogger(),
+	)
+	require.NoError(t, err)
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- listener.Run()
+	}()
+	t.Cleanup(func() {
+		listener.Stop()
+		require.NoError(t, <-runErr)
+	})
+
+	return listener, writes
+}
+
+func newCarbonRecorderMock() *MockRecorder {
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measureIncomingRequest", "123").Return(nil)
+	recorderMock.On("measureIncomingSamples", "123", mock.Anything).Return(nil)
+	recorderMock.On("measureConversionDuration", "123", mock.Anything).Return(nil)
+	recorderMock.On("measureReceivedRequest", "123").Return(nil)
+	recorderMock.On("measureReceivedSamples", "123", mock.Anything).Return(nil)
+	recorderMock.On("measureRejectedSamples", "123", mock.Anything).Return(nil)
+	return recorderMock
+}
+
+func waitCarbonWrite(t *testing.T, writes chan carbonWrite) carbonWrite {
+	select {
+	case w := <-writes:
+		return w
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for write")
+		return carbonWrite{}
+	}
+}
+
+func TestCarbonListener_TCP(t *testing.T) {
+	recorderMock := newCarbonRecorderMock()
+	listener, writes := newCarbonTestListener(t, networkTCP, CarbonFormatPlaintext, 2, recorderMock)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	_, err = fmt.Fprint(conn, "some.test.metric 1 1600000000\nnot valid\nsome.test.metric;foo=bar 2 1600000000\n")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	w := waitCarbonWrite(t, writes)
+	assert.Equal(t, "123", w.orgID)
+	require.Len(t, w.series, 2)
+	assert.Equal(t, []mimirpb.LabelAdapter{
+		{Name: "__n000__", Value: "some"},
+		{Name: "__n001__", Value: "test"},
+		{Name: "__n002__", Value: "metric"},
+		{Name: "__name__", Value: "graphite_untagged"},
+	}, w.series[0].Labels)
+	assert.Equal(t, []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}}, w.series[0].Samples)
+	assert.Equal(t, []mimirpb.LabelAdapter{
+		{Name: "__name__", Value: "graphite_tagged"},
+		{Name: "foo", Value: "bar"},
+		{Name: "name", Value: "some.test.metric"},
+	}, w.series[1].Labels)
+
+	recorderMock.AssertCalled(t, "measureRejectedSamples", "123", reasonCantParseLine)
+	recorderMock.AssertCalled(t, "measureReceivedSamples", "123", 2)
+}
+
+func TestCarbonListener_UDP(t *testing.T) {
+	recorderMock := newCarbonRecorderMock()
+	listener, writes := newCarbonTestListener(t, networkUDP, CarbonFormatPlaintext, 1, recorderMock)
+
+	conn, err := net.Dial("udp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "some.test.metric 1 1600000000\n")
+	require.NoError(t, err)
+
+	w := waitCarbonWrite(t, writes)
+	assert.Equal(t, "123", w.orgID)
+	require.Len(t, w.series, 1)
+	assert.Equal(t, []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}}, w.series[0].Samples)
+}
+
+func TestCarbonListener_Pickle(t *testing.T) {
+	recorderMock := newCarbonRecorderMock()
+	listener, writes := newCarbonTestListener(t, networkTCP, CarbonFormatPickle, 1, recorderMock)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	// [("a.b", ("1600000000", "4.5"))]
+	_, err = pickleMessages("\x80\x02]q\x00X\x03\x00\x00\x00a.bq\x01X\n\x00\x00\x001600000000q\x02X\x03\x00\x00\x004.5q\x03\x86q\x04\x86q\x05a.").WriteTo(conn)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	w := waitCarbonWrite(t, writes)
+	assert.Equal(t, "123", w.orgID)
+	require.Len(t, w.series, 1)
+	assert.Equal(t, []mimirpb.Sample{{Value: 4.5, TimestampMs: 1600000000000}}, w.series[0].Samples)
+}
+
+func TestCarbonListener_FlushesOnClose(t *testing.T) {
+	remoteWriteMock, writes := newCarbonTestClient(t)
+	proxy, err := NewRemoteWriteProxy(Config{}, remoteWriteMock, newCarbonRecorderMock(), nil, nil)
+	require.NoError(t, err)
+	listener := &CarbonListener{
+		cfg:           CarbonListenerConfig{OrgID: "123"},
+		batchSize:     100,
+		flushInterval: time.Hour,
+		proxy:         proxy,
+		logger:        log.NewNopLogger(),
+		metrics:       make(chan *schema.MetricData, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listener.runBatcher()
+	}()
+
+	// The batch is not full, so nothing is written until the channel closes.
+	listener.metrics <- &schema.MetricData{Name: "some.test.metric", Value: 1, Time: 1600000000, Interval: carbonInterval}
+	close(listener.metrics)
+
+	w := waitCarbonWrite(t, writes)
+	require.Len(t, w.series, 1)
+	<-done
+}
+
+func TestCarbonListener_Limits(t *testing.T) {
+	recorderMock := newCarbonRecorderMock()
+	remoteWriteMock, writes := newCarbonTestClient(t)
+	overrides, err := NewOverrides(LimitsConfig{Limits: Limits{IngestionRate: 1, IngestionBurstSize: 2, MaxNameLength: 16}}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	proxy, err := NewRemoteWriteProxy(Config{}, remoteWriteMock, recorderMock, overrides, nil)
+	require.NoError(t, err)
+	listener := &CarbonListener{
+		cfg:    CarbonListenerConfig{OrgID: "123"},
+		proxy:  proxy,
+		logger: log.NewNopLogger(),
+	}
+
+	metric := func(name string) *schema.MetricData {
+		return &schema.MetricData{Name: name, Value: 1, Time: 1600000000, Interval: carbonInterval}
+	}
+	listener.flush([]*schema.MetricData{
+		metric("some.very.long.metric.name"),
+		metric("a"),
+		metric("b"),
+		metric("c"),
+	})
+
+	// The first chunk is within the burst, the second one is rate limited.
+	w := waitCarbonWrite(t, writes)
+	assert.Len(t, w.series, 2)
+	recorderMock.AssertCalled(t, "measureRejectedSamples", "123", reasonNameTooLong)
+	recorderMock.AssertCalled(t, "measureRejectedSamples", "123", reasonRateLimited)
+	recorderMock.AssertCalled(t, "measureReceivedSamples", "123", 2)
+	select {
+	case <-writes:
+		t.Fatal("the rate limited samples were written")
+	default:
+	}
+}
+
+func TestCarbonListenerConfig_Validate(t *testing.T) {
+	valid := CarbonListenerConfig{Network: networkTCP, Address: ":2003", Format: CarbonFormatPlaintext, OrgID: "1"}
+	require.NoError(t, valid.Validate())
+
+	for name, modify := range map[string]func(*CarbonListenerConfig){
+		"unknown network": func(c *CarbonListenerConfig) { c.Network = "unix" },
+		"empty address":   func(c *CarbonListenerConfig) { c.Address = "" },
+		"unknown format":  func(c *CarbonListenerConfig) { c.Format = "json" },
+		"pickle over udp": func(c *CarbonListenerConfig) { c.Network, c.Format = networkUDP, CarbonFormatPickle },
+		"empty org ID":    func(c *CarbonListenerConfig) { c.OrgID = "" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			modify(&cfg)
+			assert.Error(t, cfg.Validate())
+		})
+	}
+}
@@ -0,0 +1,674 @@
+package writeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+const (
+	// maxPickleMessageSize is the largest pickle message accepted, the same
+	// limit carbon's pickle receiver has.
+	maxPickleMessageSize = 1 << 20
+
+	// reasonCantParsePickle is the rejected samples reason for pickle
+	// messages that can't be decoded. The message is counted once, since the
+	// number of samples it contains is unknown.
+	reasonCantParsePickle = "cant_parse_pickle"
+)
+
+var (
+	errInvalidPickle     = errors.New("invalid pickle")
+	errPickleTooLarge    = errors.New("pickle message too large")
+	errUnsupportedPickle = errors.New("unsupported pickle opcode")
+)
+
+// decodeCarbonPickle reads length-prefixed pickle messages from r until EOF,
+// as sent to carbon's pickle receiver. Each message is a pickled list of
+// (path, (timestamp, value)) tuples. Every datapoint that is decoded
+// successfully is passed to emit. Messages and datapoints that can't be
+// decoded are passed to reject and skipped. An error is returned when the
+// stream can't be read anymore, for example because of an oversized message.
+func decodeCarbonPickle(r io.Reader, now func() time.Time, emit func(*schema.MetricData), reject func(reason string, err error)) error {
+	br := bufio.NewReader(r)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxPickleMessageSize {
+			return fmt.Errorf("%w: %d bytes, max is %d", errPickleTooLarge, size, maxPickleMessageSize)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+
+		datapoints, err := unpickle(payload)
+		if err != nil {
+			reject(reasonCantParsePickle, err)
+			continue
+		}
+		items, ok := pickleSequence(datapoints)
+		if !ok {
+			reject(reasonCantParsePickle, fmt.Errorf("%w: expected a list of datapoints, got %T", errInvalidPickle, datapoints))
+			continue
+		}
+		for _, item := range items {
+			md, err := metricDataFromPickle(item, now)
+			if err != nil {
+				reject(reasonCantParseLine, err)
+				continue
+			}
+			emit(md)
+		}
+	}
+}
+
+// metricDataFromPickle converts a single (path, (timestamp, value)) item.
+// Like carbon, numbers may also be given as strings.
+func metricDataFromPickle(item interface{}, now func() time.Time) (*schema.MetricData, error) {
+	fields, ok := pickleSequence(item)
+	if !ok || len(fields) != 2 { //nolint:gomnd
+		return nil, fmt.Errorf("%w: expected a (path, (timestamp, value)) datapoint", errInvalidPickle)
+	}
+	path, ok := fields[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a string path, got %T", errInvalidPickle, fields[0])
+	}
+	datapoint, ok := pickleSequence(fields[1])
+	if !ok || len(datapoint) != 2 { //nolint:gomnd
+		return nil, fmt.Errorf("%w: expected a (timestamp, value) datapoint for %q", errInvalidPickle, path)
+	}
+	ts, err := pickleFloat(datapoint[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp for %q: %w", path, err)
+	}
+	value, err := pickleFloat(datapoint[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %q: %w", path, err)
+	}
+	if math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return nil, fmt.Errorf("%w: invalid timestamp for %q", errInvalidPickle, path)
+	}
+
+	timestamp := int64(ts)
+	if timestamp == -1 {
+		timestamp = now().Unix()
+	}
+	return carbonMetricData(path, value, timestamp)
+}
+
+func pickleSequence(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case *pickleList:
+		return s.items, true
+	case pickleTuple:
+		return s, true
+	}
+	return nil, false
+}
+
+func pickleFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q is not a number", errInvalidPickle, n)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%w: expected a number, got %T", errInvalidPickle, v)
+}
+
+// pickleList is a list built by the unpickler. It is a pointer type because
+// lists are mutable and may be referenced from the memo while being appended
+// to.
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleTuple []interface{}
+
+// pickleMark is pushed on the stack by the MARK opcode.
+type pickleMark struct{}
+
+// Pickle opcodes supported by unpickle. Opcodes that would construct objects,
+// import globals or call functions are deliberately not supported, so
+// untrusted input can only produce lists, tuples, strings and numbers.
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opFloat          = 'F'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opLong           = 'L'
+	opBinInt2        = 'M'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opList           = 'l'
+	opEmptyList      = ']'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opTuple          = 't'
+	opEmptyTuple     = ')'
+	opBinFloat       = 'G'
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+
+	opProto           = 0x80
+	opTuple1          = 0x85
+	opTuple2          = 0x86
+	opTuple3          = 0x87
+	opLong1           = 0x8a
+	opLong4           = 0x8b
+	opShortBinUnicode = 0x8c
+	opBinUnicode8     = 0x8d
+	opMemoize         = 0x94
+	opFrame           = 0x95
+)
+
+// unpickle decodes a pickle of protocol 0 to 4 restricted to lists, tuples,
+// strings and numbers.
+func unpickle(data []byte) (interface{}, error) {
+	u := unpickler{data: data, memo: map[uint64]interface{}{}}
+	return u.run()
+}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[uint64]interface{}
+}
+
+func (u *unpickler) run() (interface{}, error) { //nolint:gocyclo
+	for {
+		op, err := u.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opProto:
+			if _, err := u.readByte(); err != nil {
+				return nil, err
+			}
+		case opFrame:
+			if _, err := u.read(8); err != nil { //nolint:gomnd
+				return nil, err
+			}
+		case opStop:
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			if len(u.stack) != 0 {
+				return nil, fmt.Errorf("%w: stack not empty at STOP", errInvalidPickle)
+			}
+			return v, nil
+
+		case opMark:
+			u.push(pickleMark{})
+		case opPop:
+			if _, err := u.pop(); err != nil {
+				return nil, err
+			}
+		case opPopMark:
+			if _, err := u.popMark(); err != nil {
+				return nil, err
+			}
+
+		case opEmptyList:
+			u.push(&pickleList{})
+		case opList:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(&pickleList{items: items})
+		case opAppend:
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			list, err := u.topList()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, v)
+		case opAppends:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			list, err := u.topList()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, items...)
+
+		case opEmptyTuple:
+			u.push(pickleTuple{})
+		case opTuple:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(pickleTuple(items))
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(u.stack) < n {
+				return nil, fmt.Errorf("%w: stack underflow", errInvalidPickle)
+			}
+			items := make(pickleTuple, n)
+			copy(items, u.stack[len(u.stack)-n:])
+			u.stack = u.stack[:len(u.stack)-n]
+			for _, item := range items {
+				if _, ok := item.(pickleMark); ok {
+					return nil, fmt.Errorf("%w: unexpected mark", errInvalidPickle)
+				}
+			}
+			u.push(items)
+
+		case opString:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			s, err := unquotePickleString(line)
+			if err != nil {
+				return nil, err
+			}
+			u.push(s)
+		case opUnicode:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			u.push(decodeRawUnicodeEscape(line))
+		case opShortBinString, opShortBinBytes, opShortBinUnicode:
+			n, err := u.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.pushString(uint64(n)); err != nil {
+				return nil, err
+			}
+		case opBinString, opBinBytes, opBinUnicode:
+			b, err := u.read(4) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			if err := u.pushString(uint64(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+		case opBinUnicode8:
+			b, err := u.read(8) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			if err := u.pushString(binary.LittleEndian.Uint64(b)); err != nil {
+				return nil, err
+			}
+
+		case opInt:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			// Protocol 0 booleans are encoded as "I01" and "I00", which parse
+			// to 1 and 0 as well.
+			n, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid INT %q", errInvalidPickle, line)
+			}
+			u.push(n)
+		case opLong:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid LONG %q", errInvalidPickle, line)
+			}
+			u.push(n)
+		case opBinInt:
+			b, err := u.read(4) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+		case opBinInt1:
+			b, err := u.readByte()
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(b))
+		case opBinInt2:
+			b, err := u.read(2) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(binary.LittleEndian.Uint16(b)))
+		case opLong1:
+			n, err := u.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.pushLong(uint64(n)); err != nil {
+				return nil, err
+			}
+		case opLong4:
+			b, err := u.read(4) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			if err := u.pushLong(uint64(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+
+		case opFloat:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			f, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid FLOAT %q", errInvalidPickle, line)
+			}
+			u.push(f)
+		case opBinFloat:
+			b, err := u.read(8) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+
+		case opPut:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.ParseUint(line, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid PUT %q", errInvalidPickle, line)
+			}
+			if err := u.put(idx); err != nil {
+				return nil, err
+			}
+		case opBinPut:
+			idx, err := u.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.put(uint64(idx)); err != nil {
+				return nil, err
+			}
+		case opLongBinPut:
+			b, err := u.read(4) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			if err := u.put(uint64(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+		case opMemoize:
+			if err := u.put(uint64(len(u.memo))); err != nil {
+				return nil, err
+			}
+		case opGet:
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.ParseUint(line, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid GET %q", errInvalidPickle, line)
+			}
+			if err := u.get(idx); err != nil {
+				return nil, err
+			}
+		case opBinGet:
+			idx, err := u.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.get(uint64(idx)); err != nil {
+				return nil, err
+			}
+		case opLongBinGet:
+			b, err := u.read(4) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+			if err := u.get(uint64(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("%w: 0x%02x", errUnsupportedPickle, op)
+		}
+	}
+}
+
+func (u *unpickler) readByte() (byte, error) {
+	if u.pos >= len(u.data) {
+		return 0, fmt.Errorf("%w: unexpected end of data", errInvalidPickle)
+	}
+	b := u.data[u.pos]
+	u.pos++
+	return b, nil
+}
+
+func (u *unpickler) read(n uint64) ([]byte, error) {
+	if n > uint64(len(u.data)-u.pos) {
+		return nil, fmt.Errorf("%w: unexpected end of data", errInvalidPickle)
+	}
+	b := u.data[u.pos : u.pos+int(n)]
+	u.pos += int(n)
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	idx := bytes.IndexByte(u.data[u.pos:], '\n')
+	if idx < 0 {
+		return "", fmt.Errorf("%w: unexpected end of data", errInvalidPickle)
+	}
+	line := string(u.data[u.pos : u.pos+idx])
+	u.pos += idx + 1
+	return line, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", errInvalidPickle)
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	if _, ok := v.(pickleMark); ok {
+		return nil, fmt.Errorf("%w: unexpected mark", errInvalidPickle)
+	}
+	return v, nil
+}
+
+// popMark pops all the items above the topmost mark, and the mark itself.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := make([]interface{}, len(u.stack)-i-1)
+			copy(items, u.stack[i+1:])
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: mark not found", errInvalidPickle)
+}
+
+func (u *unpickler) topList() (*pickleList, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", errInvalidPickle)
+	}
+	list, ok := u.stack[len(u.stack)-1].(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("%w: append to %T", errInvalidPickle, u.stack[len(u.stack)-1])
+	}
+	return list, nil
+}
+
+// pushString pushes the next n bytes as a string. Byte strings and unicode
+// strings are treated the same, only valid UTF-8 is accepted.
+func (u *unpickler) pushString(n uint64) error {
+	b, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(b) {
+		return fmt.Errorf("%w: string is not valid UTF-8", errInvalidPickle)
+	}
+	u.push(string(b))
+	return nil
+}
+
+// pushLong pushes the next n bytes as a little-endian two's complement
+// integer. Only integers that fit in 64 bits are supported.
+func (u *unpickler) pushLong(n uint64) error {
+	b, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	if n > 8 { //nolint:gomnd
+		return fmt.Errorf("%w: integer too large", errInvalidPickle)
+	}
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	if n > 0 && n < 8 && b[n-1]&0x80 != 0 {
+		// Sign extend negative numbers.
+		v |= math.MaxUint64 << (8 * n)
+	}
+	u.push(int64(v))
+	return nil
+}
+
+func (u *unpickler) put(idx uint64) error {
+	if len(u.stack) == 0 {
+		return fmt.Errorf("%w: stack underflow", errInvalidPickle)
+	}
+	u.memo[idx] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) get(idx uint64) error {
+	v, ok := u.memo[idx]
+	if !ok {
+		return fmt.Errorf("%w: memo key %d not found", errInvalidPickle, idx)
+	}
+	u.push(v)
+	return nil
+}
+
+// unquotePickleString decodes the Python string literal used by the protocol 0
+// STRING opcode.
+func unquotePickleString(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] { //nolint:gomnd
+		return "", fmt.Errorf("%w: invalid STRING %q", errInvalidPickle, s)
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("%w: invalid escape in STRING", errInvalidPickle)
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("%w: invalid escape in STRING", errInvalidPickle)
+			}
+			sb.WriteByte(byte(b))
+			i += 2
+		default:
+			// Covers \\, \' and \".
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+// decodeRawUnicodeEscape decodes the raw-unicode-escape encoding used by the
+// protocol 0 UNICODE opcode, where only \uXXXX and \UXXXXXXXX are escapes.
+func decodeRawUnicodeEscape(s string) string {
+	if !strings.Contains(s, `\u`) && !strings.Contains(s, `\U`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') {
+			n := 4
+			if s[i+1] == 'U' {
+				n = 8
+			}
+			if i+2+n <= len(s) {
+				if r, err := strconv.ParseUint(s[i+2:i+2+n], 16, 32); err == nil {
+					sb.WriteRune(rune(r))
+					i += 1 + n
+					continue
+				}
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,168 @@
+package writeproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test pickles were generated with Python's pickle.dumps.
+
+func TestDecodeCarbonPickle_Protocols(t *testing.T) {
+	// [("some.test.metric", (1600000000, 1.5)), ("some.test.metric;foo=bar", (1600000010, 2)), ("some.other.metric", (1600000020.0, -3))]
+	pickles := map[string]string{
+		"protocol 0":          "(lp0\n(Vsome.test.metric\np1\n(I1600000000\nF1.5\ntp2\ntp3\na(Vsome.test.metric;foo=bar\np4\n(I1600000010\nI2\ntp5\ntp6\na(Vsome.other.metric\np7\n(F1600000020.0\nI-3\ntp8\ntp9\na.",
+		"protocol 1":          "]q\x00((X\x10\x00\x00\x00some.test.metricq\x01(J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x18\x00\x00\x00some.test.metric;foo=barq\x04(J\n\x10^_K\x02tq\x05tq\x06(X\x11\x00\x00\x00some.other.metricq\x07(GA\xd7\xd7\x84\x05\x00\x00\x00J\xfd\xff\xff\xfftq\x08tq\x09e.",
+		"protocol 2":          "\x80\x02]q\x00(X\x10\x00\x00\x00some.test.metricq\x01J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x18\x00\x00\x00some.test.metric;foo=barq\x04J\n\x10^_K\x02\x86q\x05\x86q\x06X\x11\x00\x00\x00some.other.metricq\x07GA\xd7\xd7\x84\x05\x00\x00\x00J\xfd\xff\xff\xff\x86q\x08\x86q\x09e.",
+		"protocol 3":          "\x80\x03]q\x00(X\x10\x00\x00\x00some.test.metricq\x01J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x18\x00\x00\x00some.test.metric;foo=barq\x04J\n\x10^_K\x02\x86q\x05\x86q\x06X\x11\x00\x00\x00some.other.metricq\x07GA\xd7\xd7\x84\x05\x00\x00\x00J\xfd\xff\xff\xff\x86q\x08\x86q\x09e.",
+		"protocol 4":          "\x80\x04\x95v\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x10some.test.metric\x94J\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x18some.test.metric;foo=bar\x94J\n\x10^_K\x02\x86\x94\x86\x94\x8c\x11some.other.metric\x94GA\xd7\xd7\x84\x05\x00\x00\x00J\xfd\xff\xff\xff\x86\x94\x86\x94e.",
+		"python 2 protocol 0": "(lp0\n(S'some.test.metric'\np1\n(L1600000000L\nF1.5\ntp2\ntp3\na(S'some.test.metric;foo=bar'\np4\n(L1600000010L\nI2\ntp5\ntp6\na(S'some.other.metric'\np7\n(F1600000020.0\nI-3\ntp8\ntp9\na.",
+	}
+	expected := []*schema.MetricData{
+		{Name: "some.test.metric", Value: 1.5, Time: 1600000000, Interval: carbonInterval},
+		{Name: "some.test.metric", Tags: []string{"foo=bar"}, Value: 2, Time: 1600000010, Interval: carbonInterval},
+		{Name: "some.other.metric", Value: -3, Time: 1600000020, Interval: carbonInterval},
+	}
+
+	for name, pickle := range pickles {
+		t.Run(name, func(t *testing.T) {
+			var emitted []*schema.MetricData
+			err := decodeCarbonPickle(pickleMessages(pickle), time.Now,
+				func(md *schema.MetricData) { emitted = append(emitted, md) },
+				func(reason string, err error) { t.Fatalf("unexpected rejection %s: %v", reason, err) },
+			)
+			require.NoError(t, err)
+			assert.Equal(t, expected, emitted)
+		})
+	}
+}
+
+func TestDecodeCarbonPickle_Values(t *testing.T) {
+	tests := map[string]struct {
+		pickle string
+		exp    []*schema.MetricData
+	}{
+		"long integers": {
+			// [("a.b", (1, 2**40)), ("big.neg", (1, -2**40))]
+			pickle: "\x80\x02]q\x00(X\x03\x00\x00\x00a.bq\x01K\x01\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x02\x86q\x03X\x07\x00\x00\x00big.negq\x04K\x01\x8a\x06\x00\x00\x00\x00\x00\xff\x86q\x05\x86q\x06e.",
+			exp: []*schema.MetricData{
+				{Name: "a.b", Value: 1 << 40, Time: 1, Interval: carbonInterval},
+				{Name: "big.neg", Value: -(1 << 40), Time: 1, Interval: carbonInterval},
+			},
+		},
+		"numbers as strings": {
+			// [("a.b", ("1600000000", "4.5"))]
+			pickle: "\x80\x02]q\x00X\x03\x00\x00\x00a.bq\x01X\n\x00\x00\x001600000000q\x02X\x03\x00\x00\x004.5q\x03\x86q\x04\x86q\x05a.",
+			exp: []*schema.MetricData{
+				{Name: "a.b", Value: 4.5, Time: 1600000000, Interval: carbonInterval},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var emitted []*schema.MetricData
+			err := decodeCarbonPickle(pickleMessages(test.pickle), time.Now,
+				func(md *schema.MetricData) { emitted = append(emitted, md) },
+				func(reason string, err error) { t.Fatalf("unexpected rejection %s: %v", reason, err) },
+			)
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, emitted)
+		})
+	}
+}
+
+func TestDecodeCarbonPickle_Rejected(t *testing.T) {
+	tests := map[string]struct {
+		pickle    string
+		expReason string
+		expErr    error
+	}{
+		"globals are not supported": {
+			// The classic os.system exploit.
+			pickle:    "cos\nsystem\n(S'echo hi'\ntR.",
+			expReason: reasonCantParsePickle,
+			expErr:    errUnsupportedPickle,
+		},
+		"truncated pickle": {
+			pickle:    "\x80\x02]q\x00(X\x10\x00\x00\x00some",
+			expReason: reasonCantParsePickle,
+			expErr:    errInvalidPickle,
+		},
+		"not a list": {
+			pickle:    "\x80\x02K\x01.",
+			expReason: reasonCantParsePickle,
+			expErr:    errInvalidPickle,
+		},
+		"datapoint without value": {
+			// [("a.b", (1,))]
+			pickle:    "\x80\x02]X\x03\x00\x00\x00a.bK\x01\x85\x86a.",
+			expReason: reasonCantParseLine,
+			expErr:    errInvalidPickle,
+		},
+		"value is not a number": {
+			// [("a.b", (1, "x"))]
+			pickle:    "\x80\x02]X\x03\x00\x00\x00a.bK\x01X\x01\x00\x00\x00x\x86\x86a.",
+			expReason: reasonCantParseLine,
+			expErr:    errInvalidPickle,
+		},
+		"get of missing memo key": {
+			pickle:    "\x80\x02]h\x05a.",
+			expReason: reasonCantParsePickle,
+			expErr:    errInvalidPickle,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var reasons []string
+			err := decodeCarbonPickle(pickleMessages(test.pickle), time.Now,
+				func(*schema.MetricData) { t.Fatal("no metric expected") },
+				func(reason string, err error) {
+					reasons = append(reasons, reason)
+					assert.ErrorIs(t, err, test.expErr)
+				},
+			)
+			require.NoError(t, err)
+			assert.Equal(t, []string{test.expReason}, reasons)
+		})
+	}
+}
+
+func TestDecodeCarbonPickle_MessageTooLarge(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxPickleMessageSize+1)
+	err := decodeCarbonPickle(bytes.NewReader(header[:]), time.Now,
+		func(*schema.MetricData) { t.Fatal("no metric expected") },
+		func(string, error) { t.Fatal("no rejection expected") },
+	)
+	assert.ErrorIs(t, err, errPickleTooLarge)
+}
+
+func TestDecodeCarbonPickle_MultipleMessages(t *testing.T) {
+	// [("a.b", ("1600000000", "4.5"))] twice, with a broken message in between.
+	pickle := "\x80\x02]q\x00X\x03\x00\x00\x00a.bq\x01X\n\x00\x00\x001600000000q\x02X\x03\x00\x00\x004.5q\x03\x86q\x04\x86q\x05a."
+	var emitted, rejected int
+	err := decodeCarbonPickle(pickleMessages(pickle, "garbage", pickle), time.Now,
+		func(*schema.MetricData) { emitted++ },
+		func(string, error) { rejected++ },
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 2, emitted)
+	assert.Equal(t, 1, rejected)
+}
+
+// pickleMessages frames the given pickles as carbon's pickle receiver expects.
+func pickleMessages(pickles ...string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	for _, p := range pickles {
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(p)))
+		buf.WriteString(p)
+	}
+	return buf
+}
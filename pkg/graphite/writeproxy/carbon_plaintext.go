@@ -0,0 +1,137 @@
+package writeproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+const (
+	// maxCarbonLineLength is the longest plaintext line accepted, longer lines
+	// fail the whole stream as there is no way to resynchronise on them.
+	maxCarbonLineLength = 64 * 1024
+
+	// carbonInterval is the interval set on metrics received through the
+	// carbon protocols. Carbon lines don't carry one, but schema.MetricData
+	// requires it to be set.
+	carbonInterval = 1
+
+	// reasonCantParseLine is the rejected samples reason for lines that can't
+	// be parsed.
+	reasonCantParseLine = "cant_parse_line"
+)
+
+var errInvalidCarbonLine = errors.New("invalid carbon line")
+
+// decodeCarbonPlaintext reads carbon plaintext lines from r until EOF. Every
+// line that is parsed successfully is passed to emit, lines that can't be
+// parsed are passed to reject and skipped.
+func decodeCarbonPlaintext(r io.Reader, now func() time.Time, emit func(*schema.MetricData), reject func(reason string, err error)) error {
+	scanner := newCarbonScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		md, err := parseCarbonLine(line, now)
+		if err != nil {
+			reject(reasonCantParseLine, fmt.Errorf("%w: %q", err, line))
+			continue
+		}
+		emit(md)
+	}
+	return scanner.Err()
+}
+
+// newCarbonScanner returns a scanner of the carbon plaintext lines of r, which
+// fails on lines longer than maxCarbonLineLength.
+func newCarbonScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxCarbonLineLength) //nolint:gomnd
+	return scanner
+}
+
+// parseCarbonLine parses a line of the carbon plaintext protocol:
+//
+//	<metric path> <value> <timestamp>
+//
+// The metric path may be a Graphite 1.1 tagged name, and a timestamp of -1
+// means the current time, as in carbon.
+func parseCarbonLine(line string, now func() time.Time) (*schema.MetricData, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 { //nolint:gomnd
+		return nil, fmt.Errorf("%w: expected 3 fields, got %d", errInvalidCarbonLine, len(fields))
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid value %q", errInvalidCarbonLine, fields[1])
+	}
+
+	ts, err := parseCarbonTimestamp(fields[2], now)
+	if err != nil {
+		return nil, err
+	}
+
+	return carbonMetricData(fields[0], value, ts)
+}
+
+// carbonMetricData creates the MetricData for a carbon datapoint, splitting
+// tagged paths into the name and tags.
+func carbonMetricData(path string, value float64, ts int64) (*schema.MetricData, error) {
+	name, tags, err := parseCarbonName(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema.MetricData{
+		Name:     name,
+		Tags:     tags,
+		Value:    value,
+		Time:     ts,
+		Interval: carbonInterval,
+	}, nil
+}
+
+// parseCarbonName splits a Graphite 1.1 tagged name, "name;tag1=value1;tag2=value2",
+// into the name and its tags. Untagged names are returned unchanged with no
+// tags.
+func parseCarbonName(s string) (string, []string, error) {
+	name, rest, tagged := strings.Cut(s, ";")
+	if name == "" {
+		return "", nil, fmt.Errorf("%w: empty metric name", errInvalidCarbonLine)
+	}
+	if !tagged {
+		return name, nil, nil
+	}
+
+	tags := strings.Split(rest, ";")
+	for _, tag := range tags {
+		if equalIdx := strings.Index(tag, "="); equalIdx <= 0 || equalIdx == len(tag)-1 {
+			return "", nil, fmt.Errorf("%w: invalid tag %q", errInvalidCarbonLine, tag)
+		}
+	}
+	return name, tags, nil
+}
+
+func parseCarbonTimestamp(s string, now func() time.Time) (int64, error) {
+	if s == "-1" {
+		return now().Unix(), nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	// Carbon also accepts fractional timestamps, which are truncated.
+	ts, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, fmt.Errorf("%w: invalid timestamp %q", errInvalidCarbonLine, s)
+	}
+	return int64(ts), nil
+}
@@ -0,0 +1,126 @@
+package writeproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCarbonLine(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	timeNow := func() time.Time { return now }
+
+	tests := map[string]struct {
+		line   string
+		exp    *schema.MetricData
+		expErr bool
+	}{
+		"untagged metric": {
+			line: "some.test.metric 1.5 1600000000",
+			exp:  &schema.MetricData{Name: "some.test.metric", Value: 1.5, Time: 1600000000, Interval: carbonInterval},
+		},
+		"tagged metric": {
+			line: "some.test.metric;tag=value;foo=bar 1 1600000000",
+			exp: &schema.MetricData{
+				Name:     "some.test.metric",
+				Tags:     []string{"tag=value", "foo=bar"},
+				Value:    1,
+				Time:     1600000000,
+				Interval: carbonInterval,
+			},
+		},
+		"tabs and repeated spaces separate fields": {
+			line: "some.test.metric\t 2  1600000000",
+			exp:  &schema.MetricData{Name: "some.test.metric", Value: 2, Time: 1600000000, Interval: carbonInterval},
+		},
+		"fractional timestamps are truncated": {
+			line: "some.test.metric 2 1600000000.75",
+			exp:  &schema.MetricData{Name: "some.test.metric", Value: 2, Time: 1600000000, Interval: carbonInterval},
+		},
+		"-1 timestamp means now": {
+			line: "some.test.metric 2 -1",
+			exp:  &schema.MetricData{Name: "some.test.metric", Value: 2, Time: now.Unix(), Interval: carbonInterval},
+		},
+		"missing timestamp": {
+			line:   "some.test.metric 2",
+			expErr: true,
+		},
+		"too many fields": {
+			line:   "some.test.metric 2 1600000000 extra",
+			expErr: true,
+		},
+		"invalid value": {
+			line:   "some.test.metric two 1600000000",
+			expErr: true,
+		},
+		"invalid timestamp": {
+			line:   "some.test.metric 2 yesterday",
+			expErr: true,
+		},
+		"empty name with tags": {
+			line:   ";tag=value 2 1600000000",
+			expErr: true,
+		},
+		"tag without value": {
+			line:   "some.test.metric;tag= 2 1600000000",
+			expErr: true,
+		},
+		"tag without equal sign": {
+			line:   "some.test.metric;tag 2 1600000000",
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			md, err := parseCarbonLine(test.line, timeNow)
+			if test.expErr {
+				assert.ErrorIs(t, err, errInvalidCarbonLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, md)
+		})
+	}
+}
+
+func TestDecodeCarbonPlaintext(t *testing.T) {
+	input := strings.Join([]string{
+		"some.test.metric 1 1600000000",
+		"",
+		"not a valid line at all",
+		"  some.other.metric;foo=bar 2 1600000010  ",
+	}, "\n")
+
+	var emitted []*schema.MetricData
+	var rejected []error
+	err := decodeCarbonPlaintext(strings.NewReader(input), time.Now,
+		func(md *schema.MetricData) { emitted = append(emitted, md) },
+		func(reason string, err error) {
+			assert.Equal(t, reasonCantParseLine, reason)
+			rejected = append(rejected, err)
+		},
+	)
+	require.NoError(t, err)
+
+	require.Len(t, emitted, 2)
+	assert.Equal(t, "some.test.metric", emitted[0].Name)
+	assert.Equal(t, "some.other.metric", emitted[1].Name)
+	assert.Equal(t, []string{"foo=bar"}, emitted[1].Tags)
+	require.Len(t, rejected, 1)
+	assert.ErrorIs(t, rejected[0], errInvalidCarbonLine)
+	assert.ErrorContains(t, rejected[0], "not a valid line at all")
+}
+
+func TestDecodeCarbonPlaintext_LineTooLong(t *testing.T) {
+	input := strings.Repeat("a", maxCarbonLineLength+1) + " 1 1600000000\n"
+	err := decodeCarbonPlaintext(strings.NewReader(input), time.Now,
+		func(*schema.MetricData) { t.Fatal("no metric expected") },
+		func(string, error) { t.Fatal("no rejection expected") },
+	)
+	assert.Error(t, err)
+}
@@ -2,16 +2,80 @@ package writeproxy
 
 import (
 	"flag"
+	"strings"
 
 	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite"
 )
 
 type Config struct {
 	RemoteWriteConfig remotewrite.Config `yaml:"remote_write"`
+	Carbon            CarbonConfig       `yaml:"carbon"`
+
+	// AdditionalRemoteWrites are other destinations the writes are sent to,
+	// along with RemoteWriteConfig. RemoteWritePolicy chooses which of them
+	// must succeed for the writes to be acknowledged. They can only be set in
+	// the config file.
+	AdditionalRemoteWrites []remotewrite.DestinationConfig `yaml:"additional_remote_writes"`
+	RemoteWritePolicy      string                          `yaml:"remote_write_policy"`
+
+	// MaxSeriesPerRequest splits the series of a large write request into
+	// several upstream requests of at most this many series each.
+	MaxSeriesPerRequest int `yaml:"max_series_per_request"`
+
+	// MaxDecompressedBodySize is the maximum size of the request bodies once
+	// decompressed, protecting from small compressed bodies expanding without
+	// limit.
+	MaxDecompressedBodySize int64 `yaml:"max_decompressed_body_size"`
+
+	// AllowPartialWrites writes the valid samples of a request and drops the
+	// invalid ones, instead of rejecting the whole request.
+	AllowPartialWrites   bool `yaml:"allow_partial_writes"`
+	MaxRejectionExamples int  `yaml:"max_rejection_examples"`
+
+	// NameMappings are evaluated in order to name the series of the matching
+	// Graphite paths, which are otherwise stored as graphite_untagged or
+	// graphite_tagged series. They can only be set in the config file.
+	NameMappings []NameMappingRule `yaml:"name_mappings"`
+
+	// Filters drop or rewrite the incoming Graphite paths before they're
+	// converted. They can only be set in the config file.
+	Filters FilterConfig `yaml:"filters"`
+
+	// TenantRoutes are evaluated in order to write the matching metrics to
+	// another tenant than the one of the request, splitting the batches per
+	// tenant. They can only be set in the config file.
+	TenantRoutes []TenantRoute `yaml:"tenant_routes"`
+
+	Aggregation AggregationConfig `yaml:"aggregation"`
+
+	// DedupPolicy removes the samples with the same series and timestamp as
+	// another sample of the batch, which Mimir would reject as duplicates,
+	// keeping either the first or the last of them.
+	DedupPolicy string `yaml:"dedup_policy"`
+
+	SendMetadata  bool `yaml:"send_metadata"`
+	IntervalLabel bool `yaml:"interval_label"`
+
+	Limits LimitsConfig `yaml:"limits"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 	c.RemoteWriteConfig.RegisterFlagsWithPrefix(prefix, f)
+	c.Carbon.RegisterFlagsWithPrefix(prefix, f)
+	c.Limits.RegisterFlagsWithPrefix(prefix, f)
+	c.Aggregation.RegisterFlagsWithPrefix(prefix, f)
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	f.StringVar(&c.RemoteWritePolicy, prefix+"remote-write-policy", remotewrite.FanOutPolicyAll, "Destinations that must succeed for the writes to be acknowledged when additional remote writes are configured: all, any, or primary for the main remote write only.")
+	f.IntVar(&c.MaxSeriesPerRequest, prefix+"max-series-per-request", 0, "Maximum number of series sent upstream in a single write request, larger requests are decoded and written in several batches. 0 to disable.")
+	f.Int64Var(&c.MaxDecompressedBodySize, prefix+"max-decompressed-body-size", defaultMaxDecompressedBodySize, "Maximum size in bytes of the request bodies once decompressed, larger bodies are rejected with a 413. 0 to disable.")
+	f.BoolVar(&c.AllowPartialWrites, prefix+"allow-partial-writes", false, "If set to true, invalid samples are dropped and the valid samples of the request are still written. Otherwise the whole request is rejected.")
+	f.IntVar(&c.MaxRejectionExamples, prefix+"max-rejection-examples", defaultMaxRejectionExamples, "Maximum number of rejected samples listed for each rejection reason in the response of partial writes.")
+	f.StringVar(&c.DedupPolicy, prefix+"dedup-policy", DedupPolicyNone, "Deduplication of the samples with the same series and timestamp in a request or a carbon batch: none, first to keep the first of them, or last to keep the last of them. Samples already written by an earlier sub-batch of the request are always kept over their duplicates.")
+	f.BoolVar(&c.SendMetadata, prefix+"send-metadata", false, "If set to true, the metric type and unit of the metrics named by the name mappings are sent upstream as Prometheus metadata.")
+	f.BoolVar(&c.IntervalLabel, prefix+"interval-label", false, "If set to true, the interval of the metrics is added to their series as the \"interval\" label.")
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -0,0 +1,184 @@
+package writeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+const (
+	contentEncodingIdentity = "identity"
+	contentEncodingGzip     = "gzip"
+	contentEncodingZstd     = "zstd"
+	contentEncodingSnappy   = "snappy"
+)
+
+// snappyStreamMagic is the start of the snappy framing format stream
+// identifier chunk.
+var snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// bodyTooLargeError is returned when the decompressed request body exceeds
+// the limit.
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e bodyTooLargeError) Error() string {
+	return fmt.Sprintf("decompressed body exceeds the limit of %d bytes", e.limit)
+}
+
+// bodyReadError is returned when the request body couldn't be read, as
+// opposed to being invalid.
+type bodyReadError struct {
+	err error
+}
+
+func (e bodyReadError) Error() string {
+	return fmt.Sprintf("failed to read request body: %s", e.err)
+}
+
+func (e bodyReadError) Unwrap() error {
+	return e.err
+}
+
+// bodyReader keeps the first error reading the request body, which the
+// decoders don't all return as is.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// decodeContentEncoding wraps body so that reading from it returns the
+// decompressed content, according to the Content-Encoding header value.
+// Unsupported encodings are returned as errorx.UnsupportedMediaType.
+//
+// If maxSize is positive, reading more than maxSize decompressed bytes fails
+// with a bodyTooLargeError, so that a small compressed body can't expand
+// without limit.
+func decodeContentEncoding(contentEncoding string, body io.Reader, maxSize int64) (*limitedBody, error) {
+	decoded, err := decodeContent(contentEncoding, body, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedBody{ReadCloser: decoded, remaining: maxSize, limit: maxSize}, nil
+}
+
+func decodeContent(contentEncoding string, body io.Reader, maxSize int64) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", contentEncodingIdentity:
+		return io.NopCloser(body), nil
+	case contentEncodingGzip:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		return gz, nil
+	case contentEncodingZstd:
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxSize > 0 {
+			// Also bounds the window the decoder allocates, which is at least
+			// zstd.MinWindowSize even for the smallest frames.
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(max(maxSize, zstd.MinWindowSize))))
+		}
+		dec, err := zstd.NewReader(body, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		return dec.IOReadCloser(), nil
+	case contentEncodingSnappy:
+		return snappyReader(body, maxSize)
+	default:
+		return nil, errorx.UnsupportedMediaType{Msg: fmt.Sprintf("unsupported content-encoding %q", contentEncoding)}
+	}
+}
+
+// snappyReader supports both the snappy framing format and the block format
+// used by Prometheus remote write, telling them apart by the stream
+// identifier the framing format starts with.
+//
+// The framing format is streamed, while a block has to be decoded at once. Its
+// decoded length is checked against maxSize before the block is read.
+func snappyReader(body io.Reader, maxSize int64) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	if header, _ := br.Peek(len(snappyStreamMagic)); bytes.Equal(header, snappyStreamMagic) {
+		return io.NopCloser(snappy.NewReader(br)), nil
+	}
+
+	header, _ := br.Peek(binary.MaxVarintLen32)
+	decodedLen, err := snappy.DecodedLen(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+	if maxSize > 0 && int64(decodedLen) > maxSize {
+		return nil, bodyTooLargeError{limit: maxSize}
+	}
+
+	// A valid block is never larger than the maximum encoded length of its
+	// content.
+	compressed, err := io.ReadAll(io.LimitReader(br, int64(snappy.MaxEncodedLen(decodedLen))+1))
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := snappy.Decode(make([]byte, decodedLen), compressed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+	return io.NopCloser(bytes.NewReader(decoded)), nil
+}
+
+// limitedBody fails reads going over the limit, unlike io.LimitReader which
+// would silently truncate the body.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return b.ReadCloser.Read(p)
+	}
+	if b.exceeded {
+		return 0, bodyTooLargeError{limit: b.limit}
+	}
+
+	// Read one more byte than remaining to tell a body of exactly the limit
+	// from a larger one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		// The zstd decoder rejects the frames declaring a larger size up
+		// front.
+		b.exceeded = true
+		return n, bodyTooLargeError{limit: b.limit}
+	}
+	if int64(n) > b.remaining {
+		b.exceeded = true
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, bodyTooLargeError{limit: b.limit}
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,137 @@
+package writeproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+func TestDecodeContentEncoding(t *testing.T) {
+	const content = "some.test.metric 1 1600000000\n"
+
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	_, err := gz.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstded := zstdEncoder.EncodeAll([]byte(content), nil)
+
+	snappyFramed := &bytes.Buffer{}
+	sw := snappy.NewBufferedWriter(snappyFramed)
+	_, err = sw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	tests := map[string]struct {
+		encoding string
+		body     []byte
+	}{
+		"no encoding":      {encoding: "", body: []byte(content)},
+		"identity":         {encoding: "identity", body: []byte(content)},
+		"gzip":             {encoding: "gzip", body: gzipped.Bytes()},
+		"gzip, mixed case": {encoding: " GZip ", body: gzipped.Bytes()},
+		"zstd":             {encoding: "zstd", body: zstded},
+		"snappy block":     {encoding: "snappy", body: snappy.Encode(nil, []byte(content))},
+		"snappy framed":    {encoding: "snappy", body: snappyFramed.Bytes()},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, err := decodeContentEncoding(test.encoding, bytes.NewReader(test.body), int64(len(content)))
+			require.NoError(t, err)
+			defer body.Close()
+
+			decoded, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(decoded))
+		})
+	}
+}
+
+func TestDecodeContentEncoding_Errors(t *testing.T) {
+	t.Run("unsupported encoding", func(t *testing.T) {
+		_, err := decodeContentEncoding("br", strings.NewReader("data"), 0)
+		assert.ErrorAs(t, err, &errorx.UnsupportedMediaType{})
+	})
+
+	t.Run("corrupt gzip", func(t *testing.T) {
+		_, err := decodeContentEncoding("gzip", strings.NewReader("not gzip"), 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("corrupt snappy", func(t *testing.T) {
+		_, err := decodeContentEncoding("snappy", strings.NewReader("\xff\xff\xff\xff"), 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestDecodeContentEncoding_MaxSize(t *testing.T) {
+	const maxSize = 1024
+	// Compresses to a few bytes.
+	content := bytes.Repeat([]byte("0"), 1<<20)
+
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	_, err := gz.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	snappyFramed := &bytes.Buffer{}
+	sw := snappy.NewBufferedWriter(snappyFramed)
+	_, err = sw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	tests := map[string]struct {
+		encoding string
+		body     []byte
+	}{
+		"no encoding":   {encoding: "", body: content},
+		"gzip":          {encoding: "gzip", body: gzipped.Bytes()},
+		"zstd":          {encoding: "zstd", body: zstdEncoder.EncodeAll(content, nil)},
+		"snappy framed": {encoding: "snappy", body: snappyFramed.Bytes()},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, err := decodeContentEncoding(test.encoding, bytes.NewReader(test.body), maxSize)
+			require.NoError(t, err)
+			defer body.Close()
+
+			decoded, err := io.ReadAll(body)
+			require.ErrorAs(t, err, &bodyTooLargeError{})
+			// The zstd decoder fails before decoding frames declaring a
+			// larger size.
+			assert.LessOrEqual(t, len(decoded), maxSize)
+		})
+	}
+
+	t.Run("snappy block", func(t *testing.T) {
+		// The decoded length is checked before reading the block.
+		_, err := decodeContentEncoding("snappy", bytes.NewReader(snappy.Encode(nil, content)), maxSize)
+		require.ErrorAs(t, err, &bodyTooLargeError{})
+	})
+
+	t.Run("snappy block within the limit", func(t *testing.T) {
+		body, err := decodeContentEncoding("snappy", bytes.NewReader(snappy.Encode(nil, content[:maxSize])), maxSize)
+		require.NoError(t, err)
+		decoded, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, content[:maxSize], decoded)
+	})
+}
@@ -0,0 +1,97 @@
+package writeproxy
+
+import (
+	"fmt"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+const (
+	// DedupPolicyNone writes every sample, even those with the same series
+	// and timestamp as another sample of the batch.
+	DedupPolicyNone = "none"
+	// DedupPolicyFirst keeps the first of the samples with the same series
+	// and timestamp in a batch.
+	DedupPolicyFirst = "first"
+	// DedupPolicyLast keeps the last of the samples with the same series and
+	// timestamp in a batch.
+	DedupPolicyLast = "last"
+)
+
+func validateDedupPolicy(policy string) error {
+	switch policy {
+	case "", DedupPolicyNone, DedupPolicyFirst, DedupPolicyLast:
+		return nil
+	default:
+		return fmt.Errorf("invalid dedup policy %q, must be %q, %q or %q", policy, DedupPolicyNone, DedupPolicyFirst, DedupPolicyLast)
+	}
+}
+
+type dedupKey struct {
+	hash      uint64
+	timestamp int64
+}
+
+// dedupSeries removes the series with the same labels and timestamp as
+// another series of the batch, keeping the first or the last of them
+// according to the policy, at the position of the first. The series, which
+// have a single sample each, are deduplicated in place and the removed ones
+// are returned to the pool. It returns the remaining series and the number of
+// removed ones.
+//
+// If written isn't nil, it holds the keys of the series already written by
+// the earlier batches of the request. Those can't be replaced anymore, so
+// their duplicates are removed whatever the policy, and the keys of the
+// remaining series are added to it. Only the hashes of the labels are kept,
+// to bound the memory of large requests.
+func dedupSeries(series []mimirpb.PreallocTimeseries, policy string, written map[dedupKey]struct{}) ([]mimirpb.PreallocTimeseries, int) {
+	if policy != DedupPolicyFirst && policy != DedupPolicyLast {
+		return series, 0
+	}
+
+	var (
+		kept    = series[:0]
+		index   = make(map[dedupKey][]int, len(series))
+		removed int
+	)
+	for _, ts := range series {
+		key := dedupKey{
+			hash:      mimirpb.FromLabelAdaptersToLabels(ts.Labels).Hash(),
+			timestamp: ts.Samples[0].TimestampMs,
+		}
+		dup := -1
+		// Series with colliding hashes are told apart by their labels.
+		for _, i := range index[key] {
+			if mimirpb.CompareLabelAdapters(kept[i].Labels, ts.Labels) == 0 {
+				dup = i
+				break
+			}
+		}
+		if dup < 0 {
+			if _, ok := written[key]; ok {
+				removed++
+				mimirpb.ReusePreallocTimeseries(&ts)
+				continue
+			}
+			index[key] = append(index[key], len(kept))
+			kept = append(kept, ts)
+			continue
+		}
+
+		removed++
+		if policy == DedupPolicyLast {
+			kept[dup], ts = ts, kept[dup]
+		}
+		mimirpb.ReusePreallocTimeseries(&ts)
+	}
+	if written != nil {
+		for key := range index {
+			written[key] = struct{}{}
+		}
+	}
+	// The tail of the slice mustn't keep references to the series.
+	for i := len(kept); i < len(series); i++ {
+		series[i] = mimirpb.PreallocTimeseries{}
+	}
+	return kept, removed
+}
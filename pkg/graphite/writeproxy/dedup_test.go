@@ -0,0 +1,174 @@
+package writeproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+)
+
+func TestDedupSeries(t *testing.T) {
+	// The removed series are returned to the pool, so they must come from it.
+	series := func(name string, value float64, timestamp int64) mimirpb.PreallocTimeseries {
+		ts := mimirpb.TimeseriesFromPool()
+		ts.Labels = []mimirpb.LabelAdapter{{Name: "__name__", Value: name}}
+		ts.Samples = []mimirpb.Sample{{Value: value, TimestampMs: timestamp}}
+		return mimirpb.PreallocTimeseries{TimeSeries: ts}
+	}
+	batch := func() []mimirpb.PreallocTimeseries {
+		return []mimirpb.PreallocTimeseries{
+			series("a", 1, 1000),
+			series("b", 2, 1000),
+			series("a", 3, 1000),
+			series("a", 4, 2000),
+			series("a", 5, 1000),
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		policy     string
+		expValues  []float64
+		expRemoved int
+	}{
+		"none": {
+			policy:    DedupPolicyNone,
+			expValues: []float64{1, 2, 3, 4, 5},
+		},
+		"first": {
+			policy:     DedupPolicyFirst,
+			expValues:  []float64{1, 2, 4},
+			expRemoved: 2,
+		},
+		"last": {
+			policy:     DedupPolicyLast,
+			expValues:  []float64{5, 2, 4},
+			expRemoved: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			deduped, removed := dedupSeries(batch(), tc.policy, nil)
+			assert.Equal(t, tc.expRemoved, removed)
+
+			var values []float64
+			for _, ts := range deduped {
+				values = append(values, ts.Samples[0].Value)
+			}
+			assert.Equal(t, tc.expValues, values)
+		})
+	}
+}
+
+func TestDedupSeries_Written(t *testing.T) {
+	series := func(name string, value float64) mimirpb.PreallocTimeseries {
+		ts := mimirpb.TimeseriesFromPool()
+		ts.Labels = []mimirpb.LabelAdapter{{Name: "__name__", Value: name}}
+		ts.Samples = []mimirpb.Sample{{Value: value, TimestampMs: 1000}}
+		return mimirpb.PreallocTimeseries{TimeSeries: ts}
+	}
+
+	written := map[dedupKey]struct{}{}
+	deduped, removed := dedupSeries([]mimirpb.PreallocTimeseries{series("a", 1), series("b", 2)}, DedupPolicyLast, written)
+	assert.Len(t, deduped, 2)
+	assert.Equal(t, 0, removed)
+	assert.Len(t, written, 2)
+
+	// The series already written can't be replaced anymore.
+	deduped, removed = dedupSeries([]mimirpb.PreallocTimeseries{series("a", 3), series("c", 4), series("c", 5)}, DedupPolicyLast, written)
+	require.Len(t, deduped, 1)
+	assert.Equal(t, float64(5), deduped[0].Samples[0].Value)
+	assert.Equal(t, 2, removed)
+	assert.Len(t, written, 3)
+}
+
+func TestRemoteWriteMetricsHandler_Dedup(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{Name: "servers.www01.cpu", Interval: 1, Value: 1, Time: 1600000000},
+		{Name: "servers.www01.cpu", Interval: 1, Value: 2, Time: 1600000000},
+		{Name: "servers.www01.cpu", Interval: 1, Value: 3, Time: 1600000001},
+		{Name: "servers.www01.cpu", Interval: 1, Value: 4, Time: 1600000000},
+	}
+	body, err := json.Marshal(metrics)
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		policy     string
+		maxSeries  int
+		expDeduped []int
+		expSamples []mimirpb.Sample
+	}{
+		"last": {
+			policy:     DedupPolicyLast,
+			expDeduped: []int{2},
+			expSamples: []mimirpb.Sample{
+				{Value: 4, TimestampMs: 1600000000000},
+				{Value: 3, TimestampMs: 1600000001000},
+			},
+		},
+		"first across sub-batches": {
+			policy:     DedupPolicyFirst,
+			maxSeries:  2,
+			expDeduped: []int{1, 1},
+			expSamples: []mimirpb.Sample{
+				{Value: 1, TimestampMs: 1600000000000},
+				{Value: 3, TimestampMs: 1600000001000},
+			},
+		},
+		"last across sub-batches keeps the written sample": {
+			policy:     DedupPolicyLast,
+			maxSeries:  2,
+			expDeduped: []int{1, 1},
+			expSamples: []mimirpb.Sample{
+				{Value: 2, TimestampMs: 1600000000000},
+				{Value: 3, TimestampMs: 1600000001000},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorderMock := &MockRecorder{}
+			recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+			recorderMock.On("measureIncomingSamples", "fake", 4).Return(nil)
+			recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+			recorderMock.On("measureReceivedSamples", "fake", 2).Return(nil)
+			for _, deduped := range tc.expDeduped {
+				recorderMock.On("measureDedupedSamples", "fake", deduped).Once().Return(nil)
+			}
+			defer recorderMock.AssertExpectations(t)
+
+			var samples []mimirpb.Sample
+			remoteWriteMock := &remotewritemock.Client{}
+			remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				for _, ts := range args.Get(1).(*mimirpb.WriteRequest).Timeseries {
+					samples = append(samples, ts.Samples...)
+				}
+			}).Return(nil)
+
+			handler, err := NewRemoteWriteProxy(Config{DedupPolicy: tc.policy, MaxSeriesPerRequest: tc.maxSeries}, remoteWriteMock, recorderMock, nil, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+			require.JSONEq(t, `{"published":2}`, recorder.Body.String())
+			assert.Equal(t, tc.expSamples, samples)
+		})
+	}
+}
+
+func TestNewRemoteWriteProxy_InvalidDedupPolicy(t *testing.T) {
+	_, err := NewRemoteWriteProxy(Config{DedupPolicy: "newest"}, &remotewritemock.Client{}, &MockRecorder{}, nil, nil)
+	require.Error(t, err)
+}
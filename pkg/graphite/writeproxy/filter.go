@@ -0,0 +1,133 @@
+package writeproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// reasonFiltered is the rejected samples reason of the samples dropped by the
+// allow and deny rules.
+const reasonFiltered = "filtered"
+
+// FilterConfig configures the filtering and rewriting of the incoming Graphite
+// paths, like the blacklist.conf, whitelist.conf and rewrite-rules.conf of
+// carbon. The rules can only be set in the config file.
+//
+// Rewrites are applied first, in order, then the tags are dropped, then the
+// rewritten paths are matched against the allow and deny rules. The regular
+// expressions match any part of the path, like carbon, unless anchored.
+type FilterConfig struct {
+	// Allow, if not empty, drops the paths matching none of its rules.
+	Allow []string `yaml:"allow"`
+	// Deny drops the paths matching any of its rules.
+	Deny []string `yaml:"deny"`
+	// Rewrites replace the matches of their regular expression in the paths.
+	Rewrites []RewriteRule `yaml:"rewrites"`
+	// DropTags are the names of the tags removed from the tagged metrics.
+	DropTags []string `yaml:"drop_tags"`
+}
+
+// Enabled returns whether any rule is configured.
+func (c FilterConfig) Enabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0 || len(c.Rewrites) > 0 || len(c.DropTags) > 0
+}
+
+// RewriteRule replaces the matches of a regular expression in the paths. The
+// replacement can refer to the captured groups as $1, ${1}, or by name.
+type RewriteRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+type rewriteRule struct {
+	regex   *regexp.Regexp
+	replace string
+}
+
+// Filter applies the rules of a FilterConfig to the incoming metrics.
+type Filter struct {
+	allow    []*regexp.Regexp
+	deny     []*regexp.Regexp
+	rewrites []rewriteRule
+	dropTags map[string]struct{}
+}
+
+// NewFilter validates and compiles the rules of the given config.
+func NewFilter(cfg FilterConfig) (*Filter, error) {
+	f := &Filter{dropTags: map[string]struct{}{}}
+	var err error
+	if f.allow, err = compileFilterRules("allow", cfg.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = compileFilterRules("deny", cfg.Deny); err != nil {
+		return nil, err
+	}
+	for i, rule := range cfg.Rewrites {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("invalid rewrite rule %d: match can't be empty", i)
+		}
+		regex, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %d (%q): %w", i, rule.Match, err)
+		}
+		f.rewrites = append(f.rewrites, rewriteRule{regex: regex, replace: rule.Replace})
+	}
+	for _, name := range cfg.DropTags {
+		if name == "" || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("invalid tag name %q to drop", name)
+		}
+		f.dropTags[name] = struct{}{}
+	}
+	return f, nil
+}
+
+func compileFilterRules(kind string, rules []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(rules))
+	for i, rule := range rules {
+		regex, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rule %d (%q): %w", kind, i, rule, err)
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+// apply rewrites md in place, and returns whether it's kept. A nil Filter
+// keeps all the metrics unchanged.
+func (f *Filter) apply(md *schema.MetricData) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, rule := range f.rewrites {
+		md.Name = rule.regex.ReplaceAllString(md.Name, rule.replace)
+	}
+	if len(f.dropTags) > 0 && len(md.Tags) > 0 {
+		tags := md.Tags[:0]
+		for _, tag := range md.Tags {
+			name, _, _ := strings.Cut(tag, "=")
+			if _, ok := f.dropTags[name]; !ok {
+				tags = append(tags, tag)
+			}
+		}
+		md.Tags = tags
+	}
+
+	if len(f.allow) > 0 && !matchesAny(f.allow, md.Name) {
+		return false
+	}
+	return !matchesAny(f.deny, md.Name)
+}
+
+func matchesAny(regexes []*regexp.Regexp, name string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
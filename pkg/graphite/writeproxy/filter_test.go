@@ -0,0 +1,159 @@
+package writeproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+)
+
+func TestFilter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg     FilterConfig
+		md      *schema.MetricData
+		expKeep bool
+		expName string
+		expTags []string
+	}{
+		"no rules": {
+			md:      &schema.MetricData{Name: "servers.www01.cpu"},
+			expKeep: true,
+			expName: "servers.www01.cpu",
+		},
+		"denied": {
+			cfg: FilterConfig{Deny: []string{`^servers\.localhost\.`}},
+			md:  &schema.MetricData{Name: "servers.localhost.cpu"},
+		},
+		"not denied": {
+			cfg:     FilterConfig{Deny: []string{`^servers\.localhost\.`}},
+			md:      &schema.MetricData{Name: "servers.www01.cpu"},
+			expKeep: true,
+			expName: "servers.www01.cpu",
+		},
+		"allowed": {
+			cfg:     FilterConfig{Allow: []string{`^servers\.`, `^apps\.`}},
+			md:      &schema.MetricData{Name: "apps.api.requests"},
+			expKeep: true,
+			expName: "apps.api.requests",
+		},
+		"not allowed": {
+			cfg: FilterConfig{Allow: []string{`^servers\.`, `^apps\.`}},
+			md:  &schema.MetricData{Name: "junk.metric"},
+		},
+		"allowed but denied": {
+			cfg: FilterConfig{Allow: []string{`^servers\.`}, Deny: []string{`\.tmp$`}},
+			md:  &schema.MetricData{Name: "servers.www01.tmp"},
+		},
+		"rules match any part of the path": {
+			cfg: FilterConfig{Deny: []string{`localhost`}},
+			md:  &schema.MetricData{Name: "servers.localhost.cpu"},
+		},
+		"rewrites are applied in order": {
+			cfg: FilterConfig{Rewrites: []RewriteRule{
+				{Match: `^collectd\.([^.]+)\.`, Replace: "servers.$1."},
+				{Match: `_`, Replace: "."},
+			}},
+			md:      &schema.MetricData{Name: "collectd.www01.cpu_user"},
+			expKeep: true,
+			expName: "servers.www01.cpu.user",
+		},
+		"rewrites are applied before filtering": {
+			cfg: FilterConfig{
+				Rewrites: []RewriteRule{{Match: `^collectd\.`, Replace: "servers."}},
+				Allow:    []string{`^servers\.`},
+			},
+			md:      &schema.MetricData{Name: "collectd.www01.cpu"},
+			expKeep: true,
+			expName: "servers.www01.cpu",
+		},
+		"tags are dropped": {
+			cfg:     FilterConfig{DropTags: []string{"pod", "instance"}},
+			md:      &schema.MetricData{Name: "requests", Tags: []string{"app=api", "instance=10.0.0.1", "pod=api-1234"}},
+			expKeep: true,
+			expName: "requests",
+			expTags: []string{"app=api"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			filter, err := NewFilter(tc.cfg)
+			require.NoError(t, err)
+
+			keep := filter.apply(tc.md)
+			assert.Equal(t, tc.expKeep, keep)
+			if tc.expKeep {
+				assert.Equal(t, tc.expName, tc.md.Name)
+				if tc.expTags != nil {
+					assert.Equal(t, tc.expTags, tc.md.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestNewFilter_Validation(t *testing.T) {
+	for name, cfg := range map[string]FilterConfig{
+		"invalid allow rule":   {Allow: []string{"("}},
+		"invalid deny rule":    {Deny: []string{"("}},
+		"invalid rewrite rule": {Rewrites: []RewriteRule{{Match: "(", Replace: "x"}}},
+		"empty rewrite rule":   {Rewrites: []RewriteRule{{Replace: "x"}}},
+		"invalid tag name":     {DropTags: []string{"pod=api"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewFilter(cfg)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRemoteWriteMetricsHandler_Filters(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{Name: "collectd.www01.cpu", Interval: 1, Value: 1, Time: 1600000000},
+		{Name: "servers.localhost.cpu", Interval: 1, Value: 2, Time: 1600000000},
+	}
+	body, err := json.Marshal(metrics)
+	require.NoError(t, err)
+
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+	recorderMock.On("measureIncomingSamples", "fake", 2).Return(nil)
+	recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+	recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+	recorderMock.On("measureReceivedSamples", "fake", 1).Return(nil)
+	recorderMock.On("measureRejectedSamples", "fake", reasonFiltered).Once().Return(nil)
+	defer recorderMock.AssertExpectations(t)
+
+	var written []string
+	remoteWriteMock := &remotewritemock.Client{}
+	remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		for _, ts := range args.Get(1).(*mimirpb.WriteRequest).Timeseries {
+			written = append(written, graphiteName(ts.Labels))
+		}
+	}).Return(nil)
+
+	cfg := Config{Filters: FilterConfig{
+		Rewrites: []RewriteRule{{Match: `^collectd\.`, Replace: "servers."}},
+		Deny:     []string{`^servers\.localhost\.`},
+	}}
+	handler, err := NewRemoteWriteProxy(cfg, remoteWriteMock, recorderMock, nil, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	// Filtered samples don't fail the request.
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	require.JSONEq(t, `{"published":1}`, recorder.Body.String())
+	assert.Equal(t, []string{"servers.www01.cpu"}, written)
+}
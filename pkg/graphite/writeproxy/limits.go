@@ -0,0 +1,258 @@
+package writeproxy
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/runtimeconfig"
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/metrictank/schema"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	reasonRateLimited    = "rate_limited"
+	reasonNameTooLong    = "name_too_long"
+	reasonTooManyTags    = "too_many_tags"
+	reasonTooManySamples = "too_many_samples"
+
+	defaultOverridesReloadPeriod = 10 * time.Second
+)
+
+// Limits are the write limits of a tenant. Zero values mean unlimited.
+type Limits struct {
+	// IngestionRate is the number of samples per second a tenant can write,
+	// with bursts of up to IngestionBurstSize samples.
+	IngestionRate        float64 `yaml:"ingestion_rate"`
+	IngestionBurstSize   int     `yaml:"ingestion_burst_size"`
+	MaxSamplesPerRequest int     `yaml:"max_samples_per_request"`
+	MaxNameLength        int     `yaml:"max_name_length"`
+	MaxTags              int     `yaml:"max_tags"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it.
+func (l *Limits) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	flags.Float64Var(&l.IngestionRate, prefix+"ingestion-rate", 0, "Per-tenant ingestion rate limit in samples per second. 0 to disable.")
+	flags.IntVar(&l.IngestionBurstSize, prefix+"ingestion-burst-size", 0, "Per-tenant allowed ingestion burst size, in samples. Defaults to the ingestion rate if not set.")
+	flags.IntVar(&l.MaxSamplesPerRequest, prefix+"max-samples-per-request", 0, "Maximum number of samples in a single write request. Doesn't apply to the carbon listeners, whose samples aren't sent in requests. 0 to disable.")
+	flags.IntVar(&l.MaxNameLength, prefix+"max-name-length", 0, "Maximum length of the Graphite name of a sample. 0 to disable.")
+	flags.IntVar(&l.MaxTags, prefix+"max-tags", 0, "Maximum number of tags of a sample. 0 to disable.")
+}
+
+// validate checks md against the per sample limits, returning the rejected
+// samples reason along with the error.
+func (l Limits) validate(md *schema.MetricData) (string, error) {
+	if l.MaxNameLength > 0 && len(md.Name) > l.MaxNameLength {
+		return reasonNameTooLong, fmt.Errorf("name length %d exceeds the limit of %d", len(md.Name), l.MaxNameLength)
+	}
+	if l.MaxTags > 0 && len(md.Tags) > l.MaxTags {
+		return reasonTooManyTags, fmt.Errorf("%d tags exceed the limit of %d", len(md.Tags), l.MaxTags)
+	}
+	return "", nil
+}
+
+// burst returns the ingestion burst size, defaulting to the rate.
+func (l Limits) burst() int {
+	if l.IngestionBurstSize > 0 {
+		return l.IngestionBurstSize
+	}
+	if burst := int(l.IngestionRate); burst > 0 {
+		return burst
+	}
+	return 1
+}
+
+// LimitsConfig configures the default limits of all the tenants, and the file
+// that overrides them for some tenants. The file is reloaded periodically,
+// and looks like:
+//
+//	overrides:
+//	  tenant-a:
+//	    ingestion_rate: 10000
+//
+// The limits not set for a tenant in the file keep their default value.
+type LimitsConfig struct {
+	Limits                `yaml:",inline"`
+	OverridesFile         string        `yaml:"overrides_file"`
+	OverridesReloadPeriod time.Duration `yaml:"overrides_reload_period"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it.
+func (c *LimitsConfig) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	c.Limits.RegisterFlagsWithPrefix(prefix+"limits", flags)
+	flags.StringVar(&c.OverridesFile, prefix+"limits.overrides-file", "", "Path to a YAML file with per-tenant overrides of the limits, reloaded periodically.")
+	flags.DurationVar(&c.OverridesReloadPeriod, prefix+"limits.overrides-reload-period", defaultOverridesReloadPeriod, "How often the limits overrides file is reloaded.")
+}
+
+type overridesConfig struct {
+	Overrides map[string]Limits
+}
+
+// Overrides returns the limits of each tenant.
+type Overrides struct {
+	defaults Limits
+	manager  *runtimeconfig.Manager
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// NewOverrides creates the Overrides for the given config. When an overrides
+// file is configured, it is loaded before returning, so that errors are
+// reported before the app is started.
+func NewOverrides(cfg LimitsConfig, reg prometheus.Registerer, logger log.Logger) (*Overrides, error) {
+	o := &Overrides{
+		defaults: cfg.Limits,
+		quit:     make(chan struct{}),
+	}
+	if cfg.OverridesFile == "" {
+		return o, nil
+	}
+
+	manager, err := runtimeconfig.New(runtimeconfig.Config{
+		ReloadPeriod: cfg.OverridesReloadPeriod,
+		LoadPath:     flagext.StringSliceCSV{cfg.OverridesFile},
+		Loader:       overridesLoader(cfg.Limits),
+	}, "limits_overrides", reg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := services.StartAndAwaitRunning(context.Background(), manager); err != nil {
+		return nil, fmt.Errorf("can't load limits overrides: %w", err)
+	}
+	o.manager = manager
+	return o, nil
+}
+
+// overridesLoader decodes the overrides file, starting every tenant from the
+// default limits.
+func overridesLoader(defaults Limits) runtimeconfig.Loader {
+	return func(r io.Reader) (interface{}, error) {
+		var raw struct {
+			Overrides map[string]yaml.Node `yaml:"overrides"`
+		}
+		dec := yaml.NewDecoder(r)
+		dec.KnownFields(true)
+		if err := dec.Decode(&raw); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		cfg := &overridesConfig{Overrides: make(map[string]Limits, len(raw.Overrides))}
+		for tenant, node := range raw.Overrides {
+			limits, err := decodeTenantLimits(&node, defaults)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limits for tenant %s: %w", tenant, err)
+			}
+			cfg.Overrides[tenant] = limits
+		}
+		return cfg, nil
+	}
+}
+
+// decodeTenantLimits decodes the limits of a tenant over the defaults. Unlike
+// yaml.Node.Decode, unknown fields are rejected, so that typos aren't silently
+// ignored.
+func decodeTenantLimits(node *yaml.Node, defaults Limits) (Limits, error) {
+	raw, err := yaml.Marshal(node)
+	if err != nil {
+		return Limits{}, err
+	}
+	limits := defaults
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&limits); err != nil && err != io.EOF {
+		return Limits{}, err
+	}
+	return limits, nil
+}
+
+// ForTenant returns the limits of the given tenant. A nil Overrides has no
+// limits.
+func (o *Overrides) ForTenant(userID string) Limits {
+	if o == nil {
+		return Limits{}
+	}
+	if o.manager != nil {
+		if cfg, ok := o.manager.GetConfig().(*overridesConfig); ok && cfg != nil {
+			if limits, ok := cfg.Overrides[userID]; ok {
+				return limits
+			}
+		}
+	}
+	return o.defaults
+}
+
+// Handler returns two functions to run the reloading of the overrides file
+// and to stop it.
+func (o *Overrides) Handler() (run func() error, stop func(error)) {
+	run = func() error {
+		if o.manager == nil {
+			<-o.quit
+			return nil
+		}
+		return o.manager.AwaitTerminated(context.Background())
+	}
+	stop = func(error) {
+		o.quitOnce.Do(func() {
+			close(o.quit)
+			if o.manager != nil {
+				o.manager.StopAsync()
+			}
+		})
+	}
+	return run, stop
+}
+
+// tenantRateLimiter keeps the ingestion rate limiter of each tenant.
+type tenantRateLimiter struct {
+	mtx      sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newTenantRateLimiter() *tenantRateLimiter {
+	return &tenantRateLimiter{limiters: map[string]*rate.Limiter{}}
+}
+
+// AllowN reports whether n samples of the tenant can be written at now, given
+// its current limits.
+func (t *tenantRateLimiter) AllowN(userID string, limits Limits, now time.Time, n int) bool {
+	if limits.IngestionRate <= 0 {
+		return true
+	}
+
+	t.mtx.Lock()
+	limiter, ok := t.limiters[userID]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(limits.IngestionRate), limits.burst())
+		t.limiters[userID] = limiter
+	}
+	t.mtx.Unlock()
+
+	// The limits may have been reloaded since the limiter was created.
+	if limiter.Limit() != rate.Limit(limits.IngestionRate) {
+		limiter.SetLimitAt(now, rate.Limit(limits.IngestionRate))
+	}
+	if limiter.Burst() != limits.burst() {
+		limiter.SetBurstAt(now, limits.burst())
+	}
+	return limiter.AllowN(now, n)
+}
@@ -0,0 +1,198 @@
+package writeproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/schema/msg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+)
+
+func TestOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+overrides:
+  tenant-a:
+    ingestion_rate: 100
+  tenant-b:
+    max_tags: 5
+    max_name_length: 0
+`), 0o600))
+
+	defaults := Limits{IngestionRate: 10, MaxNameLength: 200}
+	overrides, err := NewOverrides(LimitsConfig{
+		Limits:                defaults,
+		OverridesFile:         path,
+		OverridesReloadPeriod: 10 * time.Millisecond,
+	}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	run, stop := overrides.Handler()
+	done := make(chan error)
+	go func() {
+		done <- run()
+	}()
+	t.Cleanup(func() {
+		stop(nil)
+		require.NoError(t, <-done)
+	})
+
+	assert.Equal(t, Limits{IngestionRate: 100, MaxNameLength: 200}, overrides.ForTenant("tenant-a"))
+	assert.Equal(t, Limits{IngestionRate: 10, MaxTags: 5}, overrides.ForTenant("tenant-b"))
+	assert.Equal(t, defaults, overrides.ForTenant("tenant-c"))
+
+	// The file is reloaded periodically.
+	require.NoError(t, os.WriteFile(path, []byte(`
+overrides:
+  tenant-c:
+    max_tags: 1
+`), 0o600))
+	require.Eventually(t, func() bool {
+		return overrides.ForTenant("tenant-c").MaxTags == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, defaults, overrides.ForTenant("tenant-a"))
+}
+
+func TestNewOverrides_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("overrides:\n  tenant-a:\n    ingestion_rate: lots\n"), 0o600))
+
+	_, err := NewOverrides(LimitsConfig{OverridesFile: path, OverridesReloadPeriod: time.Second}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.Error(t, err)
+}
+
+func TestNewOverrides_UnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("overrides:\n  tenant-a:\n    ingestion_rat: 100\n"), 0o600))
+
+	_, err := NewOverrides(LimitsConfig{OverridesFile: path, OverridesReloadPeriod: time.Second}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.ErrorContains(t, err, "ingestion_rat")
+}
+
+func TestOverrides_Nil(t *testing.T) {
+	var overrides *Overrides
+	assert.Equal(t, Limits{}, overrides.ForTenant("tenant-a"))
+}
+
+func TestTenantRateLimiter(t *testing.T) {
+	limiter := newTenantRateLimiter()
+	now := time.Now()
+	limits := Limits{IngestionRate: 10, IngestionBurstSize: 20}
+
+	assert.True(t, limiter.AllowN("tenant-a", limits, now, 20))
+	assert.False(t, limiter.AllowN("tenant-a", limits, now, 1))
+	// Tenants are limited independently.
+	assert.True(t, limiter.AllowN("tenant-b", limits, now, 20))
+	// The bucket refills at the ingestion rate.
+	assert.True(t, limiter.AllowN("tenant-a", limits, now.Add(time.Second), 10))
+	// No rate means no limit.
+	assert.True(t, limiter.AllowN("tenant-a", Limits{}, now, 1000))
+	// Updated limits are applied, the bucket refills at the new rate.
+	limits = Limits{IngestionRate: 1000}
+	assert.True(t, limiter.AllowN("tenant-a", limits, now.Add(2*time.Second), 10))
+	assert.True(t, limiter.AllowN("tenant-a", limits, now.Add(2500*time.Millisecond), 500))
+}
+
+func TestRemoteWriteMetricsHandler_Limits(t *testing.T) {
+	metric := func(name string, tags ...string) *schema.MetricData {
+		return &schema.MetricData{Name: name, Tags: tags, Interval: 1, Value: 1, Time: 1600000000}
+	}
+
+	tests := map[string]struct {
+		limits         Limits
+		metrics        []*schema.MetricData
+		expectedStatus int
+		expectedReason string
+		expectedWrite  bool
+	}{
+		"within limits": {
+			limits:         Limits{IngestionRate: 10, MaxSamplesPerRequest: 2, MaxNameLength: 16, MaxTags: 1},
+			metrics:        []*schema.MetricData{metric("some.test.metric", "a=b"), metric("other")},
+			expectedStatus: http.StatusOK,
+			expectedWrite:  true,
+		},
+		"name too long": {
+			limits:         Limits{MaxNameLength: 10},
+			metrics:        []*schema.MetricData{metric("some.test.metric")},
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: reasonNameTooLong,
+		},
+		"too many tags": {
+			limits:         Limits{MaxTags: 1},
+			metrics:        []*schema.MetricData{metric("some.test.metric", "a=b", "c=d")},
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: reasonTooManyTags,
+		},
+		"too many samples": {
+			limits:         Limits{MaxSamplesPerRequest: 1},
+			metrics:        []*schema.MetricData{metric("some.test.metric"), metric("other")},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedReason: reasonTooManySamples,
+		},
+		"rate limited": {
+			limits:         Limits{IngestionRate: 1},
+			metrics:        []*schema.MetricData{metric("some.test.metric"), metric("other")},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedReason: reasonRateLimited,
+			// The first sub-batch, within the burst, is written.
+			expectedWrite: true,
+		},
+		"sub-batches are capped to the burst": {
+			limits:         Limits{IngestionRate: 1e9, IngestionBurstSize: 1},
+			metrics:        []*schema.MetricData{metric("some.test.metric"), metric("other"), metric("third")},
+			expectedStatus: http.StatusOK,
+			expectedWrite:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, err := msg.CreateMsg(tc.metrics, 0, msg.FormatMetricDataArrayMsgp)
+			require.NoError(t, err)
+
+			recorderMock := &MockRecorder{}
+			recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+			recorderMock.On("measureIncomingSamples", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+			recorderMock.On("measureReceivedSamples", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureRejectedSamples", "fake", mock.Anything).Return(nil)
+
+			remoteWriteMock := &remotewritemock.Client{}
+			remoteWriteMock.On("Write", mock.Anything, mock.Anything).Return(nil)
+
+			overrides, err := NewOverrides(LimitsConfig{Limits: tc.limits}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+			require.NoError(t, err)
+			handler, err := NewRemoteWriteProxy(Config{}, remoteWriteMock, recorderMock, overrides, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentTypeMetricBinary)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, tc.expectedStatus, recorder.Code, recorder.Body.String())
+
+			if tc.expectedReason != "" {
+				recorderMock.AssertCalled(t, "measureRejectedSamples", "fake", tc.expectedReason)
+			}
+			if tc.expectedWrite {
+				remoteWriteMock.AssertExpectations(t)
+			} else {
+				remoteWriteMock.AssertNotCalled(t, "Write", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
@@ -2,20 +2,26 @@ package writeproxy
 
 import (
 	"context"
-	"fmt"
-	"strings"
+	"strconv"
 
 	"github.com/prometheus/prometheus/prompb"
 
 	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/mimir/pkg/mimirpb"
 	"github.com/grafana/mimir/pkg/util/spanlogger"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
 )
 
 const (
-	TaggedMetricName   = "graphite_tagged"
-	UntaggedMetricName = "graphite_untagged"
+	TaggedMetricName   = convert.TaggedMetricName
+	UntaggedMetricName = convert.UntaggedMetricName
+
+	// IntervalLabel is the label set to the metric interval, in seconds, when
+	// enabled.
+	IntervalLabel = "interval"
 )
 
 type MetricDataPayload []*schema.MetricData
@@ -66,6 +72,22 @@ func (m MetricDataPayload) GeneratePromTimeSeries(ctx context.Context) ([]prompb
 }
 
 func (m MetricDataPayload) GeneratePreallocTimeseries(ctx context.Context) ([]mimirpb.PreallocTimeseries, error) {
+	return m.GeneratePreallocTimeseriesWithOptions(ctx, ConvertOptions{})
+}
+
+// ConvertOptions customise the series generated from the metrics.
+type ConvertOptions struct {
+	// NameMapper names the series of the metrics matching its rules instead of
+	// the default encoding, it may be nil.
+	NameMapper *NameMapper
+	// IntervalLabel adds the interval of the metrics to their series, unless a
+	// tag already sets the label.
+	IntervalLabel bool
+}
+
+// GeneratePreallocTimeseriesWithOptions is like GeneratePreallocTimeseries,
+// with the series customised according to opts.
+func (m MetricDataPayload) GeneratePreallocTimeseriesWithOptions(ctx context.Context, opts ConvertOptions) ([]mimirpb.PreallocTimeseries, error) {
 	log, _ := spanlogger.New(ctx, "graphiteWriter.GeneratePreallocTimeseries")
 	defer log.Finish()
 
@@ -73,10 +95,15 @@ func (m MetricDataPayload) GeneratePreallocTimeseries(ctx context.Context) ([]mi
 
 	labelsBuilder := labels.NewBuilder(nil)
 	for _, md := range m {
-		labels, sample, err := promMetricsFromMetricData(md, labelsBuilder)
+		labels, sample, err := mappedPromMetricsFromMetricData(md, opts.NameMapper, labelsBuilder)
 		if err != nil {
 			return nil, err
 		}
+		if opts.IntervalLabel && !labels.Has(IntervalLabel) {
+			labelsBuilder.Reset(labels)
+			labelsBuilder.Set(IntervalLabel, strconv.Itoa(md.Interval))
+			labels = labelsBuilder.Labels()
+		}
 		ts := mimirpb.TimeseriesFromPool()
 		ts.Labels = mimirpb.FromLabelsToLabelAdapters(labels)
 		ts.Samples = []mimirpb.Sample{sample}
@@ -89,6 +116,70 @@ func (m MetricDataPayload) GeneratePreallocTimeseries(ctx context.Context) ([]mi
 	return tsSlice, nil
 }
 
+// GenerateMetadata returns the metadata of the metric families of series,
+// which must have been generated from m, in the same order. Metrictank
+// counters are monotonic, so they are the only Prometheus counters, and every
+// other metric type is a gauge.
+//
+// Metadata is per metric family, so it is only returned for the families named
+// by the name mappings. The graphite_untagged and graphite_tagged families are
+// shared by metrics of every type, and their series get no metadata. Each
+// family is returned once, with the metadata of its first series.
+func (m MetricDataPayload) GenerateMetadata(series []mimirpb.PreallocTimeseries) []*mimirpb.MetricMetadata {
+	var metadata []*mimirpb.MetricMetadata
+	seen := make(map[string]struct{})
+	for i, md := range m {
+		family := metricFamilyName(series[i].Labels)
+		if family == UntaggedMetricName || family == TaggedMetricName {
+			continue
+		}
+		if _, ok := seen[family]; ok {
+			continue
+		}
+		seen[family] = struct{}{}
+		metadata = append(metadata, &mimirpb.MetricMetadata{
+			Type:             metadataType(md.Mtype),
+			MetricFamilyName: family,
+			Unit:             md.Unit,
+		})
+	}
+	return metadata
+}
+
+func metadataType(mtype string) mimirpb.MetricMetadata_MetricType {
+	switch mtype {
+	case "counter":
+		return mimirpb.COUNTER
+	case "gauge", "rate", "count", "timestamp":
+		return mimirpb.GAUGE
+	default:
+		return mimirpb.UNKNOWN
+	}
+}
+
+func metricFamilyName(lbls []mimirpb.LabelAdapter) string {
+	for _, l := range lbls {
+		if l.Name == model.MetricNameLabel {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// mappedPromMetricsFromMetricData applies the first mapper rule matching the
+// metric name, falling back to the default naming when none matches.
+func mappedPromMetricsFromMetricData(md *schema.MetricData, mapper *NameMapper, builder *labels.Builder) (labels.Labels,
+	mimirpb.Sample,
+	error) {
+	if mapper != nil {
+		labels, ok, err := mapper.labels(md.Name, md.Tags, builder)
+		if err != nil || ok {
+			return labels, mimirpb.Sample{Value: md.Value, TimestampMs: md.Time * 1000}, err
+		}
+	}
+	return promMetricsFromMetricData(md, builder)
+}
+
 func promMetricsFromMetricData(md *schema.MetricData, builder *labels.Builder) (labels.Labels,
 	mimirpb.Sample,
 	error) {
@@ -106,22 +197,10 @@ func promMetricsFromMetricDataTagged(
 	return labels, mimirpb.Sample{Value: md.Value, TimestampMs: md.Time * 1000}, err
 }
 
+// LabelsFromTaggedName returns the labels of a tagged Graphite metric. It is
+// shared with the whisper converter so both produce the same series.
 func LabelsFromTaggedName(name string, tags []string, builder *labels.Builder) (labels.Labels, error) {
-	// 1 per tag, +1 for the graphite name, +1 for the prom name
-	builder.Reset(make(labels.Labels, 0, len(tags)+2)) // nolint:gomnd
-
-	for _, tag := range tags {
-		equalIdx := strings.Index(tag, "=")
-		if equalIdx <= 0 || equalIdx == len(tag)-1 {
-			return nil, fmt.Errorf("encountered invalid tag %s", tag)
-		}
-		builder.Set(tag[:equalIdx], tag[equalIdx+1:])
-	}
-
-	builder.Set("name", name)
-	builder.Set("__name__", TaggedMetricName)
-
-	return builder.Labels(), nil
+	return convert.LabelsFromTaggedName(name, tags, builder)
 }
 
 func promMetricsFromMetricDataUntagged(
@@ -134,16 +213,10 @@ func promMetricsFromMetricDataUntagged(
 	}, nil
 }
 
+// LabelsFromUntaggedName returns the labels of an untagged Graphite metric.
+// It is shared with the whisper converter so both produce the same series.
 func LabelsFromUntaggedName(name string, builder *labels.Builder) labels.Labels {
-	// number of metric name nodes, +1 for the prom name
-	builder.Reset(make(labels.Labels, 0, strings.Count(name, ".")+2)) // nolint:gomnd
-
-	for i, node := range strings.Split(name, ".") {
-		builder.Set(fmt.Sprintf("__n%03d__", i), node)
-	}
-
-	builder.Set("__name__", UntaggedMetricName)
-	return builder.Labels()
+	return convert.LabelsFromUntaggedName(name, builder)
 }
 
 // labelsToLabelsProto transforms labels into prompb labels.
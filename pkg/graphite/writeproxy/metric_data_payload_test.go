@@ -2,6 +2,7 @@ package writeproxy
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,6 +12,9 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/graphite/convert"
 )
 
 func TestGeneratePromMetrics(t *testing.T) {
@@ -299,3 +303,88 @@ func TestLabelsFromUntaggedName(t *testing.T) {
 		})
 	}
 }
+
+func TestLabelsFromTaggedName_MatchesConverter(t *testing.T) {
+	for name, test := range map[string]struct {
+		name string
+		tags []string
+	}{
+		"single tag": {
+			name: "disk.used",
+			tags: []string{"host=a"},
+		},
+		"multiple tags": {
+			name: "disk.used",
+			tags: []string{"host=a", "dc=eu", "rack=r1"},
+		},
+		"tag value with equal sign": {
+			name: "query.count",
+			tags: []string{"expr=a=b"},
+		},
+		"tag overriding the name": {
+			name: "disk.used",
+			tags: []string{"name=other", "host=a"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			proxyLabels, _, err := MetricDataPayload{{Name: test.name, Tags: test.tags, Time: 1}}.GeneratePromMetrics()
+			require.NoError(t, err)
+
+			convertLabels, err := convert.LabelsFromName(test.name+";"+strings.Join(test.tags, ";"), labels.NewBuilder(nil))
+			require.NoError(t, err)
+
+			assert.Equal(t, convertLabels, proxyLabels[0])
+		})
+	}
+}
+
+func TestGeneratePreallocTimeseries_IntervalLabel(t *testing.T) {
+	series, err := MetricDataPayload{
+		&schema.MetricData{Name: "some.test.metric", Interval: 10, Time: 1600000000},
+		&schema.MetricData{Name: "some.test.metric", Tags: []string{"interval=1m"}, Interval: 60, Time: 1600000000},
+	}.GeneratePreallocTimeseriesWithOptions(context.Background(), ConvertOptions{IntervalLabel: true})
+	assert.NoError(t, err)
+	defer mimirpb.ReuseSlice(series)
+
+	assert.Equal(t, []mimirpb.LabelAdapter{
+		{Name: "__n000__", Value: "some"},
+		{Name: "__n001__", Value: "test"},
+		{Name: "__n002__", Value: "metric"},
+		{Name: "__name__", Value: "graphite_untagged"},
+		{Name: "interval", Value: "10"},
+	}, series[0].Labels)
+	// The interval tag is kept.
+	assert.Equal(t, []mimirpb.LabelAdapter{
+		{Name: "__name__", Value: "graphite_tagged"},
+		{Name: "interval", Value: "1m"},
+		{Name: "name", Value: "some.test.metric"},
+	}, series[1].Labels)
+}
+
+func TestGenerateMetadata(t *testing.T) {
+	mapper, err := NewNameMapper([]NameMappingRule{
+		{Match: "app.*.requests", Name: "app_requests_total"},
+		{Match: "app.*.memory", Name: "app_memory_bytes"},
+	})
+	assert.NoError(t, err)
+
+	payload := MetricDataPayload{
+		&schema.MetricData{Name: "app.host1.requests", Mtype: "counter", Time: 1600000000},
+		&schema.MetricData{Name: "app.host2.requests", Mtype: "counter", Time: 1600000000},
+		&schema.MetricData{Name: "app.host1.memory", Mtype: "gauge", Unit: "bytes", Time: 1600000000},
+		// The first metadata of a family wins.
+		&schema.MetricData{Name: "app.host2.memory", Mtype: "counter", Time: 1600000000},
+		// The families shared by the unmapped metrics get no metadata.
+		&schema.MetricData{Name: "some.rate", Mtype: "rate", Time: 1600000000},
+		&schema.MetricData{Name: "some.counter", Mtype: "counter", Time: 1600000000},
+		&schema.MetricData{Name: "some.tagged", Tags: []string{"a=b"}, Mtype: "counter", Time: 1600000000},
+	}
+	series, err := payload.GeneratePreallocTimeseriesWithOptions(context.Background(), ConvertOptions{NameMapper: mapper})
+	assert.NoError(t, err)
+	defer mimirpb.ReuseSlice(series)
+
+	assert.Equal(t, []*mimirpb.MetricMetadata{
+		{Type: mimirpb.COUNTER, MetricFamilyName: "app_requests_total"},
+		{Type: mimirpb.GAUGE, MetricFamilyName: "app_memory_bytes", Unit: "bytes"},
+	}, payload.GenerateMetadata(series))
+}
@@ -18,6 +18,11 @@ func (_m *MockRecorder) measureConversionDuration(user string, duration time.Dur
 	_m.Called(user, duration)
 }
 
+// measureDedupedSamples provides a mock function with given fields: user, count
+func (_m *MockRecorder) measureDedupedSamples(user string, count int) {
+	_m.Called(user, count)
+}
+
 // measureIncomingRequest provides a mock function with given fields: user
 func (_m *MockRecorder) measureIncomingRequest(user string) {
 	_m.Called(user)
@@ -43,6 +48,11 @@ func (_m *MockRecorder) measureRejectedSamples(user string, reason string) {
 	_m.Called(user, reason)
 }
 
+// measureRoutedSamples provides a mock function with given fields: user, tenant, count
+func (_m *MockRecorder) measureRoutedSamples(user string, tenant string, count int) {
+	_m.Called(user, tenant, count)
+}
+
 type mockConstructorTestingTNewMockRecorder interface {
 	mock.TestingT
 	Cleanup(func())
@@ -0,0 +1,221 @@
+package writeproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	MappingMatchTypeGlob  = "glob"
+	MappingMatchTypeRegex = "regex"
+)
+
+// NameMappingRule maps the Graphite paths it matches to a Prometheus metric
+// name and labels, in the same way as the graphite_exporter and
+// statsd_exporter mappings.
+//
+// Glob rules match one path node per "*", while regex rules match the whole
+// path. The name and label values can refer to the captured groups as $1,
+// ${1}, or by name for named regex groups. Like with regexp.Expand, $1_total
+// refers to a group named "1_total", so group numbers followed by letters,
+// digits or "_" must be written ${1}_total.
+type NameMappingRule struct {
+	Match     string            `yaml:"match"`
+	MatchType string            `yaml:"match_type"`
+	Name      string            `yaml:"name"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+type nameMappingRule struct {
+	regex  *regexp.Regexp
+	name   string
+	labels map[string]string
+}
+
+// NameMapper evaluates name mapping rules in order, the first rule matching a
+// path is applied.
+type NameMapper struct {
+	rules []nameMappingRule
+}
+
+// NewNameMapper validates and compiles the given rules.
+func NewNameMapper(rules []NameMappingRule) (*NameMapper, error) {
+	m := &NameMapper{rules: make([]nameMappingRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled, err := compileNameMappingRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name mapping rule %d (%q): %w", i, rule.Match, err)
+		}
+		m.rules = append(m.rules, compiled)
+	}
+	return m, nil
+}
+
+func compileNameMappingRule(rule NameMappingRule) (nameMappingRule, error) {
+	if rule.Match == "" {
+		return nameMappingRule{}, fmt.Errorf("match can't be empty")
+	}
+	if rule.Name == "" {
+		return nameMappingRule{}, fmt.Errorf("name can't be empty")
+	}
+	for name := range rule.Labels {
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nameMappingRule{}, fmt.Errorf("invalid label name %q", name)
+		}
+	}
+
+	var expr string
+	switch rule.MatchType {
+	case "", MappingMatchTypeGlob:
+		expr = globToRegex(rule.Match)
+	case MappingMatchTypeRegex:
+		expr = rule.Match
+	default:
+		return nameMappingRule{}, fmt.Errorf("invalid match type %q, must be %q or %q", rule.MatchType, MappingMatchTypeGlob, MappingMatchTypeRegex)
+	}
+	regex, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nameMappingRule{}, err
+	}
+	if err := validateTemplate(regex, rule.Name); err != nil {
+		return nameMappingRule{}, fmt.Errorf("invalid name: %w", err)
+	}
+	for name, template := range rule.Labels {
+		if err := validateTemplate(regex, template); err != nil {
+			return nameMappingRule{}, fmt.Errorf("invalid value of label %q: %w", name, err)
+		}
+	}
+
+	return nameMappingRule{
+		regex:  regex,
+		name:   rule.Name,
+		labels: rule.Labels,
+	}, nil
+}
+
+// validateTemplate checks that the groups referred to by the template exist,
+// as regexp.Expand silently replaces unknown groups with an empty string.
+func validateTemplate(regex *regexp.Regexp, template string) error {
+	for rest := template; ; {
+		idx := strings.IndexByte(rest, '$')
+		if idx < 0 || idx == len(rest)-1 {
+			return nil
+		}
+		rest = rest[idx+1:]
+		if rest[0] == '$' {
+			rest = rest[1:]
+			continue
+		}
+
+		var group string
+		if rest[0] == '{' {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				continue
+			}
+			group, rest = rest[1:end], rest[end+1:]
+		} else {
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isGroupNameRune(r) })
+			if end < 0 {
+				end = len(rest)
+			}
+			group, rest = rest[:end], rest[end:]
+		}
+		if group == "" || strings.IndexFunc(group, func(r rune) bool { return !isGroupNameRune(r) }) >= 0 {
+			// Not a group reference, expanded as is.
+			continue
+		}
+
+		digits := strings.IndexFunc(group, func(r rune) bool { return r < '0' || r > '9' })
+		switch {
+		case digits < 0:
+			if num, err := strconv.Atoi(group); err != nil || num > regex.NumSubexp() {
+				return fmt.Errorf("reference to undefined group $%s", group)
+			}
+		case regex.SubexpIndex(group) >= 0:
+		case digits > 0:
+			return fmt.Errorf("reference to undefined group $%s, use ${%s}%s to follow a group number with text", group, group[:digits], group[digits:])
+		default:
+			return fmt.Errorf("reference to undefined group $%s", group)
+		}
+	}
+}
+
+// isGroupNameRune returns whether r can be part of a group name in a
+// regexp.Expand template.
+func isGroupNameRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// globToRegex turns a glob, where "*" matches any part of a single node, into
+// a regular expression capturing every "*".
+func globToRegex(glob string) string {
+	parts := strings.Split(glob, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return strings.Join(parts, "([^.]*)")
+}
+
+// labels returns the labels of the series for the given Graphite name and
+// tags, and whether any rule matched. Tags are kept as labels, but the labels
+// set by the rule take precedence over them.
+func (m *NameMapper) labels(name string, tags []string, builder *labels.Builder) (labels.Labels, bool, error) {
+	for _, rule := range m.rules {
+		match := rule.regex.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+
+		// 1 per tag and rule label, +1 for the prom name
+		builder.Reset(make(labels.Labels, 0, len(tags)+len(rule.labels)+1))
+		for _, tag := range tags {
+			equalIdx := strings.Index(tag, "=")
+			if equalIdx <= 0 || equalIdx == len(tag)-1 {
+				return nil, false, fmt.Errorf("encountered invalid tag %s", tag)
+			}
+			builder.Set(tag[:equalIdx], tag[equalIdx+1:])
+		}
+		for labelName, template := range rule.labels {
+			builder.Set(labelName, string(rule.regex.ExpandString(nil, template, name, match)))
+		}
+		metricName := string(rule.regex.ExpandString(nil, rule.name, name, match))
+		if metricName == "" {
+			return nil, false, fmt.Errorf("name mapping of %s results in an empty metric name", name)
+		}
+		builder.Set(model.MetricNameLabel, escapeMetricName(metricName))
+
+		return builder.Labels(), true, nil
+	}
+	return nil, false, nil
+}
+
+// escapeMetricName replaces the characters not allowed in Prometheus metric
+// names, which can come from the captured parts of the path, with "_".
+func escapeMetricName(name string) string {
+	if model.IsValidLegacyMetricName(name) {
+		return name
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
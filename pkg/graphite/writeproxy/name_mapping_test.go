@@ -0,0 +1,178 @@
+package writeproxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameMapper(t *testing.T) {
+	mapper, err := NewNameMapper([]NameMappingRule{
+		{
+			Match: "test.dispatcher.*.*.*",
+			Name:  "dispatcher_events_total",
+			Labels: map[string]string{
+				"processor": "$1",
+				"action":    "$2",
+				"outcome":   "${3}",
+				"job":       "test_dispatcher",
+			},
+		},
+		{
+			Match: "*.signup.*",
+			Name:  "signup_events_total",
+			Labels: map[string]string{
+				"provider": "$2",
+				"job":      "${1}_server",
+			},
+		},
+		{
+			Match:     `servers\.(?P<host>[^.]+)\.networking\.subnetworks\.transmissions\.([a-z0-9-]+)\.(.*)`,
+			MatchType: MappingMatchTypeRegex,
+			Name:      "servers_networking_transmissions_${3}",
+			Labels: map[string]string{
+				"hostname": "${host}",
+				"device":   "$2",
+			},
+		},
+		{
+			Match: "requests.*.latency",
+			Name:  "${1}_latency",
+		},
+		{
+			Match: "prices.*",
+			Name:  "price_dollars",
+			Labels: map[string]string{
+				"currency": "$$$1",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		name      string
+		tags      []string
+		expLabels labels.Labels
+		expMapped bool
+	}{
+		"glob": {
+			name: "test.dispatcher.FooProcessor.send.success",
+			expLabels: labels.FromStrings(
+				"__name__", "dispatcher_events_total",
+				"action", "send",
+				"job", "test_dispatcher",
+				"outcome", "success",
+				"processor", "FooProcessor",
+			),
+			expMapped: true,
+		},
+		"glob star only matches a single node": {
+			name: "test.dispatcher.FooProcessor.send.success.extra",
+		},
+		"glob with the first node captured": {
+			name: "foo_product.signup.facebook",
+			expLabels: labels.FromStrings(
+				"__name__", "signup_events_total",
+				"job", "foo_product_server",
+				"provider", "facebook",
+			),
+			expMapped: true,
+		},
+		"regex with named groups": {
+			name: "servers.rack-003-server-c4de.networking.subnetworks.transmissions.eth0.failure.mean_rate",
+			expLabels: labels.FromStrings(
+				"__name__", "servers_networking_transmissions_failure_mean_rate",
+				"device", "eth0",
+				"hostname", "rack-003-server-c4de",
+			),
+			expMapped: true,
+		},
+		"invalid characters in the name are escaped": {
+			name:      "requests.1-api.latency",
+			expLabels: labels.FromStrings("__name__", "_1_api_latency"),
+			expMapped: true,
+		},
+		"tags are kept but rule labels take precedence": {
+			name: "foo_product.signup.facebook",
+			tags: []string{"dc=eu", "job=other"},
+			expLabels: labels.FromStrings(
+				"__name__", "signup_events_total",
+				"dc", "eu",
+				"job", "foo_product_server",
+				"provider", "facebook",
+			),
+			expMapped: true,
+		},
+		"escaped dollar": {
+			name:      "prices.usd",
+			expLabels: labels.FromStrings("__name__", "price_dollars", "currency", "$usd"),
+			expMapped: true,
+		},
+		"no rule matches": {
+			name: "some.other.metric",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lbls, mapped, err := mapper.labels(tc.name, tc.tags, labels.NewBuilder(nil))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expMapped, mapped)
+			assert.Equal(t, tc.expLabels, lbls)
+		})
+	}
+}
+
+func TestNewNameMapper_Errors(t *testing.T) {
+	tests := map[string]NameMappingRule{
+		"empty match":                   {Name: "foo"},
+		"empty name":                    {Match: "foo.*"},
+		"invalid match type":            {Match: "foo.*", Name: "foo", MatchType: "prefix"},
+		"invalid regex":                 {Match: "foo.(", Name: "foo", MatchType: MappingMatchTypeRegex},
+		"invalid label name":            {Match: "foo.*", Name: "foo", Labels: map[string]string{"foo-bar": "$1"}},
+		"reserved label":                {Match: "foo.*", Name: "foo", Labels: map[string]string{"__name__": "$1"}},
+		"group number followed by text": {Match: "foo.*", Name: "$1_total"},
+		"undefined group number":        {Match: "foo.*", Name: "foo_${2}"},
+		"undefined named group":         {Match: `foo\.(?P<bar>.*)`, MatchType: MappingMatchTypeRegex, Name: "foo", Labels: map[string]string{"bar": "$baz"}},
+	}
+
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewNameMapper([]NameMappingRule{rule})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestGeneratePreallocTimeseries_NameMapper(t *testing.T) {
+	mapper, err := NewNameMapper([]NameMappingRule{
+		{Match: "app.*.requests", Name: "app_requests_total", Labels: map[string]string{"instance": "$1"}},
+	})
+	require.NoError(t, err)
+
+	series, err := MetricDataPayload{
+		&schema.MetricData{Name: "app.host1.requests", Value: 1, Time: 1600000000},
+		&schema.MetricData{Name: "app.host1.errors", Value: 2, Time: 1600000000},
+	}.GeneratePreallocTimeseriesWithOptions(context.Background(), ConvertOptions{NameMapper: mapper})
+	require.NoError(t, err)
+	defer mimirpb.ReuseSlice(series)
+
+	require.Len(t, series, 2)
+	assert.Equal(t, []mimirpb.LabelAdapter{
+		{Name: "__name__", Value: "app_requests_total"},
+		{Name: "instance", Value: "host1"},
+	}, series[0].Labels)
+	assert.Equal(t, []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}}, series[0].Samples)
+	// Unmatched paths keep the default node encoding.
+	assert.Equal(t, []mimirpb.LabelAdapter{
+		{Name: "__n000__", Value: "app"},
+		{Name: "__n001__", Value: "host1"},
+		{Name: "__n002__", Value: "errors"},
+		{Name: "__name__", Value: "graphite_untagged"},
+	}, series[1].Labels)
+}
@@ -19,6 +19,8 @@ type Recorder interface {
 	measureReceivedSamples(user string, count int)
 	measureIncomingSamples(user string, count int)
 	measureRejectedSamples(user, reason string)
+	measureRoutedSamples(user, tenant string, count int)
+	measureDedupedSamples(user string, count int)
 	measureConversionDuration(user string, duration time.Duration)
 }
 
@@ -53,6 +55,16 @@ func NewRecorder(reg prometheus.Registerer) Recorder {
 			Name:      "rejected_samples_total",
 			Help:      "The total number of samples that were rejected.",
 		}, []string{"user", "reason"}),
+		routedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "routed_samples_total",
+			Help:      "The total number of received samples written to another tenant than the one they were received for, by tenant routed to.",
+		}, []string{"user", "tenant"}),
+		dedupedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Name:      "deduped_samples_total",
+			Help:      "The total number of samples removed because another sample of the batch had the same series and timestamp.",
+		}, []string{"user"}),
 		conversionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: prefix,
 			Name:      "data_conversion_seconds",
@@ -62,7 +74,7 @@ func NewRecorder(reg prometheus.Registerer) Recorder {
 	}
 
 	reg.MustRegister(r.receivedRequests, r.incomingRequests, r.receivedSamples, r.incomingSamples, r.rejectedSamples,
-		r.conversionDuration)
+		r.routedSamples, r.dedupedSamples, r.conversionDuration)
 
 	return r
 }
@@ -75,6 +87,8 @@ type prometheusRecorder struct {
 	receivedSamples    *prometheus.CounterVec
 	incomingSamples    *prometheus.CounterVec
 	rejectedSamples    *prometheus.CounterVec
+	routedSamples      *prometheus.CounterVec
+	dedupedSamples     *prometheus.CounterVec
 	conversionDuration *prometheus.HistogramVec
 }
 
@@ -107,3 +121,13 @@ func (r prometheusRecorder) measureRejectedSamples(user, reason string) {
 func (r prometheusRecorder) measureConversionDuration(user string, duration time.Duration) {
 	r.conversionDuration.WithLabelValues(user).Observe(duration.Seconds())
 }
+
+// measureRoutedSamples measures the total amount of samples routed to another tenant on Prometheus.
+func (r prometheusRecorder) measureRoutedSamples(user, tenant string, count int) {
+	r.routedSamples.WithLabelValues(user, tenant).Add(float64(count))
+}
+
+// measureDedupedSamples measures the total amount of deduplicated samples on Prometheus.
+func (r prometheusRecorder) measureDedupedSamples(user string, count int) {
+	r.dedupedSamples.WithLabelValues(user).Add(float64(count))
+}
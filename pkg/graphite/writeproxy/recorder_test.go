@@ -57,6 +57,32 @@ graphite_proxy_ingester_samples_in_total{user="123"} 1
 # HELP graphite_proxy_ingester_rejected_samples_total The total number of samples that were rejected.
 # TYPE graphite_proxy_ingester_rejected_samples_total counter
 graphite_proxy_ingester_rejected_samples_total{reason="foo_reason", user="123"} 1
+`,
+		},
+		"Measure routed samples": {
+			measure: func(r Recorder) {
+				r.measureRoutedSamples("123", "456", 2)
+			},
+			expMetricNames: []string{
+				"graphite_proxy_ingester_routed_samples_total",
+			},
+			expMetrics: `
+# HELP graphite_proxy_ingester_routed_samples_total The total number of received samples written to another tenant than the one they were received for, by tenant routed to.
+# TYPE graphite_proxy_ingester_routed_samples_total counter
+graphite_proxy_ingester_routed_samples_total{tenant="456", user="123"} 2
+`,
+		},
+		"Measure deduped samples": {
+			measure: func(r Recorder) {
+				r.measureDedupedSamples("123", 3)
+			},
+			expMetricNames: []string{
+				"graphite_proxy_ingester_deduped_samples_total",
+			},
+			expMetrics: `
+# HELP graphite_proxy_ingester_deduped_samples_total The total number of samples removed because another sample of the batch had the same series and timestamp.
+# TYPE graphite_proxy_ingester_deduped_samples_total counter
+graphite_proxy_ingester_deduped_samples_total{user="123"} 3
 `,
 		},
 		"Measure conversion duration": {
@@ -1,6 +1,7 @@
 package writeproxy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/grafana/dskit/user"
 
 	"github.com/grafana/mimir/pkg/mimirpb"
 
@@ -21,31 +23,106 @@ import (
 
 	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/schema/msg"
+	"github.com/tinylib/msgp/msgp"
 
 	graphiteAuth "github.com/grafana/mimir-graphite/v2/pkg/graphite/authentication"
 	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite"
+	"github.com/grafana/mimir-graphite/v2/pkg/server/middleware"
 )
 
 type RemoteWriteProxy struct {
 	client   remotewrite.Client
 	recorder Recorder
+
+	maxSeriesPerRequest     int
+	maxDecompressedBodySize int64
+	allowPartialWrites      bool
+	maxRejectionExamples    int
+	nameMapper              *NameMapper
+	filter                  *Filter
+	tenantRouter            *TenantRouter
+	sendMetadata            bool
+	intervalLabel           bool
+	dedupPolicy             string
+
+	overrides   *Overrides
+	rateLimiter *tenantRateLimiter
+	aggregator  *Aggregator
 }
 
-func NewRemoteWriteProxy(client remotewrite.Client, recorder Recorder) *RemoteWriteProxy {
-	return &RemoteWriteProxy{
-		client:   client,
-		recorder: recorder,
+// NewRemoteWriteProxy creates a proxy writing to client. The tenants are
+// limited according to overrides, which may be nil to disable the limits.
+// The metrics are aggregated by aggregator, which may be nil to disable the
+// aggregation, and which writes its aggregates through the proxy.
+func NewRemoteWriteProxy(cfg Config, client remotewrite.Client, recorder Recorder, overrides *Overrides, aggregator *Aggregator) (*RemoteWriteProxy, error) {
+	wp := &RemoteWriteProxy{
+		client:                  client,
+		recorder:                recorder,
+		overrides:               overrides,
+		rateLimiter:             newTenantRateLimiter(),
+		aggregator:              aggregator,
+		maxSeriesPerRequest:     cfg.MaxSeriesPerRequest,
+		maxDecompressedBodySize: cfg.MaxDecompressedBodySize,
+		allowPartialWrites:      cfg.AllowPartialWrites,
+		maxRejectionExamples:    cfg.MaxRejectionExamples,
+		sendMetadata:            cfg.SendMetadata,
+		intervalLabel:           cfg.IntervalLabel,
+		dedupPolicy:             cfg.DedupPolicy,
+	}
+	if err := validateDedupPolicy(cfg.DedupPolicy); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.NameMappings) > 0 {
+		mapper, err := NewNameMapper(cfg.NameMappings)
+		if err != nil {
+			return nil, err
+		}
+		wp.nameMapper = mapper
+	}
+	if cfg.Filters.Enabled() {
+		filter, err := NewFilter(cfg.Filters)
+		if err != nil {
+			return nil, err
+		}
+		wp.filter = filter
 	}
+	if len(cfg.TenantRoutes) > 0 {
+		router, err := NewTenantRouter(cfg.TenantRoutes)
+		if err != nil {
+			return nil, err
+		}
+		wp.tenantRouter = router
+	}
+	if aggregator != nil {
+		aggregator.write = wp.writeAggregates
+	}
+	return wp, nil
 }
 
 const (
 	contentTypeMetricBinary       = "rt-metric-binary"
 	contentTypeMetricBinarySnappy = "rt-metric-binary-snappy"
 	contentTypeApplicationJSON    = "application/json"
+	contentTypeTextPlain          = "text/plain"
+
+	// metricBinaryHeaderSize is the size of the header of the metrictank
+	// binary format: the format byte followed by the 8 bytes message ID.
+	metricBinaryHeaderSize = 9
+
+	defaultMaxRejectionExamples = 3
+
+	defaultMaxDecompressedBodySize = 100 << 20
 )
 
+// remoteWriteResponse is the body of successful responses, and of partial
+// writes whose samples were all rejected. The accepted and rejected samples
+// are only reported for partial writes.
 type remoteWriteResponse struct {
-	Published int `json:"published"`
+	Published  int                         `json:"published"`
+	Accepted   *int                        `json:"accepted,omitempty"`
+	Rejected   int                         `json:"rejected,omitempty"`
+	Rejections map[string]*rejectedSamples `json:"rejections,omitempty"`
 }
 
 func (wp *RemoteWriteProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -54,153 +131,357 @@ func (wp *RemoteWriteProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer log.Finish()
 	ctx, userID := graphiteAuth.ExtractOrgID(r.Context())
 
-	metrics, err := extractMetricsFromRequest(r)
-	if err != nil {
+	writer := newBatchWriter(ctx, wp, userID)
+	err := decodeMetricsFromRequest(r, wp.maxDecompressedBodySize, writer.add)
+	if err == nil {
+		err = writer.flush()
+	}
+	// Unless the writer stopped the decoding, an error means the body is
+	// invalid.
+	parseErr := err != nil && !writer.stopped()
+	// Samples written by earlier sub-batches are accounted for even if the
+	// request fails afterwards, as they can't be taken back.
+	if !parseErr || writer.published > 0 {
+		// Counting the request and number of samples before validation.
+		wp.recorder.measureIncomingRequest(userID)
+		wp.recorder.measureIncomingSamples(userID, writer.incoming)
+	}
+	if writer.published > 0 {
+		wp.recorder.measureReceivedSamples(userID, writer.published)
+	}
+
+	switch {
+	case writer.limitErr != nil:
+		level.Warn(log).Log("msg", "request exceeds limits", "published", writer.published, "err", writer.limitErr)
+		http.Error(w, writer.limitErr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case writer.rateLimitErr != nil:
+		level.Warn(log).Log("msg", "rate limited", "published", writer.published, "err", writer.rateLimitErr)
+		http.Error(w, writer.rateLimitErr.Error(), http.StatusTooManyRequests)
+		return
+	case writer.convertErr != nil:
+		level.Error(log).Log("msg", "failed to generate prometheus series from metric payload", "published", writer.published, "err", writer.convertErr)
+		http.Error(w, fmt.Sprintf("failed to generate prometheus series from metric payload: %s", writer.convertErr), http.StatusBadRequest)
+		return
+	case writer.pushErr != nil:
+		if errors.As(writer.pushErr, &errorx.TooManyRequests{}) {
+			level.Warn(log).Log("msg", "too many requests", "published", writer.published, "err", writer.pushErr)
+			http.Error(w, fmt.Sprintf("too many requests: %s", writer.pushErr), http.StatusTooManyRequests)
+			return
+		}
+
+		level.Error(log).Log("msg", "failed to push metric data", "published", writer.published, "err", writer.pushErr)
+		http.Error(w, "failed to push metric data", http.StatusInternalServerError)
+		return
+	case parseErr:
 		var unsupportedMediaType errorx.UnsupportedMediaType
 		if errors.As(err, &unsupportedMediaType) {
 			level.Info(log).Log("msg", "failed to parse content-type", "err", unsupportedMediaType.Error())
 			http.Error(w, unsupportedMediaType.Error(), unsupportedMediaType.HTTPStatusCode())
 			return
 		}
+		var bodyTooLarge bodyTooLargeError
+		if errors.As(err, &bodyTooLarge) {
+			level.Warn(log).Log("msg", "request body too large", "published", writer.published, "err", bodyTooLarge)
+			http.Error(w, bodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The body is only streamed from the client while being decoded, so
+		// failing to read it doesn't mean it's invalid.
+		var readErr bodyReadError
+		if errors.As(err, &readErr) {
+			if status, ok := middleware.BodyReadErrorStatus(readErr.err); ok {
+				level.Warn(log).Log("msg", "failed to read request body", "published", writer.published, "err", readErr.err)
+				http.Error(w, readErr.Error(), status)
+				return
+			}
+		}
 		wp.recorder.measureRejectedSamples(userID, "cant_parse_body")
-		level.Error(log).Log("msg", "failed to parse metrics from body", "err", err)
+		level.Error(log).Log("msg", "failed to parse metrics from body", "published", writer.published, "err", err)
 		http.Error(w, fmt.Sprintf("failed to parse metrics from body: %s", err), http.StatusBadRequest)
 		return
+	case writer.validationErr != nil:
+		level.Error(log).Log("msg", "invalid metric data received", "published", writer.published, "err", writer.validationErr)
+		http.Error(w, fmt.Sprintf("invalid metric data received: %s", writer.validationErr), http.StatusBadRequest)
+		return
+	case writer.accepted == 0 && writer.rejected > 0:
+		// Partial writes only make sense if something was written, the
+		// rejections tell the client what to fix.
+		level.Error(log).Log("msg", "no valid metric data received", "rejected", writer.rejected)
+		wp.writeResponse(w, http.StatusBadRequest, writer)
+		return
 	}
 
-	// Counting the request and number of samples before validation.
-	wp.recorder.measureIncomingRequest(userID)
-	wp.recorder.measureIncomingSamples(userID, len(metrics))
+	// Counting the request after validation.
+	wp.recorder.measureReceivedRequest(userID)
 
-	var firstValidationError error
-	for _, metric := range metrics {
-		metricDataDefaults(metric)
-		var validateErr error
-		if validateErr = metric.Validate(); validateErr != nil {
-			if firstValidationError == nil {
-				firstValidationError = validateErr
-			}
-			wp.recorder.measureRejectedSamples(userID,
-				strings.ReplaceAll(validateErr.Error(), " ", "_"))
-		}
+	wp.writeResponse(w, http.StatusOK, writer)
+
+	level.Debug(log).Log("msg", "successful series write", "len", writer.published, "duration", time.Since(startTime))
+}
+
+// writeResponse writes the remoteWriteResponse of the request with the given
+// status.
+func (wp *RemoteWriteProxy) writeResponse(w http.ResponseWriter, status int, writer *batchWriter) {
+	resp := remoteWriteResponse{
+		Published: writer.published,
 	}
-	if firstValidationError != nil {
-		level.Error(log).Log("msg", "invalid metric data received", "err", firstValidationError)
-		http.Error(w, fmt.Sprintf("invalid metric data received: %s", firstValidationError), http.StatusBadRequest)
-		return
+	if wp.allowPartialWrites {
+		resp.Accepted = &writer.accepted
+		resp.Rejected = writer.rejected
+		if writer.rejected > 0 {
+			resp.Rejections = writer.rejections
+		}
 	}
+	body, _ := json.Marshal(resp)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
 
+// convert generates the Prometheus series for the given metrics, and their
+// metadata if enabled, measuring the time it takes for the tenant they're
+// written to. The series repeating another series of the batch, or one of the
+// written series if not nil, are removed according to the dedup policy.
+func (wp *RemoteWriteProxy) convert(ctx context.Context, tenant string, metrics []*schema.MetricData, written map[dedupKey]struct{}) ([]mimirpb.PreallocTimeseries, []*mimirpb.MetricMetadata, error) {
 	beforeConversion := time.Now()
 
-	series, err := MetricDataPayload(metrics).GeneratePreallocTimeseries(ctx)
+	payload := MetricDataPayload(metrics)
+	series, err := payload.GeneratePreallocTimeseriesWithOptions(ctx, ConvertOptions{
+		NameMapper:    wp.nameMapper,
+		IntervalLabel: wp.intervalLabel,
+	})
 	if err != nil {
-		level.Error(log).Log("msg", "failed to generate prometheus series from metric payload", "err", err)
-		http.Error(w, fmt.Sprintf("failed to generate prometheus series from metric payload: %s", err), http.StatusBadRequest)
-		return
+		return nil, nil, err
+	}
+	var metadata []*mimirpb.MetricMetadata
+	if wp.sendMetadata {
+		metadata = payload.GenerateMetadata(series)
+	}
+	// The series aren't aligned with the metrics anymore once deduplicated.
+	series, deduped := dedupSeries(series, wp.dedupPolicy, written)
+	if deduped > 0 {
+		wp.recorder.measureDedupedSamples(tenant, deduped)
 	}
-	wp.recorder.measureConversionDuration(userID, time.Since(beforeConversion))
+	wp.recorder.measureConversionDuration(tenant, time.Since(beforeConversion))
+	return series, metadata, nil
+}
+
+// aggregate passes the metrics to the aggregator, and returns those still to
+// be written. The metrics slice is reused.
+func (wp *RemoteWriteProxy) aggregate(userID string, metrics []*schema.MetricData) []*schema.MetricData {
+	if wp.aggregator == nil {
+		return metrics
+	}
+	kept := metrics[:0]
+	for _, md := range metrics {
+		if wp.aggregator.add(userID, md) {
+			kept = append(kept, md)
+		}
+	}
+	return kept
+}
 
+// writeAggregates converts and writes the aggregated metrics of the tenant
+// upstream.
+func (wp *RemoteWriteProxy) writeAggregates(userID string, metrics []*schema.MetricData) error {
+	ctx := user.InjectOrgID(context.Background(), userID)
+	for _, tb := range wp.tenantRouter.split(metrics, userID) {
+		tenantCtx := ctx
+		if tb.tenant != userID {
+			tenantCtx = user.InjectOrgID(ctx, tb.tenant)
+		}
+		series, metadata, err := wp.convert(tenantCtx, tb.tenant, tb.metrics, nil)
+		if err != nil {
+			return err
+		}
+		if err := wp.push(tenantCtx, series, metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push writes the series upstream. The series are returned to the pool
+// afterwards and must not be used by the caller anymore.
+func (wp *RemoteWriteProxy) push(ctx context.Context, series []mimirpb.PreallocTimeseries, metadata []*mimirpb.MetricMetadata) error {
 	req := mimirpb.WriteRequest{
 		Timeseries:          series,
+		Metadata:            metadata,
 		SkipLabelValidation: true,
 	}
 	defer mimirpb.ReuseSlice(req.Timeseries)
 
-	err = wp.client.Write(ctx, &req)
-	if err != nil {
-		if errors.As(err, &errorx.TooManyRequests{}) {
-			level.Warn(log).Log("msg", "too many requests", "err", err)
-			http.Error(w, fmt.Sprintf("too many requests: %s", err), http.StatusTooManyRequests)
-			return
-		}
+	return wp.client.Write(ctx, &req)
+}
 
-		level.Error(log).Log("msg", "failed to push metric data", "err", err)
-		http.Error(w, "failed to push metric data", http.StatusInternalServerError)
-		return
+// decodeMetricsFromRequest decodes the request body according to its
+// Content-Type and Content-Encoding, passing each metric to emit as soon as it
+// is decoded. Decoding stops at the first error returned by emit, or once the
+// decompressed body exceeds maxBodySize, if positive.
+func decodeMetricsFromRequest(r *http.Request, maxBodySize int64, emit func(*schema.MetricData) error) error {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case contentTypeMetricBinary, contentTypeMetricBinarySnappy, contentTypeApplicationJSON, contentTypeTextPlain:
+	default:
+		return errorx.UnsupportedMediaType{Msg: fmt.Sprintf("unknown content-type %q", contentType)}
 	}
 
-	// Counting the request and number of samples after validation.
-	wp.recorder.measureReceivedRequest(userID)
-	wp.recorder.measureReceivedSamples(userID, len(series))
-
-	w.WriteHeader(http.StatusOK)
-	body, _ := json.Marshal(remoteWriteResponse{
-		Published: len(series),
-	})
-	_, _ = w.Write(body)
-
-	level.Debug(log).Log("msg", "successful series write", "len", len(series), "duration", time.Since(startTime))
-}
+	if r.Body == nil {
+		return fmt.Errorf("no data included in request")
+	}
+	defer func() {
+		_ = r.Body.Close()
+	}()
+	reader := &bodyReader{r: r.Body}
+	body, err := decodeContentEncoding(r.Header.Get("Content-Encoding"), reader, maxBodySize)
+	if reader.err != nil {
+		return bodyReadError{err: reader.err}
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
 
-func extractMetricsFromRequest(r *http.Request) ([]*schema.MetricData, error) {
-	var metrics []*schema.MetricData
-	var err error
-	contentType := strings.ToLower(r.Header.Get("Content-Type"))
 	switch contentType {
 	case contentTypeMetricBinary:
-		metrics, err = metricsBinary(r, false)
+		err = decodeMetricsBinary(body, false, emit)
 	case contentTypeMetricBinarySnappy:
-		metrics, err = metricsBinary(r, true)
+		err = decodeMetricsBinary(body, true, emit)
 	case contentTypeApplicationJSON:
-		metrics, err = metricsJSON(r)
+		err = decodeMetricsJSON(body, emit)
 	default:
-		return nil, errorx.UnsupportedMediaType{Msg: fmt.Sprintf("unknown content-type %q", contentType)}
+		err = decodeMetricsPlaintext(body, emit)
+	}
+	if body.exceeded {
+		// The decoders don't all keep the read error.
+		return bodyTooLargeError{limit: maxBodySize}
 	}
-	return metrics, err
+	if err != nil && reader.err != nil {
+		return bodyReadError{err: reader.err}
+	}
+	return err
 }
 
-func metricsJSON(r *http.Request) ([]*schema.MetricData, error) {
-	if r.Body == nil {
-		return nil, fmt.Errorf("no data included in request")
-	}
+// mediaType returns the lowercase media type of a Content-Type header value,
+// without any parameters such as the charset.
+func mediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
 
-	defer func() {
-		_ = r.Body.Close()
-	}()
-	body, err := io.ReadAll(r.Body)
+// decodeMetricsJSON decodes a JSON array of metrics one element at a time,
+// so that the whole array is never held in memory.
+func decodeMetricsJSON(r io.Reader, emit func(*schema.MetricData) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid metric data received: %w", err)
+	}
+	if tok == nil {
+		// A null body is an empty array, as with json.Unmarshal.
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("invalid metric data received: expected an array, got %v", tok)
 	}
 
-	metrics := make([]*schema.MetricData, 0)
-	err = json.Unmarshal(body, &metrics)
-	if err != nil {
-		return nil, fmt.Errorf("invalid metric data received: %w", err)
+	for dec.More() {
+		var md *schema.MetricData
+		if err := dec.Decode(&md); err != nil {
+			return fmt.Errorf("invalid metric data received: %w", err)
+		}
+		if md == nil {
+			continue
+		}
+		if err := emit(md); err != nil {
+			return err
+		}
 	}
 
-	return metrics, nil
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("invalid metric data received: %w", err)
+	}
+	return nil
 }
 
-func metricsBinary(r *http.Request, compressed bool) ([]*schema.MetricData, error) {
-	if r.Body == nil {
-		return nil, fmt.Errorf("no data included in request")
-	}
-	var bodyReadCloser io.ReadCloser
+// decodeMetricsBinary decodes the metrictank binary format, which is a header
+// followed by an array of metrics encoded as JSON or msgpack, one element at
+// a time.
+func decodeMetricsBinary(r io.Reader, compressed bool, emit func(*schema.MetricData) error) error {
 	if compressed {
-		bodyReadCloser = io.NopCloser(snappy.NewReader(r.Body))
-	} else {
-		bodyReadCloser = r.Body
+		r = snappy.NewReader(r)
 	}
-	defer func() {
-		_ = bodyReadCloser.Close()
-	}()
 
-	body, err := io.ReadAll(bodyReadCloser)
-	if err != nil {
-		return nil, err
+	header := make([]byte, metricBinaryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("invalid metric data received: message too small")
+		}
+		return err
 	}
-	metricData := new(msg.MetricData)
-	err = metricData.InitFromMsg(body)
-	if err != nil {
-		return nil, fmt.Errorf("invalid metric data received: %w", err)
+
+	switch format := msg.Format(header[0]); format {
+	case msg.FormatMetricDataArrayJson:
+		return decodeMetricsJSON(r, emit)
+	case msg.FormatMetricDataArrayMsgp:
+		return decodeMetricsMsgp(r, emit)
+	default:
+		return fmt.Errorf("invalid metric data received: unsupported format %d", format)
 	}
+}
 
-	err = metricData.DecodeMetricData()
+func decodeMetricsMsgp(r io.Reader, emit func(*schema.MetricData) error) error {
+	reader := msgp.NewReader(r)
+	size, err := reader.ReadArrayHeader()
 	if err != nil {
-		return nil, fmt.Errorf("invalid metric data received:%w", err)
+		return fmt.Errorf("invalid metric data received: %w", err)
+	}
+
+	for i := uint32(0); i < size; i++ {
+		if reader.IsNil() {
+			if err := reader.ReadNil(); err != nil {
+				return fmt.Errorf("invalid metric data received: %w", err)
+			}
+			continue
+		}
+		md := new(schema.MetricData)
+		if err := md.DecodeMsg(reader); err != nil {
+			return fmt.Errorf("invalid metric data received: %w", err)
+		}
+		if err := emit(md); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// decodeMetricsPlaintext parses carbon plaintext lines. Unlike the carbon
+// listeners, a line that can't be parsed fails the whole request. Decoding
+// stops at the first such line or error returned by emit.
+func decodeMetricsPlaintext(r io.Reader, emit func(*schema.MetricData) error) error {
+	scanner := newCarbonScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		md, err := parseCarbonLine(line, time.Now)
+		if err != nil {
+			return fmt.Errorf("invalid metric data received: %w: %q", err, line)
+		}
+		if err := emit(md); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
 
-	return metricData.Metrics, nil
+// validationReason turns a schema validation error into a reason label for the
+// rejected samples metric.
+func validationReason(err error) string {
+	return strings.ReplaceAll(err.Error(), " ", "_")
 }
 
 // metricDataDefaults enforces orgID in the metric to be int(1) as we don't use it and some customers may not provide it,
@@ -2,18 +2,27 @@ package writeproxy
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
 
 	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+	"github.com/grafana/mimir-graphite/v2/pkg/server/middleware"
 
 	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/schema/msg"
 	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -348,7 +357,8 @@ func TestRemoteWriteMetricsHandler(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			handler := NewRemoteWriteProxy(tc.remoteWriteMock(), tc.recorderMock())
+			handler, err := NewRemoteWriteProxy(Config{}, tc.remoteWriteMock(), tc.recorderMock(), nil, nil)
+			require.NoError(t, err)
 
 			mda := schema.MetricDataArray(tc.metrics)
 			data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
@@ -366,3 +376,494 @@ func TestRemoteWriteMetricsHandler(t *testing.T) {
 		})
 	}
 }
+
+// failingReader returns the first bytes of a body, then fails.
+type failingReader struct {
+	body io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if errors.Is(err, io.EOF) {
+		return n, r.err
+	}
+	return n, err
+}
+
+// timeoutError is a network timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRemoteWriteMetricsHandler_BodyReadErrors(t *testing.T) {
+	const lines = "some.test.metric 1 1600000000\nsome.test.met"
+
+	for name, tc := range map[string]struct {
+		contentType string
+		err         error
+		status      int
+	}{
+		"client went away": {
+			contentType: "text/plain",
+			err:         io.ErrUnexpectedEOF,
+			status:      middleware.StatusClientClosedRequest,
+		},
+		"request canceled": {
+			contentType: "text/plain",
+			err:         context.Canceled,
+			status:      middleware.StatusClientClosedRequest,
+		},
+		"network timeout": {
+			contentType: "text/plain",
+			err:         timeoutError{},
+			status:      http.StatusRequestTimeout,
+		},
+		"json body": {
+			contentType: contentTypeApplicationJSON,
+			err:         io.ErrUnexpectedEOF,
+			status:      middleware.StatusClientClosedRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := lines
+			if tc.contentType == contentTypeApplicationJSON {
+				body = `[{"name": "some.test.metric", "interval": 1, "value": 1, "time": 1600000000}, {"na`
+			}
+
+			// Not counted as a rejected body, nor written.
+			recorderMock := &MockRecorder{}
+			remoteWriteMock := &remotewritemock.Client{}
+			handler, err := NewRemoteWriteProxy(Config{}, remoteWriteMock, recorderMock, nil, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", &failingReader{body: strings.NewReader(body), err: tc.err})
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, tc.status, recorder.Code, recorder.Body.String())
+			assert.Contains(t, recorder.Body.String(), "failed to read request body")
+			recorderMock.AssertNotCalled(t, "measureRejectedSamples", mock.Anything, mock.Anything)
+			remoteWriteMock.AssertNotCalled(t, "Write", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRemoteWriteMetricsHandler_Plaintext(t *testing.T) {
+	const lines = "some.test.metric;tag=value 1 1600000000\nsome.test.metric 2 1600000000\n"
+
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	_, err := gz.Write([]byte(lines))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	tests := map[string]struct {
+		contentType     string
+		contentEncoding string
+		body            []byte
+		maxBodySize     int64
+		status          int
+	}{
+		"plaintext": {
+			contentType: "text/plain",
+			body:        []byte(lines),
+			status:      http.StatusOK,
+		},
+		"plaintext with charset": {
+			contentType: "text/plain; charset=utf-8",
+			body:        []byte(lines),
+			status:      http.StatusOK,
+		},
+		"gzipped plaintext": {
+			contentType:     "text/plain",
+			contentEncoding: "gzip",
+			body:            gzipped.Bytes(),
+			status:          http.StatusOK,
+		},
+		"decompressed body too large": {
+			contentType:     "text/plain",
+			contentEncoding: "gzip",
+			body:            gzipped.Bytes(),
+			maxBodySize:     int64(len(lines)) - 1,
+			status:          http.StatusRequestEntityTooLarge,
+		},
+		"decompressed body of the maximum size": {
+			contentType:     "text/plain",
+			contentEncoding: "gzip",
+			body:            gzipped.Bytes(),
+			maxBodySize:     int64(len(lines)),
+			status:          http.StatusOK,
+		},
+		"unsupported content encoding": {
+			contentType:     "text/plain",
+			contentEncoding: "br",
+			body:            []byte(lines),
+			status:          http.StatusUnsupportedMediaType,
+		},
+		"invalid line": {
+			contentType: "text/plain",
+			body:        []byte("some.test.metric 1 1600000000\nsome.test.metric\n"),
+			status:      http.StatusBadRequest,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorderMock := &MockRecorder{}
+			recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+			recorderMock.On("measureIncomingSamples", "fake", 2).Return(nil)
+			recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+			recorderMock.On("measureReceivedSamples", "fake", 2).Return(nil)
+			recorderMock.On("measureRejectedSamples", "fake", "cant_parse_body").Return(nil)
+
+			remoteWriteMock := &remotewritemock.Client{}
+			remoteWriteMock.On("Write", mock.Anything, &mimirpb.WriteRequest{
+				Timeseries: []mimirpb.PreallocTimeseries{
+					{
+						TimeSeries: &mimirpb.TimeSeries{
+							Labels: []mimirpb.LabelAdapter{
+								{Name: "__name__", Value: "graphite_tagged"},
+								{Name: "name", Value: "some.test.metric"},
+								{Name: "tag", Value: "value"},
+							},
+							Samples:   []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}},
+							Exemplars: []mimirpb.Exemplar{},
+						},
+					},
+					{
+						TimeSeries: &mimirpb.TimeSeries{
+							Labels: []mimirpb.LabelAdapter{
+								{Name: "__n000__", Value: "some"},
+								{Name: "__n001__", Value: "test"},
+								{Name: "__n002__", Value: "metric"},
+								{Name: "__name__", Value: "graphite_untagged"},
+							},
+							Samples:   []mimirpb.Sample{{Value: 2, TimestampMs: 1600000000000}},
+							Exemplars: []mimirpb.Exemplar{},
+						},
+					},
+				},
+				SkipLabelValidation: true,
+			}).Return(nil)
+
+			handler, err := NewRemoteWriteProxy(Config{MaxDecompressedBodySize: tc.maxBodySize}, remoteWriteMock, recorderMock, nil, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+			if tc.contentEncoding != "" {
+				req.Header.Set("Content-Encoding", tc.contentEncoding)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, tc.status, recorder.Code, recorder.Body.String())
+			if tc.status == http.StatusOK {
+				remoteWriteMock.AssertExpectations(t)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteMetricsHandler_SubBatches(t *testing.T) {
+	validMetric := func(i int) *schema.MetricData {
+		return &schema.MetricData{
+			Name:     fmt.Sprintf("some.test.metric%d", i),
+			Interval: 1,
+			Value:    float64(i),
+			Time:     1600000000,
+		}
+	}
+	metrics := make([]*schema.MetricData, 5)
+	for i := range metrics {
+		metrics[i] = validMetric(i)
+	}
+	invalidAfterFirstBatch := append([]*schema.MetricData{}, metrics...)
+	invalidAfterFirstBatch[3] = &schema.MetricData{Name: "...", Interval: 1, Time: 1600000000}
+
+	tests := map[string]struct {
+		contentType     string
+		format          msg.Format
+		metrics         []*schema.MetricData
+		maxSeries       int
+		expectedWrites  []int
+		expectedStatus  int
+		expectedPublish int
+	}{
+		"msgp body is written in batches": {
+			contentType:     contentTypeMetricBinary,
+			format:          msg.FormatMetricDataArrayMsgp,
+			metrics:         metrics,
+			maxSeries:       2,
+			expectedWrites:  []int{2, 2, 1},
+			expectedStatus:  http.StatusOK,
+			expectedPublish: 5,
+		},
+		"json in binary body is written in batches": {
+			contentType:     contentTypeMetricBinary,
+			format:          msg.FormatMetricDataArrayJson,
+			metrics:         metrics,
+			maxSeries:       2,
+			expectedWrites:  []int{2, 2, 1},
+			expectedStatus:  http.StatusOK,
+			expectedPublish: 5,
+		},
+		"json body is written in batches": {
+			contentType:     contentTypeApplicationJSON,
+			metrics:         metrics,
+			maxSeries:       3,
+			expectedWrites:  []int{3, 2},
+			expectedStatus:  http.StatusOK,
+			expectedPublish: 5,
+		},
+		"no limit writes a single request": {
+			contentType:     contentTypeApplicationJSON,
+			metrics:         metrics,
+			expectedWrites:  []int{5},
+			expectedStatus:  http.StatusOK,
+			expectedPublish: 5,
+		},
+		"invalid metric stops further batches": {
+			contentType:    contentTypeMetricBinary,
+			format:         msg.FormatMetricDataArrayMsgp,
+			metrics:        invalidAfterFirstBatch,
+			maxSeries:      2,
+			expectedWrites: []int{2},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var body []byte
+			var err error
+			if tc.contentType == contentTypeApplicationJSON {
+				body, err = json.Marshal(tc.metrics)
+			} else {
+				body, err = msg.CreateMsg(tc.metrics, 0, tc.format)
+			}
+			require.NoError(t, err)
+
+			recorderMock := &MockRecorder{}
+			recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+			recorderMock.On("measureIncomingSamples", "fake", len(tc.metrics)).Return(nil)
+			recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+			recorderMock.On("measureReceivedSamples", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureRejectedSamples", "fake", "name_cannot_be_empty").Return(nil)
+
+			var writes []int
+			remoteWriteMock := &remotewritemock.Client{}
+			remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				writes = append(writes, len(args.Get(1).(*mimirpb.WriteRequest).Timeseries))
+			}).Return(nil)
+
+			handler, err := NewRemoteWriteProxy(Config{MaxSeriesPerRequest: tc.maxSeries}, remoteWriteMock, recorderMock, nil, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, tc.expectedStatus, recorder.Code, recorder.Body.String())
+			require.Equal(t, tc.expectedWrites, writes)
+
+			if tc.expectedStatus == http.StatusOK {
+				require.JSONEq(t, fmt.Sprintf(`{"published":%d}`, tc.expectedPublish), recorder.Body.String())
+				recorderMock.AssertCalled(t, "measureReceivedSamples", "fake", tc.expectedPublish)
+			} else {
+				recorderMock.AssertNotCalled(t, "measureReceivedRequest", "fake")
+			}
+		})
+	}
+}
+
+func TestDecodeMetricsBinary_Errors(t *testing.T) {
+	tests := map[string][]byte{
+		"too small":          {byte(msg.FormatMetricDataArrayMsgp), 0, 0},
+		"unsupported format": append([]byte{0xff}, make([]byte, 10)...),
+		"truncated msgp":     append(append([]byte{byte(msg.FormatMetricDataArrayMsgp)}, make([]byte, 8)...), 0x92),
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := decodeMetricsBinary(bytes.NewReader(body), false, func(*schema.MetricData) error {
+				return nil
+			})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeMetricsPlaintext_StopsOnError(t *testing.T) {
+	stopErr := errors.New("stop")
+	var emitted int
+	err := decodeMetricsPlaintext(strings.NewReader("a 1 1600000000\nb 1 1600000000\nc\n"), func(*schema.MetricData) error {
+		emitted++
+		return stopErr
+	})
+	require.ErrorIs(t, err, stopErr)
+	assert.Equal(t, 1, emitted)
+
+	emitted = 0
+	err = decodeMetricsPlaintext(strings.NewReader("a 1 1600000000\nb\nc 1 1600000000\n"), func(*schema.MetricData) error {
+		emitted++
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, emitted)
+}
+
+func TestRemoteWriteMetricsHandler_PartialWrites(t *testing.T) {
+	valid := &schema.MetricData{Name: "some.test.metric", Interval: 1, Value: 1, Time: 1600000000}
+	emptyName := &schema.MetricData{Name: "...", Interval: 1, Time: 1600000000}
+	invalidMtype := &schema.MetricData{Name: "some.test.metric", Interval: 1, Mtype: "invalid", Time: 1600000000}
+
+	tests := map[string]struct {
+		metrics        []*schema.MetricData
+		expectedStatus int
+		expectedBody   string
+	}{
+		"valid samples are written and invalid ones dropped": {
+			metrics:        []*schema.MetricData{valid, emptyName, emptyName, invalidMtype, valid, emptyName},
+			expectedStatus: http.StatusOK,
+			expectedBody: `{
+				"published": 2,
+				"accepted": 2,
+				"rejected": 4,
+				"rejections": {
+					"name_cannot_be_empty": {"count": 3, "examples": ["\"...\": name cannot be empty", "\"...\": name cannot be empty"]},
+					"invalid_mtype": {"count": 1, "examples": ["\"some.test.metric\": invalid mtype"]}
+				}
+			}`,
+		},
+		"all valid samples": {
+			metrics:        []*schema.MetricData{valid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"published": 1, "accepted": 1}`,
+		},
+		"no valid samples": {
+			metrics:        []*schema.MetricData{emptyName, invalidMtype},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody: `{
+				"published": 0,
+				"accepted": 0,
+				"rejected": 2,
+				"rejections": {
+					"name_cannot_be_empty": {"count": 1, "examples": ["\"...\": name cannot be empty"]},
+					"invalid_mtype": {"count": 1, "examples": ["\"some.test.metric\": invalid mtype"]}
+				}
+			}`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, err := msg.CreateMsg(tc.metrics, 0, msg.FormatMetricDataArrayMsgp)
+			require.NoError(t, err)
+
+			recorderMock := &MockRecorder{}
+			recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+			recorderMock.On("measureIncomingSamples", "fake", len(tc.metrics)).Return(nil)
+			recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+			recorderMock.On("measureReceivedSamples", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureRejectedSamples", "fake", mock.Anything).Return(nil)
+
+			remoteWriteMock := &remotewritemock.Client{}
+			remoteWriteMock.On("Write", mock.Anything, mock.Anything).Return(nil)
+
+			cfg := Config{AllowPartialWrites: true, MaxRejectionExamples: 2}
+			handler, err := NewRemoteWriteProxy(cfg, remoteWriteMock, recorderMock, nil, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentTypeMetricBinary)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, tc.expectedStatus, recorder.Code, recorder.Body.String())
+			require.JSONEq(t, tc.expectedBody, recorder.Body.String())
+			if tc.expectedStatus != http.StatusOK {
+				remoteWriteMock.AssertNotCalled(t, "Write", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteMetricsHandler_Metadata(t *testing.T) {
+	body, err := msg.CreateMsg([]*schema.MetricData{
+		{Name: "some.test.metric", Mtype: "counter", Unit: "requests", Interval: 10, Value: 1, Time: 1600000000},
+		{Name: "unmapped", Mtype: "gauge", Interval: 10, Value: 2, Time: 1600000000},
+	}, 0, msg.FormatMetricDataArrayMsgp)
+	require.NoError(t, err)
+
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+	recorderMock.On("measureIncomingSamples", "fake", 2).Return(nil)
+	recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+	recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+	recorderMock.On("measureReceivedSamples", "fake", 2).Return(nil)
+
+	remoteWriteMock := &remotewritemock.Client{}
+	remoteWriteMock.On("Write", mock.Anything, &mimirpb.WriteRequest{
+		Timeseries: []mimirpb.PreallocTimeseries{
+			{
+				TimeSeries: &mimirpb.TimeSeries{
+					Labels: []mimirpb.LabelAdapter{
+						{Name: "__name__", Value: "some_metric_total"},
+						{Name: "interval", Value: "10"},
+						{Name: "kind", Value: "test"},
+					},
+					Samples:   []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}},
+					Exemplars: []mimirpb.Exemplar{},
+				},
+			},
+			{
+				TimeSeries: &mimirpb.TimeSeries{
+					Labels: []mimirpb.LabelAdapter{
+						{Name: "__n000__", Value: "unmapped"},
+						{Name: "__name__", Value: "graphite_untagged"},
+						{Name: "interval", Value: "10"},
+					},
+					Samples:   []mimirpb.Sample{{Value: 2, TimestampMs: 1600000000000}},
+					Exemplars: []mimirpb.Exemplar{},
+				},
+			},
+		},
+		// The unmapped series share their family with metrics of any type,
+		// so they get no metadata.
+		Metadata: []*mimirpb.MetricMetadata{
+			{Type: mimirpb.COUNTER, MetricFamilyName: "some_metric_total", Unit: "requests"},
+		},
+		SkipLabelValidation: true,
+	}).Return(nil)
+
+	handler, err := NewRemoteWriteProxy(Config{
+		SendMetadata:  true,
+		IntervalLabel: true,
+		NameMappings: []NameMappingRule{
+			{Match: "some.*.metric", Name: "some_metric_total", Labels: map[string]string{"kind": "$1"}},
+		},
+	}, remoteWriteMock, recorderMock, nil, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentTypeMetricBinary)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	remoteWriteMock.AssertExpectations(t)
+}
@@ -0,0 +1,136 @@
+package writeproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// TenantRoute writes the metrics matching either a Graphite path prefix or a
+// tag to the given tenant, instead of the tenant of the request.
+//
+// A prefix matches whole path nodes, so "teams.a" matches "teams.a" and
+// "teams.a.cpu" but not "teams.ab.cpu". A tag is given as "name=value".
+//
+// Only the metrics sent by one of the SourceTenants are routed, so that a
+// tenant can't write into another one by naming its metrics after it. "*"
+// allows any tenant.
+type TenantRoute struct {
+	Prefix        string   `yaml:"prefix"`
+	Tag           string   `yaml:"tag"`
+	Tenant        string   `yaml:"tenant"`
+	SourceTenants []string `yaml:"source_tenants"`
+}
+
+// TenantRouter evaluates the tenant routes in order, the first route matching
+// a metric and allowing its source tenant chooses its tenant.
+type TenantRouter struct {
+	routes []TenantRoute
+}
+
+// NewTenantRouter validates the given routes.
+func NewTenantRouter(routes []TenantRoute) (*TenantRouter, error) {
+	for i, route := range routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("invalid tenant route %d: %w", i, err)
+		}
+	}
+	return &TenantRouter{routes: routes}, nil
+}
+
+func (r TenantRoute) validate() error {
+	if (r.Prefix == "") == (r.Tag == "") {
+		return fmt.Errorf("exactly one of prefix and tag must be set")
+	}
+	if r.Tag != "" {
+		equalIdx := strings.Index(r.Tag, "=")
+		if equalIdx <= 0 || equalIdx == len(r.Tag)-1 {
+			return fmt.Errorf("invalid tag %q, must be name=value", r.Tag)
+		}
+	}
+	if r.Tenant == "" {
+		return fmt.Errorf("tenant can't be empty")
+	}
+	if len(r.SourceTenants) == 0 {
+		return fmt.Errorf("source tenants can't be empty, use \"*\" to allow any tenant")
+	}
+	for _, source := range r.SourceTenants {
+		if source == "" {
+			return fmt.Errorf("source tenant can't be empty")
+		}
+	}
+	return nil
+}
+
+// allows returns whether the metrics of source may be routed.
+func (r TenantRoute) allows(source string) bool {
+	for _, allowed := range r.SourceTenants {
+		if allowed == "*" || allowed == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (r TenantRoute) matches(md *schema.MetricData) bool {
+	if r.Tag != "" {
+		for _, tag := range md.Tags {
+			if tag == r.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	if !strings.HasPrefix(md.Name, r.Prefix) {
+		return false
+	}
+	return len(md.Name) == len(r.Prefix) || strings.HasSuffix(r.Prefix, ".") || md.Name[len(r.Prefix)] == '.'
+}
+
+// tenant returns the tenant md, sent by source, is routed to, or source if no
+// route allowing it matches md.
+func (tr *TenantRouter) tenant(md *schema.MetricData, source string) string {
+	if tr == nil {
+		return source
+	}
+	for _, route := range tr.routes {
+		if route.allows(source) && route.matches(md) {
+			return route.Tenant
+		}
+	}
+	return source
+}
+
+// tenantBatch is the metrics of a batch routed to the same tenant.
+type tenantBatch struct {
+	tenant  string
+	metrics []*schema.MetricData
+}
+
+// split splits the metrics sent by source by the tenant they're routed to, in
+// the order the tenants first appear in the batch.
+func (tr *TenantRouter) split(metrics []*schema.MetricData, source string) []tenantBatch {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if tr == nil || len(tr.routes) == 0 {
+		return []tenantBatch{{tenant: source, metrics: metrics}}
+	}
+
+	var (
+		batches []tenantBatch
+		index   = map[string]int{}
+	)
+	for _, md := range metrics {
+		tenant := tr.tenant(md, source)
+		i, ok := index[tenant]
+		if !ok {
+			i = len(batches)
+			index[tenant] = i
+			batches = append(batches, tenantBatch{tenant: tenant})
+		}
+		batches[i].metrics = append(batches[i].metrics, md)
+	}
+	return batches
+}
@@ -0,0 +1,262 @@
+package writeproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/remotewrite/remotewritemock"
+)
+
+func TestTenantRouter(t *testing.T) {
+	router, err := NewTenantRouter([]TenantRoute{
+		{Prefix: "ops", Tenant: "ops", SourceTenants: []string{"infra", "default"}},
+		{Prefix: "restricted", Tenant: "restricted", SourceTenants: []string{"infra"}},
+		{Prefix: "teams.a", Tenant: "team-a", SourceTenants: []string{"*"}},
+		{Prefix: "teams.", Tenant: "teams", SourceTenants: []string{"*"}},
+		{Tag: "team=b", Tenant: "team-b", SourceTenants: []string{"*"}},
+	})
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		md        *schema.MetricData
+		source    string
+		expTenant string
+	}{
+		"allowed source tenant": {
+			md:        &schema.MetricData{Name: "ops.cpu"},
+			expTenant: "ops",
+		},
+		"other allowed source tenant": {
+			md:        &schema.MetricData{Name: "ops.cpu"},
+			source:    "infra",
+			expTenant: "ops",
+		},
+		"source tenant not allowed keeps the metric": {
+			md:        &schema.MetricData{Name: "restricted.cpu"},
+			expTenant: "default",
+		},
+		"prefix": {
+			md:        &schema.MetricData{Name: "teams.a.cpu"},
+			expTenant: "team-a",
+		},
+		"prefix is the whole path": {
+			md:        &schema.MetricData{Name: "teams.a"},
+			expTenant: "team-a",
+		},
+		"prefix matches whole nodes only": {
+			md:        &schema.MetricData{Name: "teams.ab.cpu"},
+			expTenant: "teams",
+		},
+		"prefix ending with a dot": {
+			md:        &schema.MetricData{Name: "teams.c.cpu"},
+			expTenant: "teams",
+		},
+		"tag": {
+			md:        &schema.MetricData{Name: "cpu", Tags: []string{"host=a", "team=b"}},
+			expTenant: "team-b",
+		},
+		"the first matching route wins": {
+			md:        &schema.MetricData{Name: "teams.a.cpu", Tags: []string{"team=b"}},
+			expTenant: "team-a",
+		},
+		"no match": {
+			md:        &schema.MetricData{Name: "servers.cpu", Tags: []string{"team=c"}},
+			expTenant: "default",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			source := tc.source
+			if source == "" {
+				source = "default"
+			}
+			assert.Equal(t, tc.expTenant, router.tenant(tc.md, source))
+		})
+	}
+}
+
+func TestTenantRouter_Split(t *testing.T) {
+	router, err := NewTenantRouter([]TenantRoute{{Prefix: "teams.a", Tenant: "team-a", SourceTenants: []string{"*"}}})
+	require.NoError(t, err)
+
+	metrics := []*schema.MetricData{
+		{Name: "servers.cpu"},
+		{Name: "teams.a.cpu"},
+		{Name: "servers.mem"},
+		{Name: "teams.a.mem"},
+	}
+	assert.Equal(t, []tenantBatch{
+		{tenant: "default", metrics: []*schema.MetricData{metrics[0], metrics[2]}},
+		{tenant: "team-a", metrics: []*schema.MetricData{metrics[1], metrics[3]}},
+	}, router.split(metrics, "default"))
+
+	// Without routes, the batch is written as a whole.
+	var noRouter *TenantRouter
+	assert.Equal(t, []tenantBatch{{tenant: "default", metrics: metrics}}, noRouter.split(metrics, "default"))
+}
+
+func TestNewTenantRouter_Validation(t *testing.T) {
+	for name, route := range map[string]TenantRoute{
+		"no prefix nor tag":   {Tenant: "team-a", SourceTenants: []string{"*"}},
+		"both prefix and tag": {Prefix: "teams.a", Tag: "team=a", Tenant: "team-a", SourceTenants: []string{"*"}},
+		"invalid tag":         {Tag: "team", Tenant: "team-a", SourceTenants: []string{"*"}},
+		"empty tag value":     {Tag: "team=", Tenant: "team-a", SourceTenants: []string{"*"}},
+		"no tenant":           {Prefix: "teams.a", SourceTenants: []string{"*"}},
+		"no source tenants":   {Prefix: "teams.a", Tenant: "team-a"},
+		"empty source tenant": {Prefix: "teams.a", Tenant: "team-a", SourceTenants: []string{""}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewTenantRouter([]TenantRoute{route})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRemoteWriteMetricsHandler_TenantRoutes(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{Name: "servers.cpu", Interval: 1, Value: 1, Time: 1600000000},
+		{Name: "teams.a.cpu", Interval: 1, Value: 2, Time: 1600000000},
+		{Name: "teams.a.mem", Interval: 1, Value: 3, Time: 1600000000},
+	}
+	body, err := json.Marshal(metrics)
+	require.NoError(t, err)
+
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+	recorderMock.On("measureIncomingSamples", "fake", 3).Return(nil)
+	recorderMock.On("measureConversionDuration", "fake", mock.Anything).Return(nil)
+	recorderMock.On("measureConversionDuration", "team-a", mock.Anything).Return(nil)
+	recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+	recorderMock.On("measureReceivedSamples", "fake", 3).Return(nil)
+	recorderMock.On("measureRoutedSamples", "fake", "team-a", 2).Return(nil)
+	defer recorderMock.AssertExpectations(t)
+
+	writes := map[string]int{}
+	remoteWriteMock := &remotewritemock.Client{}
+	remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		tenant, err := user.ExtractOrgID(args.Get(0).(context.Context))
+		require.NoError(t, err)
+		writes[tenant] += len(args.Get(1).(*mimirpb.WriteRequest).Timeseries)
+	}).Return(nil)
+
+	handler, err := NewRemoteWriteProxy(Config{TenantRoutes: []TenantRoute{
+		// The request tenant isn't allowed to write to ops.
+		{Prefix: "servers", Tenant: "ops", SourceTenants: []string{"ops"}},
+		{Prefix: "teams.a", Tenant: "team-a", SourceTenants: []string{"fake"}},
+	}}, remoteWriteMock, recorderMock, nil, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	require.JSONEq(t, `{"published":3}`, recorder.Body.String())
+	assert.Equal(t, map[string]int{"fake": 1, "team-a": 2}, writes)
+}
+
+func TestRemoteWriteMetricsHandler_TenantRoutesLimits(t *testing.T) {
+	metric := func(name string) *schema.MetricData {
+		return &schema.MetricData{Name: name, Interval: 1, Value: 1, Time: 1600000000}
+	}
+
+	for name, tc := range map[string]struct {
+		overrides      string
+		metrics        []*schema.MetricData
+		expectedStatus int
+		expectedReason string
+		expectedWrites map[string]int
+	}{
+		"limits of the routed tenant": {
+			overrides:      "overrides: {team-a: {max_name_length: 10}}",
+			metrics:        []*schema.MetricData{metric("servers.cpu.total"), metric("teams.a.cpu.total")},
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: reasonNameTooLong,
+			expectedWrites: map[string]int{},
+		},
+		"limits of the request tenant don't apply to routed metrics": {
+			overrides:      "overrides: {fake: {max_name_length: 10}}",
+			metrics:        []*schema.MetricData{metric("teams.a.cpu.total")},
+			expectedStatus: http.StatusOK,
+			expectedWrites: map[string]int{"team-a": 1},
+		},
+		"samples per request of the routed tenant": {
+			overrides:      "overrides: {team-a: {max_samples_per_request: 1}}",
+			metrics:        []*schema.MetricData{metric("servers.cpu"), metric("teams.a.cpu"), metric("teams.a.mem")},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedReason: reasonTooManySamples,
+			expectedWrites: map[string]int{},
+		},
+		"rate limit of the routed tenant": {
+			overrides:      "overrides: {team-a: {ingestion_rate: 1}}",
+			metrics:        []*schema.MetricData{metric("servers.cpu"), metric("teams.a.cpu"), metric("teams.a.mem")},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedReason: reasonRateLimited,
+			// The first sub-batch, within the burst of the routed tenant, is
+			// written.
+			expectedWrites: map[string]int{"fake": 1, "team-a": 1},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body, err := json.Marshal(tc.metrics)
+			require.NoError(t, err)
+
+			recorderMock := &MockRecorder{}
+			recorderMock.On("measureIncomingRequest", "fake").Return(nil)
+			recorderMock.On("measureIncomingSamples", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureConversionDuration", mock.Anything, mock.Anything).Return(nil)
+			recorderMock.On("measureReceivedRequest", "fake").Return(nil)
+			recorderMock.On("measureReceivedSamples", "fake", mock.Anything).Return(nil)
+			recorderMock.On("measureRoutedSamples", "fake", "team-a", mock.Anything).Return(nil)
+			recorderMock.On("measureRejectedSamples", "team-a", mock.Anything).Return(nil)
+
+			writes := map[string]int{}
+			remoteWriteMock := &remotewritemock.Client{}
+			remoteWriteMock.On("Write", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				tenant, err := user.ExtractOrgID(args.Get(0).(context.Context))
+				require.NoError(t, err)
+				writes[tenant] += len(args.Get(1).(*mimirpb.WriteRequest).Timeseries)
+			}).Return(nil)
+
+			overridesFile := filepath.Join(t.TempDir(), "overrides.yaml")
+			require.NoError(t, os.WriteFile(overridesFile, []byte(tc.overrides), 0o600))
+			overrides, err := NewOverrides(LimitsConfig{OverridesFile: overridesFile, OverridesReloadPeriod: time.Minute}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+			require.NoError(t, err)
+			_, stop := overrides.Handler()
+			t.Cleanup(func() { stop(nil) })
+			handler, err := NewRemoteWriteProxy(Config{TenantRoutes: []TenantRoute{
+				{Prefix: "teams.a", Tenant: "team-a", SourceTenants: []string{"fake"}},
+			}}, remoteWriteMock, recorderMock, overrides, nil)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			require.Equal(t, tc.expectedStatus, recorder.Code, recorder.Body.String())
+			assert.Equal(t, tc.expectedWrites, writes)
+			if tc.expectedReason != "" {
+				recorderMock.AssertCalled(t, "measureRejectedSamples", "team-a", tc.expectedReason)
+			}
+		})
+	}
+}
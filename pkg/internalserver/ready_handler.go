@@ -2,6 +2,7 @@ package internalserver
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -36,3 +37,29 @@ type AlwaysReady struct{}
 func (AlwaysReady) Ready() bool {
 	return true
 }
+
+// ReadinessProviders is ready when all of its providers are ready. Providers
+// can be added while it's in use.
+type ReadinessProviders struct {
+	mtx       sync.RWMutex
+	providers []ReadinessProvider
+}
+
+// Add a provider that must be ready.
+func (r *ReadinessProviders) Add(provider ReadinessProvider) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.providers = append(r.providers, provider)
+}
+
+// Ready implements ReadinessProvider.
+func (r *ReadinessProviders) Ready() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, provider := range r.providers {
+		if !provider.Ready() {
+			return false
+		}
+	}
+	return true
+}
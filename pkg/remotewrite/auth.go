@@ -0,0 +1,161 @@
+package remotewrite
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/crypto/tls"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/user"
+)
+
+// reservedHeaders are set by the client on every write, so can't be set as
+// static headers.
+var reservedHeaders = []string{
+	"Content-Encoding",
+	"Content-Type",
+	"User-Agent",
+	"X-Prometheus-Remote-Write-Version",
+	user.OrgIDHeaderName,
+}
+
+// AuthConfig configures the authentication of the writes to the remote write
+// endpoint, on top of the org ID of the write requests.
+type AuthConfig struct {
+	BasicAuthUsername string         `yaml:"basic_auth_username"`
+	BasicAuthPassword flagext.Secret `yaml:"basic_auth_password"`
+
+	// BearerTokenFile is read again whenever it changes, so the token can be
+	// rotated without restarting.
+	BearerTokenFile string `yaml:"bearer_token_file"`
+
+	// Headers are added to every write. They can only be set in the config
+	// file.
+	Headers map[string]string `yaml:"headers"`
+
+	// TLS configures the client certificates, which are also read again
+	// whenever the connections are established, and the CA bundle the server
+	// certificate is verified with.
+	TLS tls.ClientConfig `yaml:",inline"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it.
+func (c *AuthConfig) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	flags.StringVar(&c.BasicAuthUsername, prefix+"write-basic-auth-username", "", "Username of the basic authentication of the writes to the upstream remote write API.")
+	flags.Var(&c.BasicAuthPassword, prefix+"write-basic-auth-password", "Password of the basic authentication of the writes to the upstream remote write API.")
+	flags.StringVar(&c.BearerTokenFile, prefix+"write-bearer-token-file", "", "File with the bearer token of the writes to the upstream remote write API. The file is read again when it changes.")
+	flags.StringVar(&c.TLS.CertPath, prefix+"write-tls-cert-path", "", "Path to the client certificate authenticating the writes to the upstream remote write API. Also requires the key path to be configured.")
+	flags.StringVar(&c.TLS.KeyPath, prefix+"write-tls-key-path", "", "Path to the key of the client certificate. Also requires the client certificate to be configured.")
+	flags.StringVar(&c.TLS.CAPath, prefix+"write-tls-ca-path", "", "Path to the CA certificates to validate the certificate of the upstream remote write API against. If not set, the host's root CA certificates are used.")
+	flags.StringVar(&c.TLS.ServerName, prefix+"write-tls-server-name", "", "Override the expected name on the certificate of the upstream remote write API.")
+	flags.BoolVar(&c.TLS.InsecureSkipVerify, prefix+"write-tls-insecure-skip-verify", false, "Skip validating the certificate of the upstream remote write API.")
+}
+
+// Validate the config.
+func (c AuthConfig) Validate() error {
+	if c.BasicAuthUsername != "" && c.BearerTokenFile != "" {
+		return fmt.Errorf("basic auth and bearer token file can't be both set")
+	}
+	for name := range c.Headers {
+		for _, reserved := range reservedHeaders {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(reserved) {
+				return fmt.Errorf("header %s is set by the remote write client and can't be configured", name)
+			}
+		}
+		if http.CanonicalHeaderKey(name) == "Authorization" && (c.BasicAuthUsername != "" || c.BearerTokenFile != "") {
+			return fmt.Errorf("the Authorization header can't be set along with basic auth or a bearer token file")
+		}
+	}
+	return nil
+}
+
+// newAuthTransport returns a RoundTripper adding the authentication of the
+// config to the requests.
+func newAuthTransport(cfg AuthConfig, rt http.RoundTripper) http.RoundTripper {
+	if cfg.BasicAuthUsername == "" && cfg.BearerTokenFile == "" && len(cfg.Headers) == 0 {
+		return rt
+	}
+	t := &authTransport{
+		RoundTripper:      rt,
+		basicAuthUsername: cfg.BasicAuthUsername,
+		basicAuthPassword: cfg.BasicAuthPassword.String(),
+		headers:           cfg.Headers,
+	}
+	if cfg.BearerTokenFile != "" {
+		t.bearerToken = &fileToken{path: cfg.BearerTokenFile}
+	}
+	return t
+}
+
+// authTransport is a RoundTripper setting the authorization and static
+// headers of the requests.
+type authTransport struct {
+	http.RoundTripper
+
+	basicAuthUsername string
+	basicAuthPassword string
+	bearerToken       *fileToken
+	headers           map[string]string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	if t.basicAuthUsername != "" {
+		req.SetBasicAuth(t.basicAuthUsername, t.basicAuthPassword)
+	}
+	if t.bearerToken != nil {
+		token, err := t.bearerToken.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// fileToken is a token read from a file, read again whenever the modification
+// time or the size of the file change.
+type fileToken struct {
+	path string
+
+	mtx     sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+func (t *fileToken) get() (string, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return "", fmt.Errorf("can't read bearer token file: %w", err)
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.token != "" && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.token, nil
+	}
+
+	buf, err := os.ReadFile(t.path)
+	if err != nil {
+		return "", fmt.Errorf("can't read bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", t.path)
+	}
+	t.token, t.modTime, t.size = token, info.ModTime(), info.Size()
+	return t.token, nil
+}
@@ -5,10 +5,13 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +20,7 @@ import (
 
 	"github.com/grafana/mimir-graphite/v2/pkg/appcommon"
 
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
+	"github.com/grafana/dskit/crypto/tls"
 	"github.com/grafana/dskit/user"
 	"github.com/grafana/mimir/pkg/mimirpb"
 	"github.com/mwitkow/go-conntrack"
@@ -34,7 +36,17 @@ const (
 	maxErrMsgLen = 512
 )
 
-const defaultWriteTimeout = 1 * time.Second
+const (
+	defaultWriteTimeout = 1 * time.Second
+
+	defaultMaxRetries = 3
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 2 * time.Second
+
+	retryReasonNetwork   = "network"
+	retryReasonServer    = "5xx"
+	retryReasonRateLimit = "429"
+)
 
 // Client provides Prometheus Remote Write API access functionality
 //
@@ -51,6 +63,24 @@ type Config struct {
 	MaxConns            int           `yaml:"max_conns"`
 	SkipLabelValidation bool          `yaml:"skip_label_validation"`
 	UserAgent           string        `yaml:"user_agent"`
+
+	// ProtocolVersion is the Prometheus Remote Write protocol version, 1.0 or
+	// 2.0. Remote Write 2.0 interns the label names and values, so the highly
+	// repetitive Graphite node labels are only sent once per request.
+	ProtocolVersion string `yaml:"protocol_version"`
+
+	// MaxRetries is the number of times a write failing because of a network
+	// error, a 5xx or a 429 response is retried, waiting for a jittered
+	// exponential backoff between MinBackoff and MaxBackoff, or the
+	// Retry-After of 429 responses capped to MaxBackoff. Retries never outlive
+	// the write context.
+	MaxRetries int           `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	Auth     AuthConfig     `yaml:",inline"`
+	Sharding ShardingConfig `yaml:"sharding"`
+	Queue    QueueConfig    `yaml:"queue"`
 }
 
 // RegisterFlags implements flagext.Registerer
@@ -74,6 +104,13 @@ func (c *Config) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
 	flags.IntVar(&c.MaxConns, prefix+"write-max-conns", 100, "Max open conns per host for writes to upstream Prometheus remote write API.")
 	flags.BoolVar(&c.SkipLabelValidation, prefix+"skip-label-validation", false, "If set to true sends requests with headers to skip label validation.")
 	flags.StringVar(&c.UserAgent, prefix+"user-agent", "", "User agent for proxy ingester")
+	flags.StringVar(&c.ProtocolVersion, prefix+"write-protocol-version", ProtocolVersion1, "Prometheus Remote Write protocol version of the writes to the upstream remote write API, 1.0 or 2.0.")
+	flags.IntVar(&c.MaxRetries, prefix+"write-max-retries", defaultMaxRetries, "Maximum number of retries of writes failing with network errors, 5xx or 429 responses. 0 to disable.")
+	flags.DurationVar(&c.MinBackoff, prefix+"write-min-backoff", defaultMinBackoff, "Minimum backoff between write retries.")
+	flags.DurationVar(&c.MaxBackoff, prefix+"write-max-backoff", defaultMaxBackoff, "Maximum backoff between write retries, also capping the Retry-After of 429 responses.")
+	c.Auth.RegisterFlagsWithPrefix(prefix, flags)
+	c.Sharding.RegisterFlagsWithPrefix(prefix, flags)
+	c.Queue.RegisterFlagsWithPrefix(prefix, flags)
 }
 
 // NewClient creates the default http implementation of the Client
@@ -82,6 +119,16 @@ func NewClient(cfg Config, metricsRecorder Recorder, tripperware querymiddleware
 	if err != nil {
 		return nil, err
 	}
+	switch cfg.ProtocolVersion {
+	case "":
+		cfg.ProtocolVersion = ProtocolVersion1
+	case ProtocolVersion1, ProtocolVersion2:
+	default:
+		return nil, fmt.Errorf("invalid remote write protocol version %q, must be %q or %q", cfg.ProtocolVersion, ProtocolVersion1, ProtocolVersion2)
+	}
+	if err := cfg.Auth.Validate(); err != nil {
+		return nil, err
+	}
 
 	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
 	httpTransport.MaxIdleConnsPerHost = cfg.MaxIdleConns
@@ -96,7 +143,14 @@ func NewClient(cfg Config, metricsRecorder Recorder, tripperware querymiddleware
 		}),
 	)
 
-	transport := appcommon.NewTracedAuthRoundTripper(httpTransport, "Remote Write")
+	if cfg.Auth.TLS != (tls.ClientConfig{}) {
+		httpTransport.TLSClientConfig, err = cfg.Auth.TLS.GetTLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote write TLS config: %w", err)
+		}
+	}
+
+	transport := appcommon.NewTracedAuthRoundTripper(newAuthTransport(cfg.Auth, httpTransport), "Remote Write")
 	if tripperware != nil {
 		transport = tripperware(transport)
 	}
@@ -122,15 +176,63 @@ type client struct {
 // Inspired by https://github.com/prometheus/prometheus/blob/7bf76af6dffc020fb7c4d489694bb8db0a223add/storage/remote/client.go#L162-L220
 // Plus added proto marshaling and snappy encoding
 func (c *client) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
-	// TODO: use a pool of proto.Buffer here when performance becomes a priority
-	data, err := proto.Marshal(req)
+	compressed, err := encodeWriteRequest(req, c.cfg.ProtocolVersion)
 	if err != nil {
 		return errorx.Internal{Msg: "can't marshal write request", Err: err}
 	}
+	defer putBuffer(compressed)
+	sent := requestStats(req)
+
+	for retries := 0; ; retries++ {
+		err := c.attempt(ctx, compressed, sent)
+
+		var recoverable recoverableError
+		if err == nil || !errors.As(err, &recoverable) {
+			return err
+		}
+		if retries >= c.cfg.MaxRetries {
+			return recoverable
+		}
+
+		delay := recoverable.retryAfter
+		if delay <= 0 {
+			delay = c.backoff(retries)
+		} else if delay > c.cfg.MaxBackoff {
+			// Writes of the proxy have no deadline, so a long Retry-After
+			// would hold the request of the client.
+			delay = c.cfg.MaxBackoff
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return recoverable
+		}
+
+		c.recorder.measureRetry(recoverable.reason)
+		select {
+		case <-ctx.Done():
+			return recoverable
+		case <-time.After(delay):
+		}
+	}
+}
 
-	// TODO: use a pool of buffers here when performance becomes a priority
-	compressed := snappy.Encode(nil, data)
+// backoff returns the jittered exponential backoff before the given retry,
+// between half and all of the exponential delay.
+func (c *client) backoff(retries int) time.Duration {
+	delay := c.cfg.MinBackoff
+	for i := 0; i < retries && delay < c.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.cfg.MaxBackoff {
+		delay = c.cfg.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) //nolint:gosec
+}
 
+// attempt sends the compressed write request once.
+func (c *client) attempt(ctx context.Context, compressed []byte, sent writeStats) error {
 	httpReq, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(compressed))
 	if err != nil {
 		// Errors from NewRequest are from unparsable URLs, so are not
@@ -139,9 +241,14 @@ func (c *client) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
 	}
 
 	httpReq.Header.Add("Content-Encoding", "snappy")
-	httpReq.Header.Set("Content-Type", "application/x-protobuf")
 	httpReq.Header.Set("User-Agent", c.cfg.UserAgent)
-	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if c.cfg.ProtocolVersion == ProtocolVersion2 {
+		httpReq.Header.Set("Content-Type", contentTypeWriteV2Protobuf)
+		httpReq.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion2HeaderValue)
+	} else {
+		httpReq.Header.Set("Content-Type", contentTypeProtobuf)
+		httpReq.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion1HeaderValue)
+	}
 	if c.cfg.SkipLabelValidation {
 		httpReq.Header.Set(distributor.SkipLabelNameValidationHeader, "true")
 	}
@@ -164,15 +271,18 @@ func (c *client) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
 		defer ht.Finish()
 	}
 
-	return c.do(httpReq)
+	return c.do(httpReq, sent)
 }
 
-func (c *client) do(httpReq *http.Request) error {
+func (c *client) do(httpReq *http.Request, sent writeStats) error {
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
 		// Errors from Client.Do are from (for example) network errors, so are
 		// recoverable.
-		return errorx.Internal{Msg: "can't perform metrics write request", Err: err}
+		return recoverableError{
+			error:  errorx.Internal{Msg: "can't perform metrics write request", Err: err},
+			reason: retryReasonNetwork,
+		}
 	}
 	defer func() {
 		_, _ = io.Copy(io.Discard, resp.Body)
@@ -182,6 +292,16 @@ func (c *client) do(httpReq *http.Request) error {
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return c.errFromResp(resp)
 	}
+
+	written, ok := writtenStats(resp.Header)
+	if !ok && c.cfg.ProtocolVersion == ProtocolVersion2 && !sent.empty() {
+		// Remote Write 2.0 receivers always report what they wrote, this is
+		// most likely a 1.0 receiver that ignored the whole request.
+		return errorx.Internal{Msg: "remote write API didn't report any written data, it may not support Remote Write 2.0"}
+	}
+	if ok {
+		c.recorder.measureWritten(written.samples, written.histograms, written.exemplars)
+	}
 	return nil
 }
 
@@ -201,8 +321,47 @@ func (c *client) errFromResp(resp *http.Response) error {
 	}
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		return errorx.TooManyRequests{Msg: "too many write requests", Err: err}
+		return recoverableError{
+			error:      errorx.TooManyRequests{Msg: "too many write requests", Err: err},
+			reason:     retryReasonRateLimit,
+			retryAfter: retryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return recoverableError{
+			error:  errorx.Internal{Msg: "failed writing metrics", Err: err},
+			reason: retryReasonServer,
+		}
 	}
 
 	return errorx.Internal{Msg: "failed writing metrics", Err: err}
 }
+
+// recoverableError is the error of a write attempt that can be retried. It's
+// still returned once the retries are exhausted, so that the write queue can
+// tell the writes worth sending again from those that will never succeed.
+type recoverableError struct {
+	error
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e recoverableError) Unwrap() error {
+	return e.error
+}
+
+// retryAfter parses a Retry-After header value, either a number of seconds or
+// an HTTP date. It returns 0 if the header is not set or invalid.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -122,6 +122,152 @@ func TestHTTPRemoteWriteClient_Write(t *testing.T) {
 	})
 }
 
+func TestHTTPRemoteWriteClient_Retries(t *testing.T) {
+	for name, tc := range map[string]struct {
+		responses     []int
+		retryAfter    string
+		maxRetries    int
+		maxBackoff    time.Duration
+		expRequests   int
+		expRetries    map[string]int
+		expErr        interface{}
+		expMinElapsed time.Duration
+		expMaxElapsed time.Duration
+	}{
+		"retries 5xx until success": {
+			responses:   []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+			maxRetries:  3,
+			expRequests: 3,
+			expRetries:  map[string]int{"5xx": 2},
+		},
+		"gives up after max retries": {
+			responses:   []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			maxRetries:  2,
+			expRequests: 3,
+			expRetries:  map[string]int{"5xx": 2},
+			expErr:      &errorx.Internal{},
+		},
+		"retries 429 honouring retry-after": {
+			responses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter:    "1",
+			maxRetries:    1,
+			maxBackoff:    2 * time.Second,
+			expRequests:   2,
+			expRetries:    map[string]int{"429": 1},
+			expMinElapsed: time.Second,
+		},
+		"caps retry-after to the max backoff": {
+			responses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter:    "3600",
+			maxRetries:    1,
+			expRequests:   2,
+			expRetries:    map[string]int{"429": 1},
+			expMaxElapsed: time.Second,
+		},
+		"returns 429 after max retries": {
+			responses:   []int{http.StatusTooManyRequests},
+			maxRetries:  0,
+			expRequests: 1,
+			expErr:      &errorx.TooManyRequests{},
+		},
+		"doesn't retry 4xx": {
+			responses:   []int{http.StatusUnauthorized},
+			maxRetries:  3,
+			expRequests: 1,
+			expErr:      &errorx.Internal{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				status := tc.responses[requests]
+				requests++
+				if tc.retryAfter != "" {
+					rw.Header().Set("Retry-After", tc.retryAfter)
+				}
+				rw.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			recorderMock := &MockRecorder{}
+			for reason, count := range tc.expRetries {
+				recorderMock.On("measureRetry", reason).Times(count).Return(nil)
+			}
+			defer recorderMock.AssertExpectations(t)
+
+			maxBackoff := tc.maxBackoff
+			if maxBackoff == 0 {
+				maxBackoff = 10 * time.Millisecond
+			}
+			client, err := NewClient(Config{
+				Endpoint:   srv.URL,
+				Timeout:    time.Second,
+				MaxRetries: tc.maxRetries,
+				MinBackoff: time.Millisecond,
+				MaxBackoff: maxBackoff,
+			}, recorderMock, nil)
+			require.NoError(t, err)
+
+			start := time.Now()
+			err = client.Write(user.InjectOrgID(context.Background(), "some-org-id"), &mimirpb.WriteRequest{})
+			if tc.expErr != nil {
+				require.ErrorAs(t, err, tc.expErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.expRequests, requests)
+			assert.GreaterOrEqual(t, time.Since(start), tc.expMinElapsed)
+			if tc.expMaxElapsed > 0 {
+				assert.Less(t, time.Since(start), tc.expMaxElapsed)
+			}
+		})
+	}
+}
+
+func TestHTTPRemoteWriteClient_RetriesBoundByContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Retry-After", "60")
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		Endpoint:   srv.URL,
+		Timeout:    time.Second,
+		MaxRetries: 3,
+		MaxBackoff: time.Minute,
+	}, &MockRecorder{}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(user.InjectOrgID(context.Background(), "some-org-id"), time.Second)
+	defer cancel()
+
+	// The retry-after is longer than the context deadline, so there is no
+	// point waiting for it.
+	start := time.Now()
+	err = client.Write(ctx, &mimirpb.WriteRequest{})
+	require.ErrorAs(t, err, &errorx.TooManyRequests{})
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter("soon"))
+	assert.Equal(t, 5*time.Second, retryAfter("5"))
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, time.Minute, retryAfter(date), float64(2*time.Second))
+}
+
+func TestClientBackoff(t *testing.T) {
+	c := &client{cfg: Config{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for retries, expMax := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		delay := c.backoff(retries)
+		assert.GreaterOrEqual(t, delay, expMax/2)
+		assert.LessOrEqual(t, delay, expMax)
+	}
+}
+
 const outOfOrderSampleResponseText = "user=41413: err: out of order sample. " +
 	`timestamp=2021-02-16T10:07:30Z, series={__name__=\"my_proxy_dot_statsd_dot_client_dot_events\", ` +
 	`client=\"go\", client__transport=\"udp\", client__version=\"4.2.0\", ` +
@@ -0,0 +1,65 @@
+package remotewrite
+
+import (
+	"github.com/golang/snappy"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/prometheus/util/pool"
+)
+
+const (
+	minPooledBufferSize = 1 << 10
+	maxPooledBufferSize = 1 << 28
+)
+
+// bufferPool keeps the buffers of the marshalled and compressed write
+// requests, in size classes doubling from 1KiB to 256MiB so that small
+// requests don't hold on to large buffers. Larger buffers aren't pooled.
+var bufferPool = pool.New(minPooledBufferSize, maxPooledBufferSize, 2, func(size int) interface{} {
+	return make([]byte, 0, size)
+})
+
+// getBuffer returns a pooled buffer of the given length.
+func getBuffer(size int) []byte {
+	buf := bufferPool.Get(size).([]byte)
+	if cap(buf) < size {
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
+
+// putBuffer returns a buffer from getBuffer to the pool.
+func putBuffer(buf []byte) {
+	bufferPool.Put(buf) //nolint:staticcheck
+}
+
+// sizedMarshaler is implemented by the gogo protobuf messages.
+type sizedMarshaler interface {
+	Size() int
+	MarshalToSizedBuffer([]byte) (int, error)
+}
+
+// encodeWriteRequest marshals and compresses the write request in the given
+// protocol version. The returned buffer must be released with putBuffer once
+// it's not used anymore.
+func encodeWriteRequest(req *mimirpb.WriteRequest, protocolVersion string) ([]byte, error) {
+	var msg sizedMarshaler = req
+	if protocolVersion == ProtocolVersion2 {
+		msg = toWriteV2Request(req)
+	}
+
+	data := getBuffer(msg.Size())
+	defer putBuffer(data)
+	n, err := msg.MarshalToSizedBuffer(data)
+	if err != nil {
+		return nil, err
+	}
+	// The message is marshalled from the end of the buffer.
+	data = data[len(data)-n:]
+
+	maxEncodedLen := snappy.MaxEncodedLen(len(data))
+	if maxEncodedLen < 0 {
+		return nil, snappy.ErrTooLarge
+	}
+	// Encode uses the buffer as it's large enough for any input.
+	return snappy.Encode(getBuffer(maxEncodedLen), data), nil
+}
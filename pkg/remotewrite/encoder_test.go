@@ -0,0 +1,163 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkWriteRequest returns a request with the given number of untagged
+// Graphite series, like servers.<dc>.<host>.cpu.<metric>.
+func benchmarkWriteRequest(series int) *mimirpb.WriteRequest {
+	req := &mimirpb.WriteRequest{Timeseries: make([]mimirpb.PreallocTimeseries, 0, series)}
+	for i := 0; i < series; i++ {
+		req.Timeseries = append(req.Timeseries, mimirpb.PreallocTimeseries{TimeSeries: &mimirpb.TimeSeries{
+			Labels: []mimirpb.LabelAdapter{
+				{Name: "__n000__", Value: "servers"},
+				{Name: "__n001__", Value: fmt.Sprintf("dc%d", i%4)},
+				{Name: "__n002__", Value: fmt.Sprintf("host%d", i/10)},
+				{Name: "__n003__", Value: "cpu"},
+				{Name: "__n004__", Value: fmt.Sprintf("metric%d", i%10)},
+				{Name: "__name__", Value: "graphite_untagged"},
+			},
+			Samples: []mimirpb.Sample{{Value: float64(i), TimestampMs: 1600000000000}},
+		}})
+	}
+	return req
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	req := benchmarkWriteRequest(100)
+
+	t.Run("1.0", func(t *testing.T) {
+		compressed, err := encodeWriteRequest(req, ProtocolVersion1)
+		require.NoError(t, err)
+		defer putBuffer(compressed)
+
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		var decoded mimirpb.WriteRequest
+		require.NoError(t, decoded.Unmarshal(data))
+		assertSameSeries(t, req.Timeseries, decoded.Timeseries)
+	})
+
+	t.Run("2.0", func(t *testing.T) {
+		compressed, err := encodeWriteRequest(req, ProtocolVersion2)
+		require.NoError(t, err)
+		defer putBuffer(compressed)
+
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		var decoded writev2.Request
+		require.NoError(t, decoded.Unmarshal(data))
+		assert.Len(t, decoded.Timeseries, 100)
+	})
+
+	t.Run("reused buffers", func(t *testing.T) {
+		// A buffer from a larger request is reused for a smaller one.
+		large, err := encodeWriteRequest(req, ProtocolVersion1)
+		require.NoError(t, err)
+		putBuffer(large)
+
+		small := benchmarkWriteRequest(1)
+		compressed, err := encodeWriteRequest(small, ProtocolVersion1)
+		require.NoError(t, err)
+		defer putBuffer(compressed)
+
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		var decoded mimirpb.WriteRequest
+		require.NoError(t, decoded.Unmarshal(data))
+		assertSameSeries(t, small.Timeseries, decoded.Timeseries)
+	})
+}
+
+func assertSameSeries(t *testing.T, expected, actual []mimirpb.PreallocTimeseries) {
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		assert.Equal(t, expected[i].Labels, actual[i].Labels)
+		assert.Equal(t, expected[i].Samples, actual[i].Samples)
+	}
+}
+
+var benchmarkSeries = []int{1_000, 10_000, 100_000}
+
+func BenchmarkEncodeWriteRequest(b *testing.B) {
+	for _, series := range benchmarkSeries {
+		req := benchmarkWriteRequest(series)
+
+		b.Run(fmt.Sprintf("series=%d/pooled", series), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				compressed, err := encodeWriteRequest(req, ProtocolVersion1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				putBuffer(compressed)
+			}
+		})
+
+		// The encoding before the buffers were pooled, as a baseline.
+		b.Run(fmt.Sprintf("series=%d/unpooled", series), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := req.Marshal()
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = snappy.Encode(nil, data)
+			}
+		})
+
+		b.Run(fmt.Sprintf("series=%d/pooled-v2", series), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				compressed, err := encodeWriteRequest(req, ProtocolVersion2)
+				if err != nil {
+					b.Fatal(err)
+				}
+				putBuffer(compressed)
+			}
+		})
+	}
+}
+
+func BenchmarkClientWrite(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measureWritten", mock.Anything, mock.Anything, mock.Anything)
+	client, err := NewClient(Config{Endpoint: srv.URL, Timeout: 10 * time.Second}, recorderMock, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := user.InjectOrgID(context.Background(), "some-org-id")
+
+	for _, series := range benchmarkSeries {
+		req := benchmarkWriteRequest(series)
+		b.Run(fmt.Sprintf("series=%d", series), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := client.Write(ctx, req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+const (
+	// FanOutPolicyAll acknowledges the writes once all the destinations
+	// succeeded.
+	FanOutPolicyAll = "all"
+	// FanOutPolicyAny acknowledges the writes once any of the destinations
+	// succeeded.
+	FanOutPolicyAny = "any"
+	// FanOutPolicyPrimary acknowledges the writes once the first destination
+	// succeeded, the others are mirrors written on a best effort basis.
+	FanOutPolicyPrimary = "primary"
+)
+
+// DestinationConfig is a remote write destination other than the main one.
+// Destinations are configured in the config file only, the fields not set
+// there take the default values of the flags of the main destination.
+type DestinationConfig struct {
+	// Name identifies the destination in the metrics.
+	Name string `yaml:"name"`
+	// OrgID, if set, is the tenant the writes are sent as to this destination,
+	// instead of the tenant of the write request.
+	OrgID string `yaml:"org_id"`
+
+	Config `yaml:",inline"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, setting the default values of
+// the fields absent from the YAML.
+func (c *DestinationConfig) UnmarshalYAML(value *yaml.Node) error {
+	flagext.DefaultValues(&c.Config)
+	type plain DestinationConfig
+	return value.Decode((*plain)(c))
+}
+
+// Destination is a named client the fan-out client writes to.
+type Destination struct {
+	Name   string
+	Client Client
+}
+
+// NewFanOutClient returns a Client writing each request concurrently to all
+// the destinations. The policy chooses which of them must succeed for the
+// write to succeed. With the all policy, the write returns once all the
+// destinations are done, each bounded by its own timeout. With the any and
+// primary policies, it returns as soon as the policy is decided, so a slow
+// mirror doesn't hold back the acknowledgement: the other writes carry on
+// detached from the request, still bounded by the timeout and retries of
+// their destination.
+func NewFanOutClient(policy string, destinations []Destination, prefix string, reg prometheus.Registerer) (Client, error) {
+	switch policy {
+	case FanOutPolicyAll, FanOutPolicyAny, FanOutPolicyPrimary:
+	default:
+		return nil, fmt.Errorf("invalid remote write policy %q, must be %q, %q or %q", policy, FanOutPolicyAll, FanOutPolicyAny, FanOutPolicyPrimary)
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("no remote write destinations")
+	}
+	names := map[string]bool{}
+	for _, d := range destinations {
+		if d.Name == "" {
+			return nil, fmt.Errorf("remote write destinations must have a name")
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("duplicate remote write destination %q", d.Name)
+		}
+		names[d.Name] = true
+	}
+
+	c := &fanOutClient{
+		policy:       policy,
+		destinations: destinations,
+		writes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix + "_remote_write_destination",
+			Name:      "writes_total",
+			Help:      "The total number of writes to each remote write destination, by result.",
+		}, []string{"destination", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prefix + "_remote_write_destination",
+			Name:      "write_duration_seconds",
+			Help:      "Duration of the writes to each remote write destination.",
+		}, []string{"destination"}),
+		timeNow: time.Now,
+	}
+	for _, collector := range []prometheus.Collector{c.writes, c.duration} {
+		if err := reg.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type fanOutClient struct {
+	policy       string
+	destinations []Destination
+
+	writes   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	timeNow  func() time.Time
+}
+
+// destinationResult is the result of the write to the destination at index.
+type destinationResult struct {
+	index int
+	err   error
+}
+
+func (c *fanOutClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	var (
+		writeCtx = ctx
+		writeReq = req
+		// canceled stays nil, blocking forever, unless the write can return
+		// before all the destinations are done.
+		canceled <-chan struct{}
+	)
+	if c.policy != FanOutPolicyAll {
+		// The caller reuses the request once the write returns, so the
+		// destinations still writing need their own copy.
+		var err error
+		if writeReq, err = cloneWriteRequest(req); err != nil {
+			return errorx.Internal{Msg: "can't copy write request", Err: err}
+		}
+		writeCtx = context.WithoutCancel(ctx)
+		canceled = ctx.Done()
+	}
+
+	results := make(chan destinationResult, len(c.destinations))
+	for i, d := range c.destinations {
+		go func(i int, d Destination) {
+			start := c.timeNow()
+			err := d.Client.Write(writeCtx, writeReq)
+			c.duration.WithLabelValues(d.Name).Observe(c.timeNow().Sub(start).Seconds())
+
+			result := "success"
+			if err != nil {
+				result = "failure"
+			}
+			c.writes.WithLabelValues(d.Name, result).Inc()
+			results <- destinationResult{index: i, err: err}
+		}(i, d)
+	}
+
+	var (
+		errs = make([]error, len(c.destinations))
+		done = make([]bool, len(c.destinations))
+	)
+	for range c.destinations {
+		select {
+		case res := <-results:
+			errs[res.index], done[res.index] = res.err, true
+		case <-canceled:
+			return ctx.Err()
+		}
+		if c.decided(done, errs) {
+			break
+		}
+	}
+	return c.mergeErrors(errs)
+}
+
+// decided returns whether the result of the write is known from the
+// destinations done so far.
+func (c *fanOutClient) decided(done []bool, errs []error) bool {
+	switch c.policy {
+	case FanOutPolicyPrimary:
+		return done[0]
+	case FanOutPolicyAny:
+		for i := range done {
+			if done[i] && errs[i] == nil {
+				return true
+			}
+		}
+	}
+	for i := range done {
+		if !done[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneWriteRequest returns a deep copy of req.
+func cloneWriteRequest(req *mimirpb.WriteRequest) (*mimirpb.WriteRequest, error) {
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	clone := &mimirpb.WriteRequest{}
+	if err := clone.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// mergeErrors returns the error of the write according to the policy.
+func (c *fanOutClient) mergeErrors(errs []error) error {
+	switch c.policy {
+	case FanOutPolicyPrimary:
+		if errs[0] != nil {
+			return fmt.Errorf("primary remote write destination %s failed: %w", c.destinations[0].Name, errs[0])
+		}
+		return nil
+	case FanOutPolicyAny:
+		merged, failed := mostSevereError(errs)
+		if failed < len(errs) {
+			return nil
+		}
+		return fmt.Errorf("all %d remote write destinations failed: %w", failed, merged)
+	default:
+		merged, failed := mostSevereError(errs)
+		if failed == 0 {
+			return nil
+		}
+		return fmt.Errorf("%d of %d remote write destinations failed: %w", failed, len(errs), merged)
+	}
+}
+
+// NewTenantClient returns a Client writing to the given client as the given
+// tenant, whatever the tenant of the write request.
+func NewTenantClient(client Client, orgID string) Client {
+	return &tenantClient{client: client, orgID: orgID}
+}
+
+type tenantClient struct {
+	client Client
+	orgID  string
+}
+
+func (c *tenantClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	return c.client.Write(user.InjectOrgID(ctx, c.orgID), req)
+}
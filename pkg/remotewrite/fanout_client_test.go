@@ -0,0 +1,249 @@
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+func TestFanOutClient_Policies(t *testing.T) {
+	badRequest := errorx.BadRequest{Msg: "bad metrics write request"}
+	internal := errorx.Internal{Msg: "failed writing metrics"}
+
+	for name, tc := range map[string]struct {
+		policy string
+		errs   []error
+		expErr error
+	}{
+		"all, no errors": {
+			policy: FanOutPolicyAll,
+			errs:   []error{nil, nil, nil},
+		},
+		"all, a mirror failed": {
+			policy: FanOutPolicyAll,
+			errs:   []error{nil, badRequest, nil},
+			expErr: badRequest,
+		},
+		"all, the most severe error is returned": {
+			policy: FanOutPolicyAll,
+			errs:   []error{badRequest, internal, nil},
+			expErr: internal,
+		},
+		"any, a destination succeeded": {
+			policy: FanOutPolicyAny,
+			errs:   []error{internal, nil, badRequest},
+		},
+		"any, all destinations failed": {
+			policy: FanOutPolicyAny,
+			errs:   []error{badRequest, internal, badRequest},
+			expErr: internal,
+		},
+		"primary, mirrors failed": {
+			policy: FanOutPolicyPrimary,
+			errs:   []error{nil, internal, internal},
+		},
+		"primary, primary failed": {
+			policy: FanOutPolicyPrimary,
+			errs:   []error{badRequest, nil, nil},
+			expErr: badRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var (
+				destinations []Destination
+				clients      []*fakeClient
+			)
+			for i, err := range tc.errs {
+				client := &fakeClient{}
+				if err != nil {
+					client.errs = []error{err}
+				}
+				clients = append(clients, client)
+				destinations = append(destinations, Destination{Name: []string{"primary", "mirror-1", "mirror-2"}[i], Client: client})
+			}
+
+			underTest, err := NewFanOutClient(tc.policy, destinations, "test", prometheus.NewPedanticRegistry())
+			require.NoError(t, err)
+			err = underTest.Write(user.InjectOrgID(context.Background(), "some-org-id"), testWriteRequest("series_1"))
+			if tc.expErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tc.expErr), "expected %v, got %v", tc.expErr, err)
+			}
+
+			// All the destinations are written whatever the policy.
+			for i, client := range clients {
+				if tc.errs[i] == nil {
+					require.Eventually(t, func() bool {
+						return client.receivedSamples() == 1
+					}, 5*time.Second, 10*time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestFanOutClient_Metrics(t *testing.T) {
+	destinations := []Destination{
+		{Name: "primary", Client: &fakeClient{}},
+		{Name: "mirror", Client: &fakeClient{errs: []error{errorx.Internal{Msg: "failed writing metrics"}}}},
+	}
+	underTest, err := NewFanOutClient(FanOutPolicyPrimary, destinations, "test", prometheus.NewPedanticRegistry())
+	require.NoError(t, err)
+
+	ctx := user.InjectOrgID(context.Background(), "some-org-id")
+	require.NoError(t, underTest.Write(ctx, testWriteRequest("series_1")))
+	require.NoError(t, underTest.Write(ctx, testWriteRequest("series_1")))
+
+	writes := underTest.(*fanOutClient).writes
+	// The mirror may still be writing once the writes returned.
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(writes.WithLabelValues("mirror", "success")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(2), testutil.ToFloat64(writes.WithLabelValues("primary", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(writes.WithLabelValues("mirror", "failure")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(writes.WithLabelValues("mirror", "success")))
+}
+
+// blockingClient blocks the writes until released, recording the series it
+// receives then.
+type blockingClient struct {
+	fakeClient
+	release chan struct{}
+	ctxErr  chan error
+}
+
+func (c *blockingClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	<-c.release
+	c.ctxErr <- ctx.Err()
+	return c.fakeClient.Write(ctx, req)
+}
+
+func TestFanOutClient_BlockingMirror(t *testing.T) {
+	for _, policy := range []string{FanOutPolicyPrimary, FanOutPolicyAny} {
+		t.Run(policy, func(t *testing.T) {
+			primary := &fakeClient{}
+			mirror := &blockingClient{release: make(chan struct{}), ctxErr: make(chan error, 1)}
+			underTest, err := NewFanOutClient(policy, []Destination{
+				{Name: "primary", Client: primary},
+				{Name: "mirror", Client: mirror},
+			}, "test", prometheus.NewPedanticRegistry())
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(user.InjectOrgID(context.Background(), "some-org-id"))
+			req := testWriteRequest("series_1")
+			done := make(chan error)
+			go func() {
+				done <- underTest.Write(ctx, req)
+			}()
+
+			// The write is acknowledged once the primary succeeded.
+			select {
+			case err := <-done:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "the write is held by the mirror")
+			}
+			assert.Equal(t, 1, primary.receivedSamples())
+
+			// The request ending and being reused doesn't affect the mirror.
+			cancel()
+			req.Timeseries[0].Labels[0].Value = "reused"
+			close(mirror.release)
+			require.NoError(t, <-mirror.ctxErr)
+			require.Eventually(t, func() bool {
+				return mirror.receivedSamples() == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, map[string][]string{"some-org-id": {"series_1"}}, mirror.received())
+		})
+	}
+}
+
+func TestFanOutClient_AllWaitsForEveryDestination(t *testing.T) {
+	mirror := &blockingClient{release: make(chan struct{}), ctxErr: make(chan error, 1)}
+	underTest, err := NewFanOutClient(FanOutPolicyAll, []Destination{
+		{Name: "primary", Client: &fakeClient{}},
+		{Name: "mirror", Client: mirror},
+	}, "test", prometheus.NewPedanticRegistry())
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- underTest.Write(user.InjectOrgID(context.Background(), "some-org-id"), testWriteRequest("series_1"))
+	}()
+	select {
+	case <-done:
+		require.FailNow(t, "the write returned before the mirror was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(mirror.release)
+	require.NoError(t, <-done)
+	assert.Equal(t, 1, mirror.receivedSamples())
+}
+
+func TestNewFanOutClient_Validation(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy       string
+		destinations []Destination
+	}{
+		"invalid policy": {
+			policy:       "most",
+			destinations: []Destination{{Name: "primary", Client: &fakeClient{}}},
+		},
+		"no destinations": {
+			policy: FanOutPolicyAll,
+		},
+		"unnamed destination": {
+			policy:       FanOutPolicyAll,
+			destinations: []Destination{{Name: "primary", Client: &fakeClient{}}, {Client: &fakeClient{}}},
+		},
+		"duplicate destination": {
+			policy:       FanOutPolicyAll,
+			destinations: []Destination{{Name: "primary", Client: &fakeClient{}}, {Name: "primary", Client: &fakeClient{}}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewFanOutClient(tc.policy, tc.destinations, "test", prometheus.NewPedanticRegistry())
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestTenantClient(t *testing.T) {
+	client := &fakeClient{}
+	underTest := NewTenantClient(client, "mirror-org-id")
+	require.NoError(t, underTest.Write(user.InjectOrgID(context.Background(), "some-org-id"), testWriteRequest("series_1")))
+	assert.Equal(t, map[string][]string{"mirror-org-id": {"series_1"}}, client.series)
+}
+
+func TestDestinationConfig_UnmarshalYAML(t *testing.T) {
+	var cfg []DestinationConfig
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- name: mirror
+  org_id: mirror-org-id
+  endpoint: http://mirror/api/v1/push
+  timeout: 5s
+`), &cfg))
+
+	require.Len(t, cfg, 1)
+	assert.Equal(t, "mirror", cfg[0].Name)
+	assert.Equal(t, "mirror-org-id", cfg[0].OrgID)
+	assert.Equal(t, "http://mirror/api/v1/push", cfg[0].Endpoint)
+	assert.Equal(t, 5*time.Second, cfg[0].Timeout)
+	// The fields absent from the YAML have the defaults of the flags.
+	assert.Equal(t, defaultMaxRetries, cfg[0].MaxRetries)
+	assert.Equal(t, ProtocolVersion1, cfg[0].ProtocolVersion)
+	assert.Equal(t, 1, cfg[0].Sharding.Shards)
+}
@@ -9,30 +9,38 @@ import (
 )
 
 type MeasuredClient struct {
-	client   Client
-	recorder Recorder
-	tracer   opentracing.Tracer
-	timeNow  func() time.Time
+	client    Client
+	recorder  Recorder
+	tracer    opentracing.Tracer
+	timeNow   func() time.Time
+	operation string
 }
 
 func NewMeasuredClient(client Client, recorder Recorder, tracer opentracing.Tracer, timeNow func() time.Time) Client {
+	return NewMeasuredClientWithOperation(client, recorder, tracer, timeNow, "Write")
+}
+
+// NewMeasuredClientWithOperation measures the writes as the given operation,
+// to tell apart the latency of the clients of each shard for example.
+func NewMeasuredClientWithOperation(client Client, recorder Recorder, tracer opentracing.Tracer, timeNow func() time.Time, operation string) Client {
 	return &MeasuredClient{
-		client:   client,
-		recorder: recorder,
-		tracer:   tracer,
-		timeNow:  timeNow,
+		client:    client,
+		recorder:  recorder,
+		tracer:    tracer,
+		timeNow:   timeNow,
+		operation: operation,
 	}
 }
 
 func (mc *MeasuredClient) Write(ctx context.Context, req *mimirpb.WriteRequest) (err error) {
-	sp, ctx := opentracing.StartSpanFromContextWithTracer(ctx, mc.tracer, "remotewrite.Write")
+	sp, ctx := opentracing.StartSpanFromContextWithTracer(ctx, mc.tracer, "remotewrite."+mc.operation)
 	defer sp.Finish()
 	sp.LogKV("series_count", len(req.Timeseries))
 	if len(req.Metadata) > 0 {
 		sp.LogKV("example_metric", req.Metadata[0].MetricFamilyName)
 	}
 	defer func(t0 time.Time) {
-		mc.recorder.measure("Write", mc.timeNow().Sub(t0), err)
+		mc.recorder.measure(mc.operation, mc.timeNow().Sub(t0), err)
 	}(mc.timeNow())
 	return mc.client.Write(ctx, req)
 }
@@ -22,3 +22,13 @@ func (_m *MockRecorder) measure(_a0 string, _a1 time.Duration, _a2 error) {
 func (_m *MockRecorder) measureOutOfOrderSamples(count int) {
 	_m.Called(count)
 }
+
+// measureRetry provides a mock function with given fields: reason
+func (_m *MockRecorder) measureRetry(reason string) {
+	_m.Called(reason)
+}
+
+// measureWritten provides a mock function with given fields: samples, histograms, exemplars
+func (_m *MockRecorder) measureWritten(samples int, histograms int, exemplars int) {
+	_m.Called(samples, histograms, exemplars)
+}
@@ -0,0 +1,408 @@
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+	"github.com/grafana/mimir-graphite/v2/pkg/internalserver"
+)
+
+const (
+	defaultQueueShards           = 4
+	defaultQueueSegmentSizeBytes = 16 << 20
+	defaultQueueMaxDiskBytes     = 1 << 30
+	defaultQueueMinBackoff       = 100 * time.Millisecond
+	defaultQueueMaxBackoff       = 30 * time.Second
+
+	shardDirFormat = "shard-%03d"
+)
+
+// QueueConfig configures the durable on-disk queue of the writes to the
+// remote write endpoint. The queue is disabled unless a directory is set.
+type QueueConfig struct {
+	Directory        string        `yaml:"directory"`
+	Shards           int           `yaml:"shards"`
+	SegmentSizeBytes int64         `yaml:"segment_size_bytes"`
+	MaxDiskBytes     int64         `yaml:"max_disk_bytes"`
+	MinBackoff       time.Duration `yaml:"min_backoff"`
+	MaxBackoff       time.Duration `yaml:"max_backoff"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it.
+func (c *QueueConfig) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	flags.StringVar(&c.Directory, prefix+"write-queue.directory", "", "Directory of the durable write queue. Writes are acknowledged once stored there, and sent to the remote write API in the background. Disabled if empty.")
+	flags.IntVar(&c.Shards, prefix+"write-queue.shards", defaultQueueShards, "Number of concurrent senders of the write queue. Series are assigned to a shard by the hash of their labels, so the samples of a series are sent in order.")
+	flags.Int64Var(&c.SegmentSizeBytes, prefix+"write-queue.segment-size-bytes", defaultQueueSegmentSizeBytes, "Size of the files of the write queue. Files are deleted once all their writes have been sent.")
+	flags.Int64Var(&c.MaxDiskBytes, prefix+"write-queue.max-disk-bytes", defaultQueueMaxDiskBytes, "Maximum disk space used by the write queue. Writes are rejected with 429 once it's full.")
+	flags.DurationVar(&c.MinBackoff, prefix+"write-queue.min-backoff", defaultQueueMinBackoff, "Minimum backoff between retries of the queued writes.")
+	flags.DurationVar(&c.MaxBackoff, prefix+"write-queue.max-backoff", defaultQueueMaxBackoff, "Maximum backoff between retries of the queued writes.")
+}
+
+// Enabled returns whether the queue is enabled.
+func (c QueueConfig) Enabled() bool {
+	return c.Directory != ""
+}
+
+// Validate the config.
+func (c QueueConfig) Validate() error {
+	if c.Shards <= 0 {
+		return fmt.Errorf("write queue shards must be positive")
+	}
+	if c.SegmentSizeBytes <= 0 {
+		return fmt.Errorf("write queue segment size must be positive")
+	}
+	if c.MaxDiskBytes < c.SegmentSizeBytes {
+		return fmt.Errorf("write queue max disk bytes can't be less than the segment size")
+	}
+	return nil
+}
+
+var _ internalserver.ReadinessProvider = (*QueueClient)(nil)
+
+// QueueClient is a Client that durably stores the writes on disk, and sends
+// them with another Client in the background, retrying them until they
+// succeed. Writes rejected as bad requests by the remote write API are
+// dropped.
+//
+// Writes are sent at least once: the writes being sent when the process stops
+// are sent again when it's restarted.
+type QueueClient struct {
+	cfg     QueueConfig
+	client  Client
+	logger  log.Logger
+	metrics *queueMetrics
+
+	shards    []*queueShard
+	diskBytes atomic.Int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	quit   chan struct{}
+	once   sync.Once
+}
+
+type queueShard struct {
+	log *queueLog
+	// sending is the enqueue time in nanoseconds of the write being sent, 0
+	// if the shard is idle.
+	sending atomic.Int64
+}
+
+// NewQueueClient opens the queue in the configured directory, which is
+// created if needed. The writes left in the queue are sent when it's run.
+func NewQueueClient(cfg QueueConfig, client Client, prefix string, reg prometheus.Registerer, logger log.Logger) (*QueueClient, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &QueueClient{
+		cfg:    cfg,
+		client: client,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+		quit:   make(chan struct{}),
+	}
+
+	// Shards of a previous run with more shards are still read, so their
+	// writes aren't lost, but nothing is written to them anymore.
+	var pending int
+	shards := cfg.Shards
+	if existing, err := filepath.Glob(filepath.Join(cfg.Directory, "shard-*")); err == nil && len(existing) > shards {
+		shards = len(existing)
+	}
+	for i := 0; i < shards; i++ {
+		l, records, size, err := openQueueLog(filepath.Join(cfg.Directory, fmt.Sprintf(shardDirFormat, i)), cfg.SegmentSizeBytes, logger)
+		if err != nil {
+			q.close()
+			return nil, fmt.Errorf("can't open write queue: %w", err)
+		}
+		pending += records
+		l.onDelete = func(size int64) {
+			q.diskBytes.Add(-size)
+		}
+		q.diskBytes.Add(size)
+		q.shards = append(q.shards, &queueShard{log: l})
+	}
+
+	q.metrics = newQueueMetrics(prefix, q)
+	if err := q.metrics.register(reg); err != nil {
+		q.close()
+		return nil, err
+	}
+	q.metrics.pendingWrites.Set(float64(pending))
+	return q, nil
+}
+
+// Write stores the write request in the queue. It returns once the request
+// has been durably stored.
+func (q *QueueClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	tenant, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return errorx.BadRequest{Msg: "can't get org ID of write request", Err: err}
+	}
+
+	now := time.Now()
+	encoded := make([][]byte, q.cfg.Shards)
+	var size int64
+	for i, shardReq := range q.split(tenant, req) {
+		if shardReq == nil {
+			continue
+		}
+		data, err := shardReq.Marshal()
+		if err != nil {
+			return errorx.Internal{Msg: "can't marshal write request", Err: err}
+		}
+		encoded[i] = queueRecord{tenant: tenant, enqueued: now, data: snappy.Encode(nil, data)}.encode()
+		size += int64(len(encoded[i]))
+	}
+
+	if q.diskBytes.Add(size) > q.cfg.MaxDiskBytes {
+		q.diskBytes.Add(-size)
+		q.metrics.rejectedWrites.Inc()
+		return errorx.TooManyRequests{Msg: "write queue is full"}
+	}
+
+	for i, buf := range encoded {
+		if buf == nil {
+			continue
+		}
+		if err := q.shards[i].log.append(buf); err != nil {
+			// The series already stored in the other shards are sent again
+			// when the write is retried, which is harmless.
+			q.diskBytes.Add(-size)
+			return errorx.Internal{Msg: "can't store write request in the write queue", Err: err}
+		}
+		size -= int64(len(buf))
+		q.metrics.pendingWrites.Inc()
+	}
+	return nil
+}
+
+// split returns the write request to store in each shard, by the hash of the
+// series labels. The metadata is sent with the first shard.
+func (q *QueueClient) split(tenant string, req *mimirpb.WriteRequest) []*mimirpb.WriteRequest {
+	shards := make([]*mimirpb.WriteRequest, q.cfg.Shards)
+	if q.cfg.Shards == 1 {
+		shards[0] = req
+		return shards
+	}
+
+	shardReq := func(i int) *mimirpb.WriteRequest {
+		if shards[i] == nil {
+			shards[i] = &mimirpb.WriteRequest{
+				Source:              req.Source,
+				SkipLabelValidation: req.SkipLabelValidation,
+			}
+		}
+		return shards[i]
+	}
+	for _, series := range req.Timeseries {
+		i := int(mimirpb.ShardByAllLabelAdapters(tenant, series.Labels) % uint32(q.cfg.Shards))
+		shardReq(i).Timeseries = append(shardReq(i).Timeseries, series)
+	}
+	if len(req.Metadata) > 0 {
+		shardReq(0).Metadata = req.Metadata
+	}
+	return shards
+}
+
+// Ready implements internalserver.ReadinessProvider. The queue is not ready
+// once it's full or stopped.
+func (q *QueueClient) Ready() bool {
+	select {
+	case <-q.quit:
+		return false
+	default:
+		return q.diskBytes.Load() < q.cfg.MaxDiskBytes
+	}
+}
+
+// Handler returns two functions to run the senders of the queue and to stop
+// them. The writes not sent yet stay in the queue until it's run again.
+func (q *QueueClient) Handler() (run func() error, stop func(error)) {
+	run = func() error {
+		for _, shard := range q.shards {
+			shard := shard
+			q.wg.Add(1)
+			go func() {
+				defer q.wg.Done()
+				q.send(shard)
+			}()
+		}
+		<-q.quit
+		q.wg.Wait()
+		return q.close()
+	}
+	stop = func(error) {
+		q.once.Do(func() {
+			q.cancel()
+			close(q.quit)
+		})
+	}
+	return run, stop
+}
+
+// send sends the writes of the shard until the queue is stopped.
+func (q *QueueClient) send(shard *queueShard) {
+	boff := backoff.New(q.ctx, backoff.Config{MinBackoff: q.cfg.MinBackoff, MaxBackoff: q.cfg.MaxBackoff})
+	for {
+		rec, err := shard.log.next(q.ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, errLogClosed) {
+				level.Error(q.logger).Log("msg", "can't read write queue, stopping sender", "err", err)
+			}
+			return
+		}
+		shard.sending.Store(rec.enqueued.UnixNano())
+
+		req := &mimirpb.WriteRequest{}
+		if err := q.decode(rec, req); err != nil {
+			level.Error(q.logger).Log("msg", "dropping corrupted queued write", "err", err)
+			q.metrics.sentWrites.WithLabelValues("dropped").Inc()
+			q.ack(shard)
+			continue
+		}
+
+		boff.Reset()
+		for {
+			err = q.client.Write(user.InjectOrgID(q.ctx, rec.tenant), req)
+			if err == nil {
+				q.metrics.sentWrites.WithLabelValues("success").Inc()
+				break
+			}
+			if q.ctx.Err() != nil {
+				// The write is sent again on the next run.
+				return
+			}
+			if !errors.As(err, &recoverableError{}) {
+				// Retrying a write rejected by the remote write API, for
+				// example with a 400 or a 403, would block the shard forever.
+				level.Warn(q.logger).Log("msg", "dropping queued write rejected by the remote write API", "tenant", rec.tenant, "err", err)
+				q.metrics.sentWrites.WithLabelValues("dropped").Inc()
+				break
+			}
+			level.Warn(q.logger).Log("msg", "failed sending queued write, retrying", "tenant", rec.tenant, "err", err)
+			q.metrics.sentWrites.WithLabelValues("retry").Inc()
+			boff.Wait()
+		}
+		q.ack(shard)
+	}
+}
+
+// ack acknowledges the write sent by the shard, so that it isn't sent again
+// after a restart.
+func (q *QueueClient) ack(shard *queueShard) {
+	if err := shard.log.ack(); err != nil {
+		// The write is only sent again if the proxy restarts.
+		level.Warn(q.logger).Log("msg", "can't store write queue checkpoint", "err", err)
+	}
+	shard.sending.Store(0)
+	q.metrics.pendingWrites.Dec()
+}
+
+func (q *QueueClient) decode(rec queueRecord, req *mimirpb.WriteRequest) error {
+	data, err := snappy.Decode(nil, rec.data)
+	if err != nil {
+		return err
+	}
+	return req.Unmarshal(data)
+}
+
+// lag returns how long ago the oldest write being sent was enqueued.
+func (q *QueueClient) lag() time.Duration {
+	var lag time.Duration
+	now := time.Now()
+	for _, shard := range q.shards {
+		if sending := shard.sending.Load(); sending != 0 && now.Sub(time.Unix(0, sending)) > lag {
+			lag = now.Sub(time.Unix(0, sending))
+		}
+	}
+	return lag
+}
+
+func (q *QueueClient) close() error {
+	var errs []error
+	for _, shard := range q.shards {
+		if err := shard.log.close(); err != nil {
+			errs = append(errs, err)
+		}
+		shard.log.closeReader()
+	}
+	return errors.Join(errs...)
+}
+
+type queueMetrics struct {
+	pendingWrites  prometheus.Gauge
+	sentWrites     *prometheus.CounterVec
+	rejectedWrites prometheus.Counter
+	diskBytes      prometheus.GaugeFunc
+	lag            prometheus.GaugeFunc
+}
+
+func newQueueMetrics(prefix string, q *QueueClient) *queueMetrics {
+	namespace := prefix + "_remote_write_queue"
+	return &queueMetrics{
+		pendingWrites: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pending_writes",
+			Help:      "The number of writes in the write queue not sent yet.",
+		}),
+		sentWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sent_writes_total",
+			Help:      "The total number of attempts to send the queued writes, by result.",
+		}, []string{"result"}),
+		rejectedWrites: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_writes_total",
+			Help:      "The total number of writes rejected because the write queue was full.",
+		}),
+		diskBytes: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "disk_bytes",
+			Help:      "The disk space used by the write queue.",
+		}, func() float64 {
+			return float64(q.diskBytes.Load())
+		}),
+		lag: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "lag_seconds",
+			Help:      "How long ago the oldest write being sent was enqueued.",
+		}, func() float64 {
+			return q.lag().Seconds()
+		}),
+	}
+}
+
+func (m *queueMetrics) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m.pendingWrites, m.sentWrites, m.rejectedWrites, m.diskBytes, m.lag} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
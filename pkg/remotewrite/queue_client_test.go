@@ -0,0 +1,356 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+// fakeClient records the series it receives, failing with the queued errors
+// first.
+type fakeClient struct {
+	mtx     sync.Mutex
+	errs    []error
+	series  map[string][]string
+	samples int
+}
+
+func (c *fakeClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+
+	tenant, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if c.series == nil {
+		c.series = map[string][]string{}
+	}
+	for _, series := range req.Timeseries {
+		c.series[tenant] = append(c.series[tenant], mimirpb.FromLabelAdaptersToLabels(series.Labels).Get("__name__"))
+		c.samples += len(series.Samples)
+	}
+	return nil
+}
+
+func (c *fakeClient) received() map[string][]string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	received := map[string][]string{}
+	for tenant, series := range c.series {
+		received[tenant] = append([]string(nil), series...)
+		sort.Strings(received[tenant])
+	}
+	return received
+}
+
+func (c *fakeClient) receivedSamples() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.samples
+}
+
+func testWriteRequest(names ...string) *mimirpb.WriteRequest {
+	req := &mimirpb.WriteRequest{}
+	for _, name := range names {
+		req.Timeseries = append(req.Timeseries, mimirpb.PreallocTimeseries{TimeSeries: &mimirpb.TimeSeries{
+			Labels:  []mimirpb.LabelAdapter{{Name: "__name__", Value: name}},
+			Samples: []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}},
+		}})
+	}
+	return req
+}
+
+func testQueueConfig(t *testing.T) QueueConfig {
+	return QueueConfig{
+		Directory:        t.TempDir(),
+		Shards:           4,
+		SegmentSizeBytes: 1 << 20,
+		MaxDiskBytes:     16 << 20,
+		MinBackoff:       time.Millisecond,
+		MaxBackoff:       10 * time.Millisecond,
+	}
+}
+
+// runQueue runs the queue until the test ends, or until the returned function
+// is called.
+func runQueue(t *testing.T, q *QueueClient) (stop func()) {
+	run, stopFn := q.Handler()
+	done := make(chan error)
+	go func() {
+		done <- run()
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			stopFn(nil)
+			require.NoError(t, <-done)
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestQueueClient(t *testing.T) {
+	client := &fakeClient{}
+	q, err := NewQueueClient(testQueueConfig(t), client, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	runQueue(t, q)
+
+	require.NoError(t, q.Write(user.InjectOrgID(context.Background(), "tenant-a"), testWriteRequest("a", "b", "c", "d", "e")))
+	require.NoError(t, q.Write(user.InjectOrgID(context.Background(), "tenant-b"), testWriteRequest("f")))
+
+	require.Eventually(t, func() bool {
+		return client.receivedSamples() == 6
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string][]string{
+		"tenant-a": {"a", "b", "c", "d", "e"},
+		"tenant-b": {"f"},
+	}, client.received())
+	assert.Equal(t, float64(0), testutil.ToFloat64(q.metrics.pendingWrites))
+	assert.True(t, q.Ready())
+}
+
+func TestQueueClient_Retries(t *testing.T) {
+	client := &fakeClient{errs: []error{
+		recoverableError{error: errorx.Internal{Msg: "failed writing metrics"}, reason: retryReasonServer},
+		recoverableError{error: errorx.TooManyRequests{Msg: "too many write requests"}, reason: retryReasonRateLimit},
+		errorx.BadRequest{Msg: "bad metrics write request"},
+	}}
+	cfg := testQueueConfig(t)
+	cfg.Shards = 1
+	q, err := NewQueueClient(cfg, client, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx := user.InjectOrgID(context.Background(), "tenant-a")
+	// The first write is retried until it's rejected as a bad request, the
+	// second one is sent.
+	require.NoError(t, q.Write(ctx, testWriteRequest("dropped")))
+	require.NoError(t, q.Write(ctx, testWriteRequest("sent")))
+	runQueue(t, q)
+
+	require.Eventually(t, func() bool {
+		return client.receivedSamples() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string][]string{"tenant-a": {"sent"}}, client.received())
+	assert.Equal(t, float64(2), testutil.ToFloat64(q.metrics.sentWrites.WithLabelValues("retry")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(q.metrics.sentWrites.WithLabelValues("dropped")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(q.metrics.sentWrites.WithLabelValues("success")))
+}
+
+func TestQueueClient_DropsUnrecoverableWrites(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if requests == 1 {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		Endpoint:   srv.URL,
+		Timeout:    time.Second,
+		MaxRetries: 3,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}, &MockRecorder{}, nil)
+	require.NoError(t, err)
+
+	cfg := testQueueConfig(t)
+	cfg.Shards = 1
+	q, err := NewQueueClient(cfg, client, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx := user.InjectOrgID(context.Background(), "tenant-a")
+	require.NoError(t, q.Write(ctx, testWriteRequest("forbidden")))
+	require.NoError(t, q.Write(ctx, testWriteRequest("sent")))
+	runQueue(t, q)
+
+	// The forbidden write isn't retried, so the shard keeps sending.
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(q.metrics.pendingWrites) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(q.metrics.sentWrites.WithLabelValues("dropped")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(q.metrics.sentWrites.WithLabelValues("success")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(q.metrics.sentWrites.WithLabelValues("retry")))
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, 2, requests)
+}
+
+func TestQueueClient_Restart(t *testing.T) {
+	cfg := testQueueConfig(t)
+	// Small segments so that the queue is split in many files.
+	cfg.SegmentSizeBytes = 64
+
+	q, err := NewQueueClient(cfg, &fakeClient{}, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	ctx := user.InjectOrgID(context.Background(), "tenant-a")
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("series_%02d", i))
+		require.NoError(t, q.Write(ctx, testWriteRequest(names[i])))
+	}
+	// The writes not sent are kept on disk.
+	require.NoError(t, q.close())
+
+	// A partially written record, from a crash for example, is dropped.
+	segments, err := filepath.Glob(filepath.Join(cfg.Directory, "shard-*", "[0-9]*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, segments)
+	sort.Strings(segments)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	client := &fakeClient{}
+	q, err = NewQueueClient(cfg, client, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	assert.Equal(t, float64(20), testutil.ToFloat64(q.metrics.pendingWrites))
+	runQueue(t, q)
+
+	require.Eventually(t, func() bool {
+		return client.receivedSamples() >= 20
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string][]string{"tenant-a": names}, client.received())
+
+	// Only the segments being written are left once everything is sent.
+	require.Eventually(t, func() bool {
+		segments, err := filepath.Glob(filepath.Join(cfg.Directory, "shard-*", "[0-9]*"))
+		require.NoError(t, err)
+		return len(segments) <= cfg.Shards
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestQueueClient_RestartAfterSent(t *testing.T) {
+	for name, corruptCheckpoint := range map[string]bool{
+		"sent writes aren't sent again":           false,
+		"corrupted checkpoint sends writes again": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := testQueueConfig(t)
+			cfg.Shards = 1
+			// The last writes are sent from the segment being written.
+			cfg.SegmentSizeBytes = 256
+
+			q, err := NewQueueClient(cfg, &fakeClient{}, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+			require.NoError(t, err)
+			stop := runQueue(t, q)
+			ctx := user.InjectOrgID(context.Background(), "tenant-a")
+			var names []string
+			for i := 0; i < 5; i++ {
+				names = append(names, fmt.Sprintf("series_%02d", i))
+				require.NoError(t, q.Write(ctx, testWriteRequest(names[i])))
+			}
+			require.Eventually(t, func() bool {
+				return testutil.ToFloat64(q.metrics.pendingWrites) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			stop()
+
+			if corruptCheckpoint {
+				require.NoError(t, os.WriteFile(filepath.Join(cfg.Directory, fmt.Sprintf(shardDirFormat, 0), checkpointFilename), []byte{1, 2, 3}, 0o640))
+			}
+
+			client := &fakeClient{}
+			q, err = NewQueueClient(cfg, client, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+			require.NoError(t, err)
+			if corruptCheckpoint {
+				assert.NotZero(t, testutil.ToFloat64(q.metrics.pendingWrites))
+				assert.NotZero(t, q.diskBytes.Load())
+			} else {
+				assert.Equal(t, float64(0), testutil.ToFloat64(q.metrics.pendingWrites))
+				assert.Equal(t, int64(0), q.diskBytes.Load())
+			}
+			runQueue(t, q)
+			require.NoError(t, q.Write(ctx, testWriteRequest("new_series")))
+
+			require.Eventually(t, func() bool {
+				return testutil.ToFloat64(q.metrics.pendingWrites) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			received := client.received()["tenant-a"]
+			assert.Contains(t, received, "new_series")
+			if corruptCheckpoint {
+				assert.Subset(t, received, names[len(names)-1:])
+			} else {
+				assert.Equal(t, []string{"new_series"}, received)
+			}
+		})
+	}
+}
+
+func TestQueueClient_Full(t *testing.T) {
+	cfg := testQueueConfig(t)
+	cfg.Shards = 1
+	q, err := NewQueueClient(cfg, &fakeClient{}, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	defer q.close()
+	ctx := user.InjectOrgID(context.Background(), "tenant-a")
+
+	require.NoError(t, q.Write(ctx, testWriteRequest("some_series")))
+	// Leave room for exactly one more write.
+	q.cfg.MaxDiskBytes = 2 * q.diskBytes.Load()
+
+	err = q.Write(ctx, testWriteRequest("some_series", "other_series"))
+	require.ErrorAs(t, err, &errorx.TooManyRequests{})
+	assert.Equal(t, float64(1), testutil.ToFloat64(q.metrics.rejectedWrites))
+	assert.True(t, q.Ready())
+
+	require.NoError(t, q.Write(ctx, testWriteRequest("some_series")))
+	assert.False(t, q.Ready())
+	require.ErrorAs(t, q.Write(ctx, testWriteRequest("some_series")), &errorx.TooManyRequests{})
+	assert.Equal(t, float64(2), testutil.ToFloat64(q.metrics.pendingWrites))
+}
+
+func TestQueueClient_NoOrgID(t *testing.T) {
+	q, err := NewQueueClient(testQueueConfig(t), &fakeClient{}, "test", prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	defer q.close()
+
+	err = q.Write(context.Background(), testWriteRequest("some_series"))
+	require.ErrorAs(t, err, &errorx.BadRequest{})
+}
+
+func TestQueueConfig_Validate(t *testing.T) {
+	cfg := QueueConfig{Directory: "queue", Shards: 1, SegmentSizeBytes: 10, MaxDiskBytes: 100}
+	require.NoError(t, cfg.Validate())
+
+	for name, cfg := range map[string]QueueConfig{
+		"no shards":            {Directory: "queue", SegmentSizeBytes: 10, MaxDiskBytes: 100},
+		"no segment size":      {Directory: "queue", Shards: 1, MaxDiskBytes: 100},
+		"disk below a segment": {Directory: "queue", Shards: 1, SegmentSizeBytes: 10, MaxDiskBytes: 5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, cfg.Validate())
+		})
+	}
+}
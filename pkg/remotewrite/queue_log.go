@@ -0,0 +1,479 @@
+package remotewrite
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// recordHeaderSize is the size of the length and the CRC of a record.
+	recordHeaderSize = 8
+	// maxRecordSize protects from allocating huge buffers when reading a
+	// corrupted length.
+	maxRecordSize = 256 << 20
+
+	segmentNameFormat = "%08d"
+
+	// checkpointFilename is the file storing the position of the first record
+	// of the log not acknowledged yet.
+	checkpointFilename = "checkpoint"
+	// checkpointSize is the size of the segment index and offset of the
+	// checkpoint, followed by their CRC.
+	checkpointSize = 20
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptedRecord     = errors.New("corrupted record")
+	errCorruptedCheckpoint = errors.New("corrupted checkpoint")
+	errLogClosed           = errors.New("queue is closed")
+)
+
+// queueRecord is a write request waiting in the queue.
+type queueRecord struct {
+	tenant   string
+	enqueued time.Time
+	// data is the snappy compressed write request.
+	data []byte
+}
+
+// encode returns the record as written in the segments: the length and the
+// CRC of the payload, followed by the payload itself.
+func (r queueRecord) encode() []byte {
+	payload := make([]byte, 0, 8+binary.MaxVarintLen64+len(r.tenant)+len(r.data))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(r.enqueued.UnixNano()))
+	payload = binary.AppendUvarint(payload, uint64(len(r.tenant)))
+	payload = append(payload, r.tenant...)
+	payload = append(payload, r.data...)
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, castagnoli))
+	return append(buf, payload...)
+}
+
+func decodeQueueRecord(payload []byte) (queueRecord, error) {
+	if len(payload) < 8 {
+		return queueRecord{}, errCorruptedRecord
+	}
+	enqueued := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	payload = payload[8:]
+
+	tenantLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < tenantLen {
+		return queueRecord{}, errCorruptedRecord
+	}
+	payload = payload[n:]
+
+	return queueRecord{
+		tenant:   string(payload[:tenantLen]),
+		enqueued: enqueued,
+		data:     payload[tenantLen:],
+	}, nil
+}
+
+// readRecordAt reads the record at off of f, which must not be read past
+// size. It returns the record and its size on disk.
+func readRecordAt(f *os.File, off, size int64) (queueRecord, int64, error) {
+	if size-off < recordHeaderSize {
+		return queueRecord{}, 0, errCorruptedRecord
+	}
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return queueRecord{}, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > maxRecordSize || size-off-recordHeaderSize < length {
+		return queueRecord{}, 0, errCorruptedRecord
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+recordHeaderSize); err != nil {
+		return queueRecord{}, 0, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return queueRecord{}, 0, errCorruptedRecord
+	}
+	rec, err := decodeQueueRecord(payload)
+	return rec, recordHeaderSize + length, err
+}
+
+// checkpoint is the position of the first record not acknowledged yet.
+type checkpoint struct {
+	index  int
+	offset int64
+}
+
+func (c checkpoint) encode() []byte {
+	buf := make([]byte, 0, checkpointSize)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.index))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.offset))
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoli))
+}
+
+func decodeCheckpoint(buf []byte) (checkpoint, error) {
+	if len(buf) != checkpointSize || crc32.Checksum(buf[:16], castagnoli) != binary.BigEndian.Uint32(buf[16:]) {
+		return checkpoint{}, errCorruptedCheckpoint
+	}
+	return checkpoint{
+		index:  int(binary.BigEndian.Uint64(buf[0:8])),
+		offset: int64(binary.BigEndian.Uint64(buf[8:16])),
+	}, nil
+}
+
+type logSegment struct {
+	index int
+	// size is the number of bytes durably written to the segment.
+	size int64
+	// start is the offset of the first record not acknowledged when the log
+	// was opened, the records before it aren't read again.
+	start int64
+}
+
+// queueLog is an append-only log of records, split in numbered segment files
+// in a directory. Records are appended to the last segment and read in order
+// from the first one by a single reader, which acknowledges them once
+// processed and deletes the segments it has fully read. The position of the
+// first record not acknowledged is stored in a checkpoint file, so that only
+// the records not acknowledged are read again after a restart.
+type queueLog struct {
+	dir         string
+	segmentSize int64
+	logger      log.Logger
+
+	// onDelete is called with the size of the deleted segments.
+	onDelete func(size int64)
+
+	mtx      sync.Mutex
+	segments []*logSegment
+	head     *os.File
+	closed   bool
+	// appended is closed and replaced when records are appended.
+	appended chan struct{}
+
+	// Only accessed by the reader.
+	reading    *os.File
+	readOffset int64
+}
+
+// openQueueLog opens the log in dir, creating it if needed. Records that
+// weren't fully written, because of a crash for example, are truncated, and
+// the segments fully acknowledged are deleted. It returns the log along with
+// the number of records not acknowledged yet and their size.
+func openQueueLog(dir string, segmentSize int64, logger log.Logger) (*queueLog, int, int64, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, 0, 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	l := &queueLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		logger:      log.With(logger, "dir", dir),
+		onDelete:    func(int64) {},
+		appended:    make(chan struct{}),
+	}
+	for _, entry := range entries {
+		index, err := strconv.Atoi(entry.Name())
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		l.segments = append(l.segments, &logSegment{index: index})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].index < l.segments[j].index })
+
+	cp, err := l.readCheckpoint()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for len(l.segments) > 0 && l.segments[0].index < cp.index {
+		if err := os.Remove(l.segmentPath(l.segments[0].index)); err != nil {
+			return nil, 0, 0, err
+		}
+		l.segments = l.segments[1:]
+	}
+
+	var (
+		records int
+		size    int64
+	)
+	for _, segment := range l.segments {
+		var start int64
+		if segment.index == cp.index {
+			start = cp.offset
+		}
+		segmentRecords, err := l.replaySegment(segment, start)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		records += segmentRecords
+		size += segment.size - segment.start
+	}
+
+	var index int
+	if len(l.segments) > 0 {
+		index = l.segments[len(l.segments)-1].index
+	} else {
+		// A new segment must not be mistaken for an acknowledged one.
+		index = cp.index + 1
+		l.segments = append(l.segments, &logSegment{index: index})
+	}
+	l.readOffset = l.segments[0].start
+	if l.head, err = os.OpenFile(l.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640); err != nil {
+		return nil, 0, 0, err
+	}
+	return l, records, size, nil
+}
+
+// readCheckpoint returns the checkpoint of the log, the zero checkpoint if
+// there's none or if it's corrupted.
+func (l *queueLog) readCheckpoint() (checkpoint, error) {
+	buf, err := os.ReadFile(filepath.Join(l.dir, checkpointFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint{}, nil
+	}
+	if err != nil {
+		return checkpoint{}, err
+	}
+	cp, err := decodeCheckpoint(buf)
+	if err != nil {
+		level.Warn(l.logger).Log("msg", "ignoring corrupted write queue checkpoint, the queued writes are sent again", "err", err)
+		return checkpoint{}, nil
+	}
+	return cp, nil
+}
+
+// replaySegment checks the records of the segment, truncating it after the
+// last valid one. It returns the number of valid records from start, which
+// is ignored if it isn't the offset of a record.
+func (l *queueLog) replaySegment(segment *logSegment, start int64) (int, error) {
+	path := l.segmentPath(segment.index)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		offsets []int64
+		off     int64
+	)
+	for off < info.Size() {
+		_, n, err := readRecordAt(f, off, info.Size())
+		if err != nil {
+			level.Warn(l.logger).Log("msg", "truncating corrupted write queue segment", "segment", path, "offset", off, "err", err)
+			if err := os.Truncate(path, off); err != nil {
+				return 0, err
+			}
+			break
+		}
+		offsets = append(offsets, off)
+		off += n
+	}
+	segment.size = off
+
+	skipped := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= start })
+	if start != off && (skipped == len(offsets) || offsets[skipped] != start) {
+		level.Warn(l.logger).Log("msg", "ignoring invalid write queue checkpoint, the queued writes of the segment are sent again", "segment", path, "offset", start)
+		start, skipped = 0, 0
+	}
+	segment.start = start
+	return len(offsets) - skipped, nil
+}
+
+func (l *queueLog) segmentPath(index int) string {
+	return filepath.Join(l.dir, fmt.Sprintf(segmentNameFormat, index))
+}
+
+// append durably writes the encoded record to the log.
+func (l *queueLog) append(buf []byte) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return errLogClosed
+	}
+
+	head := l.segments[len(l.segments)-1]
+	if head.size > 0 && head.size+int64(len(buf)) > l.segmentSize {
+		if err := l.cut(); err != nil {
+			return err
+		}
+		head = l.segments[len(l.segments)-1]
+	}
+	if _, err := l.head.Write(buf); err != nil {
+		return err
+	}
+	if err := l.head.Sync(); err != nil {
+		return err
+	}
+	head.size += int64(len(buf))
+
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return nil
+}
+
+// cut closes the head segment and starts a new one. It must be called with
+// the lock held.
+func (l *queueLog) cut() error {
+	if err := l.head.Sync(); err != nil {
+		return err
+	}
+	if err := l.head.Close(); err != nil {
+		return err
+	}
+	index := l.segments[len(l.segments)-1].index + 1
+	head, err := os.OpenFile(l.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	l.head = head
+	l.segments = append(l.segments, &logSegment{index: index})
+	return nil
+}
+
+// next returns the next record of the log, waiting for one to be appended if
+// needed. Records are only returned once, and must be acknowledged with ack
+// before the next one is requested. The segments are deleted once all their
+// records have been returned and the next record is requested. After a
+// restart, the records are read again from the last one not acknowledged.
+func (l *queueLog) next(ctx context.Context) (queueRecord, error) {
+	for {
+		l.mtx.Lock()
+		if l.closed {
+			l.mtx.Unlock()
+			return queueRecord{}, errLogClosed
+		}
+		segment := l.segments[0]
+		size, last, appended := segment.size, len(l.segments) == 1, l.appended
+		l.mtx.Unlock()
+
+		if l.readOffset < size {
+			rec, n, err := l.readAt(segment.index, size)
+			if err != nil {
+				// Only the end of the segment is lost: the records are
+				// checked when the log is opened, so this is unexpected.
+				level.Error(l.logger).Log("msg", "skipping the end of corrupted write queue segment", "segment", segment.index, "offset", l.readOffset, "err", err)
+				l.readOffset = size
+				continue
+			}
+			l.readOffset += n
+			return rec, nil
+		}
+
+		if !last {
+			if err := l.deleteFirst(); err != nil {
+				return queueRecord{}, err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return queueRecord{}, ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// ack durably stores that the records returned by next have been processed,
+// so that they aren't read again after a restart.
+func (l *queueLog) ack() error {
+	l.mtx.Lock()
+	index := l.segments[0].index
+	l.mtx.Unlock()
+
+	path := filepath.Join(l.dir, checkpointFilename)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(checkpoint{index: index, offset: l.readOffset}.encode()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (l *queueLog) readAt(index int, size int64) (queueRecord, int64, error) {
+	if l.reading == nil {
+		f, err := os.Open(l.segmentPath(index))
+		if err != nil {
+			return queueRecord{}, 0, err
+		}
+		l.reading = f
+	}
+	return readRecordAt(l.reading, l.readOffset, size)
+}
+
+// deleteFirst deletes the first segment, which has been fully read.
+func (l *queueLog) deleteFirst() error {
+	if l.reading != nil {
+		_ = l.reading.Close()
+		l.reading = nil
+	}
+
+	l.mtx.Lock()
+	segment := l.segments[0]
+	l.segments = l.segments[1:]
+	l.mtx.Unlock()
+
+	l.readOffset = 0
+	if err := os.Remove(l.segmentPath(segment.index)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l.onDelete(segment.size - segment.start)
+	return nil
+}
+
+// close closes the log files. The segments are kept on disk, so the records
+// not acknowledged yet are read when the log is opened again.
+func (l *queueLog) close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.appended)
+	return l.head.Close()
+}
+
+// closeReader closes the file of the reader, it must only be called once the
+// reader stopped.
+func (l *queueLog) closeReader() {
+	if l.reading != nil {
+		_ = l.reading.Close()
+		l.reading = nil
+	}
+}
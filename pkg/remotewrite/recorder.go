@@ -10,6 +10,8 @@ import (
 type Recorder interface {
 	measureOutOfOrderSamples(count int)
 	measure(string, time.Duration, error)
+	measureRetry(reason string)
+	measureWritten(samples, histograms, exemplars int)
 }
 
 // NewRecorder returns a new Prometheus metrics Recorder.
@@ -26,10 +28,22 @@ func NewRecorder(prefix string, reg prometheus.Registerer) Recorder {
 			Name:      "request_duration_seconds",
 			Help:      "Client-side duration of remote write calls.",
 		}, []string{"operation", "result"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix + "_remote_write_client",
+			Name:      "retries_total",
+			Help:      "The total number of retried remote write requests, by the reason of the failure.",
+		}, []string{"reason"}),
+		written: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix + "_remote_write_client",
+			Name:      "written_total",
+			Help:      "The total number of samples, histograms and exemplars reported as written by the remote write API.",
+		}, []string{"type"}),
 	}
 
 	reg.MustRegister(r.outOfOrderWrites)
 	reg.MustRegister(r.requestDuration)
+	reg.MustRegister(r.retries)
+	reg.MustRegister(r.written)
 
 	return r
 }
@@ -39,6 +53,8 @@ func NewRecorder(prefix string, reg prometheus.Registerer) Recorder {
 type prometheusRecorder struct {
 	outOfOrderWrites *prometheus.CounterVec
 	requestDuration  *prometheus.HistogramVec
+	retries          *prometheus.CounterVec
+	written          *prometheus.CounterVec
 }
 
 func (r prometheusRecorder) measureOutOfOrderSamples(count int) {
@@ -52,3 +68,13 @@ func (r prometheusRecorder) measure(op string, duration time.Duration, err error
 	}
 	r.requestDuration.WithLabelValues(op, result).Observe(duration.Seconds())
 }
+
+func (r prometheusRecorder) measureRetry(reason string) {
+	r.retries.WithLabelValues(reason).Inc()
+}
+
+func (r prometheusRecorder) measureWritten(samples, histograms, exemplars int) {
+	r.written.WithLabelValues("samples").Add(float64(samples))
+	r.written.WithLabelValues("histograms").Add(float64(histograms))
+	r.written.WithLabelValues("exemplars").Add(float64(exemplars))
+}
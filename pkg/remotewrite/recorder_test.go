@@ -29,6 +29,36 @@ func TestRecorder(t *testing.T) {
 				"# TYPE my_proxy_out_of_order_writes_total counter\n" +
 				"my_proxy_out_of_order_writes_total 2\n",
 		},
+		"Measure retries": {
+			measure: func(r Recorder) {
+				r.measureRetry("5xx")
+				r.measureRetry("5xx")
+				r.measureRetry("429")
+			},
+			expMetricNames: []string{
+				"my_proxy_remote_write_client_retries_total",
+			},
+			expMetrics: "" +
+				"# HELP my_proxy_remote_write_client_retries_total The total number of retried remote write requests, by the reason of the failure.\n" +
+				"# TYPE my_proxy_remote_write_client_retries_total counter\n" +
+				"my_proxy_remote_write_client_retries_total{reason=\"429\"} 1\n" +
+				"my_proxy_remote_write_client_retries_total{reason=\"5xx\"} 2\n",
+		},
+		"Measure written": {
+			measure: func(r Recorder) {
+				r.measureWritten(10, 0, 1)
+				r.measureWritten(5, 0, 0)
+			},
+			expMetricNames: []string{
+				"my_proxy_remote_write_client_written_total",
+			},
+			expMetrics: "" +
+				"# HELP my_proxy_remote_write_client_written_total The total number of samples, histograms and exemplars reported as written by the remote write API.\n" +
+				"# TYPE my_proxy_remote_write_client_written_total counter\n" +
+				"my_proxy_remote_write_client_written_total{type=\"exemplars\"} 1\n" +
+				"my_proxy_remote_write_client_written_total{type=\"histograms\"} 0\n" +
+				"my_proxy_remote_write_client_written_total{type=\"samples\"} 15\n",
+		},
 	}
 
 	for name, test := range tests {
@@ -0,0 +1,217 @@
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+// ShardingConfig configures the split of the writes in several concurrent
+// requests.
+type ShardingConfig struct {
+	Shards          int `yaml:"shards"`
+	MaxRequestBytes int `yaml:"max_request_bytes"`
+}
+
+// RegisterFlagsWithPrefix registers flags, adding the provided prefix if
+// needed. If the prefix is not blank and doesn't end with '.', a '.' is
+// appended to it.
+func (c *ShardingConfig) RegisterFlagsWithPrefix(prefix string, flags *flag.FlagSet) {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	flags.IntVar(&c.Shards, prefix+"write-shards", 1, "Number of concurrent requests each write is split in, by the hash of the series labels.")
+	flags.IntVar(&c.MaxRequestBytes, prefix+"write-max-request-bytes", 0, "Maximum size of the uncompressed requests of each shard, larger writes are split in several requests sent in order. 0 to disable.")
+}
+
+// Enabled returns whether the writes are split.
+func (c ShardingConfig) Enabled() bool {
+	return c.Shards > 1 || c.MaxRequestBytes > 0
+}
+
+// NewShardingClient returns a Client splitting the writes in requests to the
+// given client. The series are spread over the shards by the hash of their
+// labels, and the requests of the shards are sent concurrently. The requests
+// of a shard over the max request bytes are split again and sent in order, so
+// the samples of a series are always written in order.
+//
+// The latency of each shard is measured as its own operation.
+func NewShardingClient(cfg ShardingConfig, client Client, recorder Recorder, tracer opentracing.Tracer, timeNow func() time.Time) Client {
+	shards := cfg.Shards
+	if shards < 1 {
+		shards = 1
+	}
+	c := &shardingClient{
+		maxRequestBytes: cfg.MaxRequestBytes,
+		shards:          make([]Client, shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewMeasuredClientWithOperation(client, recorder, tracer, timeNow, fmt.Sprintf("Write_shard_%d", i))
+	}
+	return c
+}
+
+type shardingClient struct {
+	maxRequestBytes int
+	shards          []Client
+}
+
+func (c *shardingClient) Write(ctx context.Context, req *mimirpb.WriteRequest) error {
+	tenant, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return errorx.BadRequest{Msg: "can't get org ID of write request", Err: err}
+	}
+
+	shards := c.split(tenant, req)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(shards))
+	)
+	for i, shardReqs := range shards {
+		if len(shardReqs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shardReqs []*mimirpb.WriteRequest) {
+			defer wg.Done()
+			for _, shardReq := range shardReqs {
+				if errs[i] = c.shards[i].Write(ctx, shardReq); errs[i] != nil {
+					// The next requests of the shard may have newer samples
+					// of the same series, so they can't be sent.
+					return
+				}
+			}
+		}(i, shardReqs)
+	}
+	wg.Wait()
+
+	return mergeShardErrors(errs)
+}
+
+// split returns the requests to send in order for each shard.
+func (c *shardingClient) split(tenant string, req *mimirpb.WriteRequest) [][]*mimirpb.WriteRequest {
+	series := make([][]mimirpb.PreallocTimeseries, len(c.shards))
+	if len(c.shards) == 1 {
+		series[0] = req.Timeseries
+	} else {
+		for _, ts := range req.Timeseries {
+			i := mimirpb.ShardByAllLabelAdapters(tenant, ts.Labels) % uint32(len(c.shards))
+			series[i] = append(series[i], ts)
+		}
+	}
+
+	shards := make([][]*mimirpb.WriteRequest, len(c.shards))
+	for i := range series {
+		shards[i] = c.chunk(req, series[i])
+	}
+	if len(req.Metadata) > 0 {
+		if len(shards[0]) == 0 {
+			shards[0] = []*mimirpb.WriteRequest{c.newRequest(req)}
+		}
+		shards[0][0].Metadata = req.Metadata
+	}
+	return shards
+}
+
+// chunk splits the series in requests of at most the max request bytes. A
+// series larger than that on its own is sent in its own request.
+func (c *shardingClient) chunk(req *mimirpb.WriteRequest, series []mimirpb.PreallocTimeseries) []*mimirpb.WriteRequest {
+	if len(series) == 0 {
+		return nil
+	}
+	if c.maxRequestBytes <= 0 {
+		shardReq := c.newRequest(req)
+		shardReq.Timeseries = series
+		return []*mimirpb.WriteRequest{shardReq}
+	}
+
+	var (
+		reqs    []*mimirpb.WriteRequest
+		current *mimirpb.WriteRequest
+		size    int
+	)
+	for _, ts := range series {
+		// The size of the series and of its field header in the request.
+		tsSize := ts.Size()
+		tsSize += 1 + sovSize(uint64(tsSize))
+		if current == nil || (size > 0 && size+tsSize > c.maxRequestBytes) {
+			current = c.newRequest(req)
+			reqs = append(reqs, current)
+			size = 0
+		}
+		current.Timeseries = append(current.Timeseries, ts)
+		size += tsSize
+	}
+	return reqs
+}
+
+func (c *shardingClient) newRequest(req *mimirpb.WriteRequest) *mimirpb.WriteRequest {
+	return &mimirpb.WriteRequest{
+		Source:              req.Source,
+		SkipLabelValidation: req.SkipLabelValidation,
+	}
+}
+
+// sovSize returns the size of x encoded as a protobuf varint.
+func sovSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// mergeShardErrors returns the most severe of the errors of the shards, so
+// that the write is retried if any of the shards can be retried.
+func mergeShardErrors(errs []error) error {
+	merged, failed := mostSevereError(errs)
+	if failed <= 1 {
+		return merged
+	}
+	return fmt.Errorf("%d of %d write shards failed: %w", failed, len(errs), merged)
+}
+
+// mostSevereError returns the most severe of the errors, and the number of
+// non-nil errors.
+func mostSevereError(errs []error) (merged error, failed int) {
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed++
+		if merged == nil || errorSeverity(err) > errorSeverity(merged) {
+			merged = err
+		}
+	}
+	return merged, failed
+}
+
+// errorSeverity ranks the errors by how much they affect the write, from the
+// client errors that won't succeed if retried to the server and unexpected
+// errors.
+func errorSeverity(err error) int {
+	switch {
+	case errors.As(err, &errorx.TooManyRequests{}):
+		return 2
+	case errors.As(err, &errorx.RequestTimeout{}):
+		return 3
+	}
+	var errx errorx.Error
+	if errors.As(err, &errx) && errx.HTTPStatusCode() < http.StatusInternalServerError {
+		return 1
+	}
+	return 4
+}
@@ -0,0 +1,173 @@
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+// requestsClient records the requests it receives, failing the requests
+// with a series named after a key of errs.
+type requestsClient struct {
+	mtx  sync.Mutex
+	reqs []*mimirpb.WriteRequest
+	errs map[string]error
+}
+
+func (c *requestsClient) Write(_ context.Context, req *mimirpb.WriteRequest) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, ts := range req.Timeseries {
+		if err, ok := c.errs[metricName(ts.Labels)]; ok {
+			return err
+		}
+	}
+	c.reqs = append(c.reqs, req)
+	return nil
+}
+
+func newTestShardingClient(cfg ShardingConfig, client Client) Client {
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measure", mock.Anything, mock.Anything, mock.Anything)
+	return NewShardingClient(cfg, client, recorderMock, opentracing.NoopTracer{}, time.Now)
+}
+
+func TestShardingClient(t *testing.T) {
+	var names []string
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("series_%03d", i))
+	}
+	req := testWriteRequest(names...)
+	req.Metadata = []*mimirpb.MetricMetadata{{MetricFamilyName: "series_000", Type: mimirpb.GAUGE}}
+
+	client := &requestsClient{}
+	underTest := newTestShardingClient(ShardingConfig{Shards: 4}, client)
+	ctx := user.InjectOrgID(context.Background(), "some-org-id")
+	require.NoError(t, underTest.Write(ctx, req))
+
+	require.Len(t, client.reqs, 4)
+	var (
+		received []string
+		metadata int
+	)
+	for _, shardReq := range client.reqs {
+		shard := mimirpb.ShardByAllLabelAdapters("some-org-id", shardReq.Timeseries[0].Labels) % 4
+		for _, ts := range shardReq.Timeseries {
+			assert.Equal(t, shard, mimirpb.ShardByAllLabelAdapters("some-org-id", ts.Labels)%4)
+			received = append(received, metricName(ts.Labels))
+		}
+		metadata += len(shardReq.Metadata)
+	}
+	assert.ElementsMatch(t, names, received)
+	assert.Equal(t, 1, metadata)
+}
+
+func TestShardingClient_MaxRequestBytes(t *testing.T) {
+	var names []string
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("series_%03d", i))
+	}
+	req := testWriteRequest(names...)
+	seriesSize := req.Size() / len(names)
+
+	client := &requestsClient{}
+	underTest := newTestShardingClient(ShardingConfig{Shards: 1, MaxRequestBytes: 3 * seriesSize}, client)
+	require.NoError(t, underTest.Write(user.InjectOrgID(context.Background(), "some-org-id"), req))
+
+	require.Len(t, client.reqs, 4)
+	var received []string
+	for _, shardReq := range client.reqs {
+		assert.LessOrEqual(t, shardReq.Size(), 3*seriesSize)
+		for _, ts := range shardReq.Timeseries {
+			received = append(received, metricName(ts.Labels))
+		}
+	}
+	// The requests of a shard are sent in order.
+	assert.Equal(t, names, received)
+}
+
+func TestShardingClient_Errors(t *testing.T) {
+	badRequest := errorx.BadRequest{Msg: "bad metrics write request"}
+	tooManyRequests := errorx.TooManyRequests{Msg: "too many write requests"}
+	internal := errorx.Internal{Msg: "failed writing metrics"}
+
+	// A series in each of the shards, so that each shard can fail on its own.
+	var (
+		req       = &mimirpb.WriteRequest{}
+		shardName = map[uint32]string{}
+	)
+	for i := 0; len(shardName) < 4; i++ {
+		name := fmt.Sprintf("series_%03d", i)
+		series := testWriteRequest(name).Timeseries
+		shard := mimirpb.ShardByAllLabelAdapters("some-org-id", series[0].Labels) % 4
+		if _, ok := shardName[shard]; !ok {
+			shardName[shard] = name
+			req.Timeseries = append(req.Timeseries, series...)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		errs   map[uint32]error
+		expErr error
+	}{
+		"no errors": {},
+		"single error": {
+			errs:   map[uint32]error{0: badRequest},
+			expErr: badRequest,
+		},
+		"the most severe error is returned": {
+			errs:   map[uint32]error{0: badRequest, 1: internal, 2: tooManyRequests, 3: badRequest},
+			expErr: internal,
+		},
+		"rate limits are more severe than bad requests": {
+			errs:   map[uint32]error{0: badRequest, 1: tooManyRequests, 2: badRequest, 3: badRequest},
+			expErr: tooManyRequests,
+		},
+		"unexpected errors are the most severe": {
+			errs:   map[uint32]error{0: context.Canceled, 1: internal, 2: internal, 3: internal},
+			expErr: context.Canceled,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			errs := map[string]error{}
+			for shard, err := range tc.errs {
+				errs[shardName[shard]] = err
+			}
+
+			underTest := newTestShardingClient(ShardingConfig{Shards: 4}, &requestsClient{errs: errs})
+			err := underTest.Write(user.InjectOrgID(context.Background(), "some-org-id"), req)
+			if tc.expErr == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, tc.expErr), "expected %v, got %v", tc.expErr, err)
+		})
+	}
+}
+
+func TestShardingClient_MeasuresShards(t *testing.T) {
+	recorderMock := &MockRecorder{}
+	recorderMock.On("measure", "Write_shard_0", mock.Anything, nil).Once()
+	recorderMock.On("measure", "Write_shard_1", mock.Anything, nil).Once()
+	defer recorderMock.AssertExpectations(t)
+
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("series_%03d", i))
+	}
+	underTest := NewShardingClient(ShardingConfig{Shards: 2}, &requestsClient{}, recorderMock, opentracing.NoopTracer{}, time.Now)
+	require.NoError(t, underTest.Write(user.InjectOrgID(context.Background(), "some-org-id"), testWriteRequest(names...)))
+}
@@ -0,0 +1,149 @@
+package remotewrite
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/prometheus/model/labels"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+const (
+	// ProtocolVersion1 sends prometheus.WriteRequest messages.
+	ProtocolVersion1 = "1.0"
+	// ProtocolVersion2 sends io.prometheus.write.v2.Request messages, where
+	// the label names and values are interned in a symbol table.
+	ProtocolVersion2 = "2.0"
+
+	remoteWriteVersion1HeaderValue = "0.1.0"
+	remoteWriteVersion2HeaderValue = "2.0.0"
+
+	contentTypeProtobuf        = "application/x-protobuf"
+	contentTypeWriteV2Protobuf = contentTypeProtobuf + ";proto=io.prometheus.write.v2.Request"
+
+	writtenSamplesHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	writtenHistogramsHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	writtenExemplarsHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// writeStats are the number of samples, histograms and exemplars of a write.
+type writeStats struct {
+	samples    int
+	histograms int
+	exemplars  int
+}
+
+func (s writeStats) empty() bool {
+	return s.samples == 0 && s.histograms == 0 && s.exemplars == 0
+}
+
+func requestStats(req *mimirpb.WriteRequest) writeStats {
+	var stats writeStats
+	for _, series := range req.Timeseries {
+		stats.samples += len(series.Samples)
+		stats.histograms += len(series.Histograms)
+		stats.exemplars += len(series.Exemplars)
+	}
+	return stats
+}
+
+// writtenStats reads the number of samples, histograms and exemplars written
+// from the response headers of a Remote Write 2.0 receiver. It returns false if
+// none of the headers is set.
+func writtenStats(header http.Header) (writeStats, bool) {
+	var (
+		stats writeStats
+		found bool
+	)
+	for name, count := range map[string]*int{
+		writtenSamplesHeader:    &stats.samples,
+		writtenHistogramsHeader: &stats.histograms,
+		writtenExemplarsHeader:  &stats.exemplars,
+	} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		found = true
+		// Invalid values are counted as nothing written.
+		*count, _ = strconv.Atoi(value)
+	}
+	return stats, found
+}
+
+// toWriteV2Request converts a Remote Write 1.0 request to 2.0. The metadata of
+// the request is attached to the series of its metric family, metadata of
+// families without series in the request is dropped. Remote Write 2.0 metadata
+// is per series, so the series of a family with conflicting metadata, which
+// can't be told apart, get none.
+func toWriteV2Request(req *mimirpb.WriteRequest) *writev2.Request {
+	metadata := make(map[string]*mimirpb.MetricMetadata, len(req.Metadata))
+	for _, md := range req.Metadata {
+		if prev, ok := metadata[md.MetricFamilyName]; ok {
+			if prev != nil && (prev.Type != md.Type || prev.Unit != md.Unit || prev.Help != md.Help) {
+				metadata[md.MetricFamilyName] = nil
+			}
+			continue
+		}
+		metadata[md.MetricFamilyName] = md
+	}
+
+	symbols := writev2.NewSymbolTable()
+	timeseries := make([]writev2.TimeSeries, 0, len(req.Timeseries))
+	for _, series := range req.Timeseries {
+		ts := writev2.TimeSeries{
+			LabelsRefs: symbolizeLabelAdapters(&symbols, series.Labels),
+			Samples:    make([]writev2.Sample, 0, len(series.Samples)),
+		}
+		for _, s := range series.Samples {
+			ts.Samples = append(ts.Samples, writev2.Sample{Value: s.Value, Timestamp: s.TimestampMs})
+		}
+		for i := range series.Histograms {
+			h := &series.Histograms[i]
+			if h.IsFloatHistogram() {
+				ts.Histograms = append(ts.Histograms, writev2.FromFloatHistogram(h.Timestamp, mimirpb.FromFloatHistogramProtoToFloatHistogram(h)))
+			} else {
+				ts.Histograms = append(ts.Histograms, writev2.FromIntHistogram(h.Timestamp, mimirpb.FromHistogramProtoToHistogram(h)))
+			}
+		}
+		for _, e := range series.Exemplars {
+			ts.Exemplars = append(ts.Exemplars, writev2.Exemplar{
+				LabelsRefs: symbolizeLabelAdapters(&symbols, e.Labels),
+				Value:      e.Value,
+				Timestamp:  e.TimestampMs,
+			})
+		}
+		if md := metadata[metricName(series.Labels)]; md != nil {
+			ts.Metadata = writev2.Metadata{
+				// Both enums have the same values.
+				Type:    writev2.Metadata_MetricType(md.Type),
+				HelpRef: symbols.Symbolize(md.Help),
+				UnitRef: symbols.Symbolize(md.Unit),
+			}
+		}
+		timeseries = append(timeseries, ts)
+	}
+
+	return &writev2.Request{
+		Symbols:    symbols.Symbols(),
+		Timeseries: timeseries,
+	}
+}
+
+func symbolizeLabelAdapters(symbols *writev2.SymbolsTable, lbls []mimirpb.LabelAdapter) []uint32 {
+	refs := make([]uint32, 0, 2*len(lbls))
+	for _, l := range lbls {
+		refs = append(refs, symbols.Symbolize(l.Name), symbols.Symbolize(l.Value))
+	}
+	return refs
+}
+
+func metricName(lbls []mimirpb.LabelAdapter) string {
+	for _, l := range lbls {
+		if l.Name == labels.MetricName {
+			return l.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/prometheus/prometheus/model/labels"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir-graphite/v2/pkg/errorx"
+)
+
+func graphiteWriteRequest() *mimirpb.WriteRequest {
+	series := func(nodes ...string) mimirpb.PreallocTimeseries {
+		lbls := []mimirpb.LabelAdapter{}
+		for i, node := range nodes {
+			lbls = append(lbls, mimirpb.LabelAdapter{Name: fmt.Sprintf("__n%03d__", i), Value: node})
+		}
+		lbls = append(lbls, mimirpb.LabelAdapter{Name: "__name__", Value: "graphite_untagged"})
+		return mimirpb.PreallocTimeseries{TimeSeries: &mimirpb.TimeSeries{
+			Labels:  lbls,
+			Samples: []mimirpb.Sample{{Value: 1, TimestampMs: 1600000000000}},
+		}}
+	}
+	return &mimirpb.WriteRequest{
+		Timeseries: []mimirpb.PreallocTimeseries{
+			series("servers", "host1", "cpu"),
+			series("servers", "host2", "cpu"),
+		},
+		Metadata: []*mimirpb.MetricMetadata{
+			{MetricFamilyName: "graphite_untagged", Type: mimirpb.GAUGE, Unit: "seconds"},
+			{MetricFamilyName: "no_series", Type: mimirpb.COUNTER},
+		},
+	}
+}
+
+func TestToWriteV2Request(t *testing.T) {
+	req := toWriteV2Request(graphiteWriteRequest())
+
+	// The label names and values are only sent once.
+	assert.ElementsMatch(t, []string{"", "__n000__", "servers", "__n001__", "host1", "host2", "__n002__", "cpu", "__name__", "graphite_untagged", "seconds"}, req.Symbols)
+	require.Len(t, req.Timeseries, 2)
+
+	var b labels.ScratchBuilder
+	assert.Equal(t, labels.FromStrings("__n000__", "servers", "__n001__", "host2", "__n002__", "cpu", "__name__", "graphite_untagged"), req.Timeseries[1].ToLabels(&b, req.Symbols))
+	assert.Equal(t, []writev2.Sample{{Value: 1, Timestamp: 1600000000000}}, req.Timeseries[1].Samples)
+	assert.Equal(t, writev2.Metadata_METRIC_TYPE_GAUGE, req.Timeseries[1].Metadata.Type)
+	assert.Equal(t, "seconds", req.Symbols[req.Timeseries[1].Metadata.UnitRef])
+	assert.Equal(t, "", req.Symbols[req.Timeseries[1].Metadata.HelpRef])
+}
+
+func TestToWriteV2Request_ConflictingMetadata(t *testing.T) {
+	in := graphiteWriteRequest()
+	in.Metadata = append(in.Metadata, &mimirpb.MetricMetadata{MetricFamilyName: "graphite_untagged", Type: mimirpb.COUNTER})
+	req := toWriteV2Request(in)
+
+	// The series of the family could have either type, so they get none.
+	require.Len(t, req.Timeseries, 2)
+	for _, ts := range req.Timeseries {
+		assert.Equal(t, writev2.Metadata{}, ts.Metadata)
+	}
+	assert.NotContains(t, req.Symbols, "seconds")
+}
+
+func TestHTTPRemoteWriteClient_WriteV2(t *testing.T) {
+	for name, tc := range map[string]struct {
+		writtenHeaders map[string]string
+		expWritten     []interface{}
+		expErr         bool
+	}{
+		"written headers are recorded": {
+			writtenHeaders: map[string]string{writtenSamplesHeader: "2", writtenHistogramsHeader: "0", writtenExemplarsHeader: "0"},
+			expWritten:     []interface{}{2, 0, 0},
+		},
+		"missing written headers fail the write": {
+			expErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				assert.Equal(t, "application/x-protobuf;proto=io.prometheus.write.v2.Request", req.Header.Get("Content-Type"))
+				assert.Equal(t, "2.0.0", req.Header.Get("X-Prometheus-Remote-Write-Version"))
+
+				body, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+				data, err := snappy.Decode(nil, body)
+				require.NoError(t, err)
+				var writeReq writev2.Request
+				require.NoError(t, writeReq.Unmarshal(data))
+				assert.Len(t, writeReq.Timeseries, 2)
+
+				for name, value := range tc.writtenHeaders {
+					rw.Header().Set(name, value)
+				}
+				rw.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			recorderMock := &MockRecorder{}
+			if tc.expWritten != nil {
+				recorderMock.On("measureWritten", tc.expWritten...).Once()
+			}
+			defer recorderMock.AssertExpectations(t)
+
+			client, err := NewClient(Config{
+				Endpoint:        srv.URL,
+				Timeout:         time.Second,
+				ProtocolVersion: ProtocolVersion2,
+			}, recorderMock, nil)
+			require.NoError(t, err)
+
+			err = client.Write(user.InjectOrgID(context.Background(), "some-org-id"), graphiteWriteRequest())
+			if tc.expErr {
+				require.ErrorAs(t, err, &errorx.Internal{})
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewClient_InvalidProtocolVersion(t *testing.T) {
+	_, err := NewClient(Config{Endpoint: "http://localhost", ProtocolVersion: "3.0"}, &MockRecorder{}, nil)
+	require.Error(t, err)
+}
+
+func TestWrittenStats(t *testing.T) {
+	_, ok := writtenStats(http.Header{})
+	assert.False(t, ok)
+
+	header := http.Header{}
+	header.Set(writtenSamplesHeader, "10")
+	header.Set(writtenExemplarsHeader, "1")
+	stats, ok := writtenStats(header)
+	assert.True(t, ok)
+	assert.Equal(t, writeStats{samples: 10, exemplars: 1}, stats)
+}
@@ -36,22 +36,31 @@ func (l RequestLimits) Wrap(next http.Handler) http.Handler {
 		log, ctx := spanlogger.NewWithLogger(r.Context(), l.logger, "middleware.RequestLimits.Wrap")
 		defer log.Finish()
 
+		// The server never reads more than the declared Content-Length, so
+		// bodies of a known size within the limit can be streamed to the
+		// handler instead of being buffered here.
+		if r.ContentLength > l.maxRequestBodySize {
+			msg := fmt.Sprintf("trying to send message larger than max (%d vs %d)", r.ContentLength, l.maxRequestBodySize)
+			_ = level.Warn(log).Log("msg", msg)
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.ContentLength >= 0 {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		reader := io.LimitReader(r.Body, int64(l.maxRequestBodySize)+1)
 		body, err := io.ReadAll(reader)
 		if err != nil {
 			_ = level.Warn(log).Log("msg", "failed to read request body", "err", err)
 
-			switch {
-			case isNetworkError(err):
-				http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusRequestTimeout)
-				return
-			case errors.Is(err, context.Canceled) || errors.Is(err, io.ErrUnexpectedEOF):
-				http.Error(w, fmt.Sprintf("failed to read request body: %v", err), StatusClientClosedRequest)
-				return
-			default:
-				http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusInternalServerError)
-				return
+			status, ok := BodyReadErrorStatus(err)
+			if !ok {
+				status = http.StatusInternalServerError
 			}
+			http.Error(w, fmt.Sprintf("failed to read request body: %v", err), status)
+			return
 		}
 		if int64(len(body)) > l.maxRequestBodySize {
 			msg := fmt.Sprintf("trying to send message larger than max (%d vs %d)", len(body), l.maxRequestBodySize)
@@ -66,6 +75,20 @@ func (l RequestLimits) Wrap(next http.Handler) http.Handler {
 	})
 }
 
+// BodyReadErrorStatus returns the status of a request whose body couldn't be
+// read because of the client: 408 on timeouts and 499 when the client went
+// away. It returns false for other errors.
+func BodyReadErrorStatus(err error) (int, bool) {
+	switch {
+	case isNetworkError(err):
+		return http.StatusRequestTimeout, true
+	case errors.Is(err, context.Canceled) || errors.Is(err, io.ErrUnexpectedEOF):
+		return StatusClientClosedRequest, true
+	default:
+		return 0, false
+	}
+}
+
 // isNetworkError determines if an error is caused by a network timeout
 func isNetworkError(err error) bool {
 	if err == nil {
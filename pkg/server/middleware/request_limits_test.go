@@ -19,6 +19,7 @@ func TestRequestLimitsMiddleware(t *testing.T) {
 		name               string
 		maxRequestBodySize int64
 		inputBody          []byte
+		unknownLength      bool
 		expectedStatus     int
 	}{
 		{
@@ -44,6 +45,20 @@ func TestRequestLimitsMiddleware(t *testing.T) {
 			inputBody:          []byte(strings.Repeat("a", 1*mb)),
 			expectedStatus:     http.StatusRequestEntityTooLarge,
 		},
+		{
+			name:               "requests of unknown length with body size below max should return 200",
+			maxRequestBodySize: 1 * mb,
+			inputBody:          []byte(strings.Repeat("a", 512*kb)),
+			unknownLength:      true,
+			expectedStatus:     http.StatusOK,
+		},
+		{
+			name:               "requests of unknown length with body size greater than max should fail with 413",
+			maxRequestBodySize: 0.5 * mb,
+			inputBody:          []byte(strings.Repeat("a", 1*mb)),
+			unknownLength:      true,
+			expectedStatus:     http.StatusRequestEntityTooLarge,
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			middleware := NewRequestLimitsMiddleware(tc.maxRequestBodySize, log.NewNopLogger())
@@ -56,6 +71,9 @@ func TestRequestLimitsMiddleware(t *testing.T) {
 				"https://example.com",
 				bytes.NewReader(tc.inputBody),
 			)
+			if tc.unknownLength {
+				req.ContentLength = -1
+			}
 			resp := httptest.NewRecorder()
 
 			handler.ServeHTTP(resp, req)
@@ -65,6 +83,24 @@ func TestRequestLimitsMiddleware(t *testing.T) {
 	}
 }
 
+func TestRequestLimitsMiddlewareStreamsKnownLengthBodies(t *testing.T) {
+	body := bytes.NewReader([]byte(strings.Repeat("a", 512*kb)))
+
+	middleware := NewRequestLimitsMiddleware(1*mb, log.NewNopLogger())
+	handler := middleware.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is handed over as is instead of being read into a buffer.
+		assert.Equal(t, 512*kb, body.Len())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("POST", "https://example.com", body)
+	resp := httptest.NewRecorder()
+
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
 type errReader struct {
 	mock.Mock
 }